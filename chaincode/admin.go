@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ListUsers retrieves the users of the admin's org, only those with the given role unless role is empty
+func (c *EMRChaincode) ListUsers(ctx contractapi.TransactionContextInterface, role string) ([]User, error) {
+	_, mspID, err := orgAdmin(ctx, "list users")
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(userObjectType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	users := []User{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next user: %v", err)
+		}
+
+		var user User
+		err = json.Unmarshal(queryResponse.Value, &user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal user: %v", err)
+		}
+		if user.MSPID == mspID && (role == "" || user.Role == role) {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+// DeactivateUser deactivates a user of the admin's org whatever its status, revokes every grant it holds, withdraws
+// the consent directives given to it and removes it as a proxy, for example when a doctor leaves a hospital, it returns
+// the number of revoked grants, directives and proxies
+// Unlike SetUserStatus the access is not restored if the user is re-activated
+// Emergency grants are not in the grantee index, they are left to expire and give inactive users no access meanwhile
+func (c *EMRChaincode) DeactivateUser(ctx contractapi.TransactionContextInterface, commonName string) (int, error) {
+	adminID, mspID, err := orgAdmin(ctx, "deactivate users")
+	if err != nil {
+		return 0, err
+	}
+
+	user, err := c.orgUser(ctx, mspID, commonName)
+	if err != nil {
+		return 0, err
+	}
+	if user.UserID == adminID {
+		return 0, fmt.Errorf("an admin cannot deactivate themselves")
+	}
+
+	emrs, err := c.indexedRecords(ctx, granteeIndexObjectType, user.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, emr := range emrs {
+		heldByUser := func(g Grant) bool { return g.GranteeID == user.UserID }
+		grants := len(emr.SharedWithDoctors) + len(emr.SharedWithHospitals)
+		emr.SharedWithDoctors = slices.DeleteFunc(emr.SharedWithDoctors, heldByUser)
+		emr.SharedWithHospitals = slices.DeleteFunc(emr.SharedWithHospitals, heldByUser)
+		revoked += grants - len(emr.SharedWithDoctors) - len(emr.SharedWithHospitals)
+
+		err = c.putRecord(ctx, &emr)
+		if err != nil {
+			return 0, err
+		}
+
+		err = delIndexEntry(ctx, granteeIndexObjectType, user.UserID, emr.EMRID)
+		if err != nil {
+			return 0, err
+		}
+
+		if emr.Encrypted {
+			err = delWrappedKey(ctx, &emr, user.UserID)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	withdrawn, err := withdrawGranteeDirectives(ctx, user.UserID)
+	if err != nil {
+		return 0, err
+	}
+	revoked += withdrawn
+
+	removed, err := removeHeldProxies(ctx, user.UserID)
+	if err != nil {
+		return 0, err
+	}
+	revoked += removed
+
+	user.Status = userStatusDeactivated
+	err = c.putUserStatus(ctx, user, adminID)
+	if err != nil {
+		return 0, err
+	}
+
+	return revoked, nil
+}
+
+// withdrawGranteeDirectives deletes the consent directives given to a grantee by every patient and returns their number
+func withdrawGranteeDirectives(ctx contractapi.TransactionContextInterface, granteeID string) (int, error) {
+	// Directives are keyed by patient first, so those of the grantee are found by visiting every directive
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(consentObjectType, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get consent directives: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var keys []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get next consent directive: %v", err)
+		}
+
+		var directive ConsentDirective
+		err = json.Unmarshal(queryResponse.Value, &directive)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unmarshal consent directive: %v", err)
+		}
+		if directive.GranteeID == granteeID {
+			keys = append(keys, queryResponse.Key)
+		}
+	}
+
+	for _, key := range keys {
+		err = ctx.GetStub().DelState(key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete consent directive: %v", err)
+		}
+	}
+	return len(keys), nil
+}
+
+// removeHeldProxies deletes the proxies held by a user for every patient and returns their number
+func removeHeldProxies(ctx contractapi.TransactionContextInterface, proxyID string) (int, error) {
+	// Proxies are keyed by patient first, so those held by the user are found by visiting every proxy
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(proxyObjectType, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get proxies: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var keys []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get next proxy: %v", err)
+		}
+
+		var proxy Proxy
+		err = json.Unmarshal(queryResponse.Value, &proxy)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unmarshal proxy: %v", err)
+		}
+		if proxy.ProxyID == proxyID {
+			keys = append(keys, queryResponse.Key)
+		}
+	}
+
+	for _, key := range keys {
+		err = ctx.GetStub().DelState(key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete proxy: %v", err)
+		}
+	}
+	return len(keys), nil
+}
+
+// ReassignRecordOwner makes a doctor or hospital of the admin's org the owner of a record in place of the current one
+// ownerRole is doctor or hospital, the previous owner keeps the grants it holds on the record but loses ownership
+// Reassigning an encrypted record requires the data key wrapped for the new owner in the transient map under the "wrappedKey" key
+func (c *EMRChaincode) ReassignRecordOwner(ctx contractapi.TransactionContextInterface, emrID string, ownerRole string, ownerCommonName string) error {
+	adminID, mspID, err := orgAdmin(ctx, "reassign records")
+	if err != nil {
+		return err
+	}
+
+	if ownerRole != "doctor" && ownerRole != "hospital" {
+		return fmt.Errorf("invalid owner role: %s", ownerRole)
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return err
+	}
+
+	recordMSPID, err := c.recordMSPID(ctx, emr)
+	if err != nil {
+		return err
+	}
+	if recordMSPID != mspID {
+		return fmt.Errorf("this admin is not authorized to manage records of another org")
+	}
+
+	owner, err := c.orgUser(ctx, mspID, ownerCommonName)
+	if err != nil {
+		return err
+	}
+	if owner.Role != ownerRole {
+		return fmt.Errorf("user with CommonName %s is not a %s", ownerCommonName, ownerRole)
+	}
+	if !owner.isActive() {
+		return fmt.Errorf("user with CommonName %s is %s and cannot own records", ownerCommonName, owner.Status)
+	}
+
+	ownerID := &emr.DoctorID
+	if ownerRole == "hospital" {
+		ownerID = &emr.HospitalID
+	}
+	previousOwnerID := *ownerID
+	if previousOwnerID == owner.UserID {
+		return fmt.Errorf("user with CommonName %s already owns record with ID %s", ownerCommonName, emrID)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	*ownerID = owner.UserID
+	emr.LastModified = now.Format(time.RFC3339)
+
+	if emr.Encrypted {
+		wrappedKey, err := transientWrappedKey(ctx)
+		if err != nil {
+			return err
+		}
+		err = putWrappedKey(ctx, emrID, owner.UserID, wrappedKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.putRecord(ctx, emr)
+	if err != nil {
+		return err
+	}
+
+	err = putIndexEntry(ctx, ownerIndexObjectType, owner.UserID, emrID)
+	if err != nil {
+		return err
+	}
+
+	// The same user can own a record both as its doctor and as its hospital
+	if previousOwnerID != "" && previousOwnerID != emr.DoctorID && previousOwnerID != emr.HospitalID {
+		err = delIndexEntry(ctx, ownerIndexObjectType, previousOwnerID, emrID)
+		if err != nil {
+			return err
+		}
+
+		held := slices.ContainsFunc(slices.Concat(emr.SharedWithDoctors, emr.SharedWithHospitals), func(g Grant) bool { return g.GranteeID == previousOwnerID })
+		if emr.Encrypted && !held {
+			err = delWrappedKey(ctx, emr, previousOwnerID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return setEvent(ctx, EventRecordReassigned, RecordReassignedEvent{
+		EMRID:           emrID,
+		PatientID:       emr.PatientID,
+		OwnerRole:       ownerRole,
+		PreviousOwnerID: previousOwnerID,
+		OwnerID:         owner.UserID,
+		ReassignedBy:    adminID,
+	})
+}
+
+// RepairUser completes the entry of a user registered by an earlier version of the chaincode or left inconsistent
+// Users without an org are given the admin's org if their certificate was issued by the CA that issued the admin's,
+// users without a status are made active and the client ID mapping of each of their certificates is rewritten
+func (c *EMRChaincode) RepairUser(ctx contractapi.TransactionContextInterface, commonName string) error {
+	_, mspID, err := orgAdmin(ctx, "repair users")
+	if err != nil {
+		return err
+	}
+
+	user, err := c.GetUser(ctx, commonName)
+	if err != nil {
+		return err
+	}
+
+	if user.MSPID == "" {
+		// Affiliations are attributes any org's CA can issue, the issuer of a certificate is set by the CA of its org
+		cert, err := ctx.GetClientIdentity().GetX509Certificate()
+		if err != nil {
+			return fmt.Errorf("failed to get X.509 certificate: %v", err)
+		}
+		issuer, ok := clientIDIssuer(user.UserID)
+		if !ok || issuer != cert.Issuer.String() {
+			return fmt.Errorf("this admin is not authorized to manage users of another org")
+		}
+		user.MSPID = mspID
+	}
+	if user.MSPID != mspID {
+		return fmt.Errorf("this admin is not authorized to manage users of another org")
+	}
+	if user.Status == "" {
+		user.Status = userStatusActive
+	}
+	user.CertificateIDs = user.certificateIDs()
+
+	err = putUser(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	for _, certificateID := range user.CertificateIDs {
+		err = putUserID(ctx, certificateID, user.CommonName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientIDIssuer returns the issuer DN of the certificate a client ID was derived from
+// Client IDs are the base64 encoding of "x509::<subject DN>::<issuer DN>"
+func clientIDIssuer(clientID string) (string, bool) {
+	id, err := base64.StdEncoding.DecodeString(clientID)
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.SplitN(string(id), "::", 3)
+	if len(parts) != 3 || parts[0] != "x509" {
+		return "", false
+	}
+	return parts[2], true
+}
+
+// RepairRecordIndexes rewrites the patient, owner and grantee index entries of a record of the admin's org
+func (c *EMRChaincode) RepairRecordIndexes(ctx contractapi.TransactionContextInterface, emrID string) error {
+	_, mspID, err := orgAdmin(ctx, "repair records")
+	if err != nil {
+		return err
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return err
+	}
+
+	recordMSPID, err := c.recordMSPID(ctx, emr)
+	if err != nil {
+		return err
+	}
+	if recordMSPID != mspID {
+		return fmt.Errorf("this admin is not authorized to manage records of another org")
+	}
+
+	return c.indexRecord(ctx, emr)
+}
+
+// orgAdmin returns the ID and MSP ID of the client if it is an admin, action completes the error returned to other roles
+// Admins only manage the users and records of their own org
+func orgAdmin(ctx contractapi.TransactionContextInterface, action string) (string, string, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found || role != "admin" {
+		return "", "", fmt.Errorf("only admins can %s", action)
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get MSP ID: %v", err)
+	}
+
+	return clientID, mspID, nil
+}
+
+// orgUser retrieves a user managed by an admin of the given org
+func (c *EMRChaincode) orgUser(ctx contractapi.TransactionContextInterface, mspID string, commonName string) (*User, error) {
+	user, err := c.GetUser(ctx, commonName)
+	if err != nil {
+		return nil, err
+	}
+	if user.MSPID == "" {
+		return nil, fmt.Errorf("user with CommonName %s has no org, it must be repaired with RepairUser first", commonName)
+	}
+	if user.MSPID != mspID {
+		return nil, fmt.Errorf("this admin is not authorized to manage users of another org")
+	}
+	return user, nil
+}
+
+// recordMSPID returns the org of a record, the org whose private data collection holds its content
+// Records created before private data collections have no collection, they belong to the org of their doctor or hospital
+func (c *EMRChaincode) recordMSPID(ctx contractapi.TransactionContextInterface, emr *EMR) (string, error) {
+	if emr.Collection != "" {
+		return strings.TrimSuffix(emr.Collection, "PrivateCollection"), nil
+	}
+
+	for _, ownerID := range []string{emr.DoctorID, emr.HospitalID} {
+		if ownerID == "" {
+			continue
+		}
+		owner, err := c.userByClientID(ctx, ownerID)
+		if err != nil {
+			return "", err
+		}
+		if owner != nil && owner.MSPID != "" {
+			return owner.MSPID, nil
+		}
+	}
+	return "", nil
+}
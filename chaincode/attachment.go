@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// attachmentObjectType is the composite key object type of attachments, keyed by EMR ID and document ID
+const attachmentObjectType = "attachment"
+
+// Attachment anchors a document stored off-chain, such as an imaging report or a lab file, to an EMR
+// Only its metadata is on the ledger, the document is checked against SHA256 when it is fetched from StorageURI
+type Attachment struct {
+	EMRID      string `json:"emrId"`
+	DocID      string `json:"docId"`
+	MediaType  string `json:"mediaType"`
+	SHA256     string `json:"sha256"` // Lowercase hex encoded SHA-256 of the document
+	SizeBytes  int64  `json:"sizeBytes"`
+	StorageURI string `json:"storageUri"`
+	AuthorID   string `json:"authorId"`
+	AttachedAt string `json:"attachedAt"`
+}
+
+// AttachDocument anchors an off-chain document to an EMR record
+// Attachments are immutable, only doctors and hospitals that can amend the record can attach documents to it
+func (c *EMRChaincode) AttachDocument(ctx contractapi.TransactionContextInterface, emrID string, docID string, mediaType string, sha256 string, sizeBytes int64, storageURI string) error {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("role attribute not found")
+	}
+
+	if docID == "" {
+		return fmt.Errorf("a document ID is required to attach a document")
+	}
+	if parsed, _, err := mime.ParseMediaType(mediaType); err != nil || !strings.Contains(parsed, "/") {
+		return fmt.Errorf("invalid media type: %s", mediaType)
+	}
+	sha256 = strings.ToLower(strings.TrimSpace(sha256))
+	if hash, err := hex.DecodeString(sha256); err != nil || len(hash) != 32 {
+		return fmt.Errorf("invalid document hash: %s", sha256)
+	}
+	if sizeBytes <= 0 {
+		return fmt.Errorf("invalid document size: %d bytes", sizeBytes)
+	}
+	if uri, err := url.Parse(storageURI); err != nil || uri.Scheme == "" {
+		return fmt.Errorf("invalid storage URI: %s", storageURI)
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return err
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	authorized, err := c.isAuthorizedToAmend(ctx, role, clientID, emr, now)
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("this %s is not authorized to attach documents to this record", role)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(attachmentObjectType, []string{emrID, docID})
+	if err != nil {
+		return fmt.Errorf("failed to create attachment key: %v", err)
+	}
+
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to get attachment: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("document with ID %s is already attached to record with ID %s", docID, emrID)
+	}
+
+	attachmentJSON, err := json.Marshal(Attachment{
+		EMRID:      emrID,
+		DocID:      docID,
+		MediaType:  mediaType,
+		SHA256:     sha256,
+		SizeBytes:  sizeBytes,
+		StorageURI: storageURI,
+		AuthorID:   clientID,
+		AttachedAt: now.Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachment: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, attachmentJSON)
+	if err != nil {
+		return fmt.Errorf("failed to write attachment: %v", err)
+	}
+
+	return setEvent(ctx, EventDocumentAttached, DocumentAttachedEvent{
+		EMRID:     emrID,
+		PatientID: emr.PatientID,
+		DocID:     docID,
+		AuthorID:  clientID,
+	})
+}
+
+// ListAttachments retrieves the documents attached to an EMR record, for clients that can read the record
+func (c *EMRChaincode) ListAttachments(ctx contractapi.TransactionContextInterface, emrID string) ([]Attachment, error) {
+	_, err := c.ReadRecord(ctx, emrID)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(attachmentObjectType, []string{emrID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachments: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	attachments := []Attachment{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next attachment: %v", err)
+		}
+
+		var attachment Attachment
+		err = json.Unmarshal(queryResponse.Value, &attachment)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal attachment: %v", err)
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// certificateLinkObjectType is the composite key object type of pending certificate links, keyed by certificate ID and CommonName
+const certificateLinkObjectType = "certlink"
+
+// CertificateLink is a request to link a new certificate, for example after a re-enrollment or a CA rotation, to a registered user
+// It is submitted with the new certificate and takes effect once an admin of the user's org approves it
+type CertificateLink struct {
+	CommonName    string `json:"CommonName"`
+	CertificateID string `json:"certificateId"`
+	RequestedAt   string `json:"requestedAt"`
+}
+
+// LinkCertificate requests to link the client's certificate to the user registered with a CommonName
+// The certificate can be used as the user once ApproveCertificateLink is called by an admin of the user's org
+func (c *EMRChaincode) LinkCertificate(ctx contractapi.TransactionContextInterface, commonName string) error {
+	certificateID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	linked, err := c.userByClientID(ctx, certificateID)
+	if err != nil {
+		return err
+	}
+	if linked != nil {
+		return fmt.Errorf("this certificate is already linked to user with CommonName %s", linked.CommonName)
+	}
+
+	user, err := c.GetUser(ctx, commonName)
+	if err != nil {
+		return err
+	}
+
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to get MSP ID: %v", err)
+	}
+	if user.MSPID == "" || mspID != user.MSPID {
+		return fmt.Errorf("this certificate cannot be linked to a user of another org")
+	}
+
+	// The certificate is used with the role of the user, so it must have been enrolled with that role
+	role, _, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if role != user.Role {
+		return fmt.Errorf("this certificate cannot be linked to a user with another role")
+	}
+
+	// A certificate can only wait to be linked to one user at a time
+	pending, err := pendingCertificateLink(ctx, certificateID)
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		return fmt.Errorf("this certificate is already waiting to be linked to user with CommonName %s", pending.CommonName)
+	}
+
+	key, err := certificateLinkKey(ctx, commonName, certificateID)
+	if err != nil {
+		return err
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	linkJSON, err := json.Marshal(CertificateLink{
+		CommonName:    commonName,
+		CertificateID: certificateID,
+		RequestedAt:   now.Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal certificate link: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, linkJSON)
+	if err != nil {
+		return fmt.Errorf("failed to write certificate link: %v", err)
+	}
+	return nil
+}
+
+// ApproveCertificateLink links a certificate requested with LinkCertificate to its user, only admins of the user's org can approve links
+func (c *EMRChaincode) ApproveCertificateLink(ctx contractapi.TransactionContextInterface, commonName string, certificateID string) error {
+	user, adminID, err := c.certificateManager(ctx, commonName)
+	if err != nil {
+		return err
+	}
+
+	key, err := certificateLinkKey(ctx, commonName, certificateID)
+	if err != nil {
+		return err
+	}
+
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to get certificate link: %v", err)
+	}
+	if existing == nil {
+		return fmt.Errorf("no link of certificate %s to user with CommonName %s was requested", certificateID, commonName)
+	}
+
+	// The certificate may have registered a user since the link was requested
+	linked, err := c.userByClientID(ctx, certificateID)
+	if err != nil {
+		return err
+	}
+	if linked != nil {
+		return fmt.Errorf("certificate %s is already linked to user with CommonName %s", certificateID, linked.CommonName)
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete certificate link: %v", err)
+	}
+
+	user.CertificateIDs = append(user.certificateIDs(), certificateID)
+	err = putUser(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	err = putUserID(ctx, certificateID, commonName)
+	if err != nil {
+		return err
+	}
+
+	return setEvent(ctx, EventCertificateLinked, CertificateLinkedEvent{
+		UserID:        user.UserID,
+		CertificateID: certificateID,
+		ApprovedBy:    adminID,
+	})
+}
+
+// UnlinkCertificate stops a certificate from being used as its user, for example when it is lost or compromised
+// Only admins of the user's org can unlink certificates, the last certificate of a user cannot be unlinked
+// The certificate stays mapped to the user so that it is rejected rather than treated as an unregistered client
+func (c *EMRChaincode) UnlinkCertificate(ctx contractapi.TransactionContextInterface, commonName string, certificateID string) error {
+	user, adminID, err := c.certificateManager(ctx, commonName)
+	if err != nil {
+		return err
+	}
+
+	certificateIDs := user.certificateIDs()
+	index := slices.Index(certificateIDs, certificateID)
+	if index == -1 {
+		return fmt.Errorf("certificate %s is not linked to user with CommonName %s", certificateID, commonName)
+	}
+	if len(certificateIDs) == 1 {
+		return fmt.Errorf("the last certificate of user with CommonName %s cannot be unlinked", commonName)
+	}
+
+	user.CertificateIDs = slices.Delete(certificateIDs, index, index+1)
+	err = putUser(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	// Users registered before certificates could be linked may have no mapping for their registration certificate
+	err = putUserID(ctx, certificateID, commonName)
+	if err != nil {
+		return err
+	}
+
+	return setEvent(ctx, EventCertificateUnlinked, CertificateUnlinkedEvent{
+		UserID:        user.UserID,
+		CertificateID: certificateID,
+		UnlinkedBy:    adminID,
+	})
+}
+
+// certificateIDs returns the certificate IDs linked to the user
+func (u *User) certificateIDs() []string {
+	if len(u.CertificateIDs) == 0 {
+		return []string{u.UserID}
+	}
+	return u.CertificateIDs
+}
+
+// certificateManager returns the user whose certificates are managed and the ID of the client if it is an admin of the user's org
+func (c *EMRChaincode) certificateManager(ctx contractapi.TransactionContextInterface, commonName string) (*User, string, error) {
+	clientID, mspID, err := orgAdmin(ctx, "manage the certificates of users")
+	if err != nil {
+		return nil, "", err
+	}
+
+	user, err := c.orgUser(ctx, mspID, commonName)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, clientID, nil
+}
+
+// resolveCaller runs before every transaction of the contract, it rejects callers whose certificate was unlinked,
+// whose user is not active or whose certificate has another role than the user, and makes the client ID of certificates
+// linked to a user the stable ID of the user
+// Callers that are not registered are checked by each transaction
+func (c *EMRChaincode) resolveCaller(ctx *contractapi.TransactionContext) error {
+	certificateID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	user, err := c.userByClientID(ctx, certificateID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return nil
+	}
+	if !slices.Contains(user.certificateIDs(), certificateID) {
+		return fmt.Errorf("this certificate is no longer linked to user with CommonName %s", user.CommonName)
+	}
+	if !user.isActive() {
+		return fmt.Errorf("user with CommonName %s is %s", user.CommonName, user.Status)
+	}
+
+	// Transactions check the role attribute of the certificate, which must be the role the user registered with
+	role, _, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if role != user.Role {
+		return fmt.Errorf("this certificate does not have the role of user with CommonName %s", user.CommonName)
+	}
+
+	if certificateID != user.UserID {
+		ctx.SetClientIdentity(&linkedClientIdentity{ClientIdentity: ctx.GetClientIdentity(), userID: user.UserID})
+	}
+	return nil
+}
+
+// linkedClientIdentity is the identity of a caller using a certificate linked to a user, its ID is the stable ID of the user
+type linkedClientIdentity struct {
+	cid.ClientIdentity
+	userID string
+}
+
+// GetID returns the stable ID of the user the certificate is linked to
+func (id *linkedClientIdentity) GetID() (string, error) {
+	return id.userID, nil
+}
+
+// certificateLinkKey returns the world state key of a pending certificate link
+func certificateLinkKey(ctx contractapi.TransactionContextInterface, commonName string, certificateID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(certificateLinkObjectType, []string{certificateID, commonName})
+	if err != nil {
+		return "", fmt.Errorf("failed to create certificate link key: %v", err)
+	}
+	return key, nil
+}
+
+// pendingCertificateLink returns the link requested for a certificate that is waiting to be approved, nil if there is none
+func pendingCertificateLink(ctx contractapi.TransactionContextInterface, certificateID string) (*CertificateLink, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(certificateLinkObjectType, []string{certificateID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate links: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	if !resultsIterator.HasNext() {
+		return nil, nil
+	}
+	queryResponse, err := resultsIterator.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get next certificate link: %v", err)
+	}
+
+	var link CertificateLink
+	err = json.Unmarshal(queryResponse.Value, &link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal certificate link: %v", err)
+	}
+	return &link, nil
+}
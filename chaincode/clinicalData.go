@@ -0,0 +1,80 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ClinicalData is the structured content of original and amended record versions
+// It is validated against the embedded schema of its SchemaVersion before being written
+type ClinicalData struct {
+	SchemaVersion string       `json:"schemaVersion"`
+	Diagnosis     string       `json:"diagnosis"`
+	ICD10Codes    []string     `json:"icd10Codes,omitempty"`
+	Notes         string       `json:"notes,omitempty"`
+	Medications   []Medication `json:"medications,omitempty"`
+	Vitals        *Vitals      `json:"vitals,omitempty"`
+}
+
+// Medication is a medication prescribed in a record version
+type Medication struct {
+	Name      string `json:"name"`
+	Dose      string `json:"dose,omitempty"`
+	Frequency string `json:"frequency,omitempty"`
+}
+
+// Vitals are the vital signs measured during an encounter
+type Vitals struct {
+	HeartRate              int     `json:"heartRate,omitempty"`              // Beats per minute
+	SystolicBloodPressure  int     `json:"systolicBloodPressure,omitempty"`  // mmHg
+	DiastolicBloodPressure int     `json:"diastolicBloodPressure,omitempty"` // mmHg
+	RespiratoryRate        int     `json:"respiratoryRate,omitempty"`        // Breaths per minute
+	Temperature            float64 `json:"temperature,omitempty"`            // Degrees Celsius
+	OxygenSaturation       float64 `json:"oxygenSaturation,omitempty"`       // Percent
+}
+
+// clinicalDataSchemaVersion is the schema version new clients should write
+const clinicalDataSchemaVersion = "1"
+
+// clinicalDataSchemas holds one schema per version, named clinicalData.v<version>.json
+//
+//go:embed schemas/clinicalData.v*.json
+var clinicalDataSchemas embed.FS
+
+// validateClinicalData checks a clinical data document against the schema of the version it declares
+// Every violation is reported with the path of the field it concerns
+func validateClinicalData(content []byte) error {
+	var header struct {
+		SchemaVersion string `json:"schemaVersion"`
+	}
+	err := json.Unmarshal(content, &header)
+	if err != nil {
+		return fmt.Errorf("invalid clinical data: %v", err)
+	}
+	if header.SchemaVersion == "" {
+		return fmt.Errorf("invalid clinical data: schemaVersion is required, the current version is %s", clinicalDataSchemaVersion)
+	}
+
+	schema, err := clinicalDataSchemas.ReadFile("schemas/clinicalData.v" + header.SchemaVersion + ".json")
+	if err != nil {
+		return fmt.Errorf("invalid clinical data: unsupported schemaVersion %s", header.SchemaVersion)
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewBytesLoader(content))
+	if err != nil {
+		return fmt.Errorf("failed to validate clinical data: %v", err)
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	var messages []string
+	for _, resultError := range result.Errors() {
+		messages = append(messages, fmt.Sprintf("%s: %s", resultError.Field(), resultError.Description()))
+	}
+	return fmt.Errorf("invalid clinical data: %s", strings.Join(messages, "; "))
+}
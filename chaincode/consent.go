@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// consentObjectType is the composite key object type of consent directives, keyed by patient ID, grantee ID and directive ID
+const consentObjectType = "consent"
+
+// Scopes of consent directives
+const (
+	consentScopeAll      = "all"      // Every record of the patient, including records created later
+	consentScopeCategory = "category" // Records whose Category is the directive ScopeValue
+	consentScopeTag      = "tag"      // Records tagged with the directive ScopeValue
+)
+
+// ConsentDirective gives a doctor or hospital access to the records of a patient matching its scope, optionally until ExpiresAt
+// Directives are evaluated alongside the grants of each record, the grantee holds the permissions of both
+type ConsentDirective struct {
+	DirectiveID string   `json:"directiveId"` // ID of the transaction that added the directive
+	PatientID   string   `json:"patientId"`
+	GranteeID   string   `json:"granteeId"`
+	GranteeRole string   `json:"granteeRole"` // doctor or hospital
+	Scope       string   `json:"scope"`       // One of the consentScope constants
+	ScopeValue  string   `json:"scopeValue,omitempty" metadata:",optional"`
+	Permissions []string `json:"permissions"`
+	GrantedAt   string   `json:"grantedAt"`
+	ExpiresAt   string   `json:"expiresAt,omitempty" metadata:",optional"` // Empty for directives that never expire
+}
+
+// covers checks if the directive applies to the EMR at the given time
+func (d *ConsentDirective) covers(emr *EMR, now time.Time) bool {
+	if d.PatientID != emr.PatientID || !notExpired(d.ExpiresAt, now) {
+		return false
+	}
+
+	switch d.Scope {
+	case consentScopeAll:
+		return true
+	case consentScopeCategory:
+		return emr.Category == d.ScopeValue
+	case consentScopeTag:
+		return slices.Contains(emr.Tags, d.ScopeValue)
+	}
+	return false
+}
+
+// AddConsentDirective gives a doctor or hospital access to the records of the calling patient matching a scope
+// scope is all, category or tag, scopeValue is the category or tag the directive applies to
+// permissions is a comma separated list of read, share, amend and revoke, read is always granted
+// durationDays limits the directive to the given number of days, 0 keeps it until it is withdrawn
+// It returns the ID of the new directive
+func (c *EMRChaincode) AddConsentDirective(ctx contractapi.TransactionContextInterface, granteeCommonName string, granteeRole string, scope string, scopeValue string, permissions string, durationDays int) (string, error) {
+	clientID, err := consentManager(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if granteeRole != "doctor" && granteeRole != "hospital" {
+		return "", fmt.Errorf("invalid role to give consent to: %s", granteeRole)
+	}
+
+	grantee, err := c.GetUser(ctx, granteeCommonName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s: %v", granteeRole, err)
+	}
+	if grantee.Role != granteeRole {
+		return "", fmt.Errorf("user with CommonName %s is not a %s", granteeCommonName, granteeRole)
+	}
+	if !grantee.isActive() {
+		return "", fmt.Errorf("user with CommonName %s is %s and cannot be given access", granteeCommonName, grantee.Status)
+	}
+
+	switch scope {
+	case consentScopeAll:
+		scopeValue = ""
+	case consentScopeCategory, consentScopeTag:
+		if scopeValue == "" {
+			return "", fmt.Errorf("a %s is required for a consent directive with the %s scope", scope, scope)
+		}
+	default:
+		return "", fmt.Errorf("invalid consent scope: %s", scope)
+	}
+
+	if durationDays < 0 {
+		return "", fmt.Errorf("invalid consent duration: %d days", durationDays)
+	}
+
+	parsedPermissions, err := parsePermissions(permissions)
+	if err != nil {
+		return "", err
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	directive := ConsentDirective{
+		DirectiveID: ctx.GetStub().GetTxID(),
+		PatientID:   clientID,
+		GranteeID:   grantee.UserID,
+		GranteeRole: granteeRole,
+		Scope:       scope,
+		ScopeValue:  scopeValue,
+		Permissions: parsedPermissions,
+		GrantedAt:   now.Format(time.RFC3339),
+	}
+	if durationDays > 0 {
+		directive.ExpiresAt = now.AddDate(0, 0, durationDays).Format(time.RFC3339)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(consentObjectType, []string{directive.PatientID, directive.GranteeID, directive.DirectiveID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create consent directive key: %v", err)
+	}
+
+	directiveJSON, err := json.Marshal(directive)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal consent directive: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, directiveJSON)
+	if err != nil {
+		return "", fmt.Errorf("failed to write consent directive: %v", err)
+	}
+
+	return directive.DirectiveID, nil
+}
+
+// ListConsentDirectives retrieves the consent directives of the calling patient, including expired ones
+func (c *EMRChaincode) ListConsentDirectives(ctx contractapi.TransactionContextInterface) ([]ConsentDirective, error) {
+	clientID, err := consentManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return consentDirectives(ctx, clientID)
+}
+
+// WithdrawConsentDirective deletes a consent directive of the calling patient
+// Per-record grants are not affected
+func (c *EMRChaincode) WithdrawConsentDirective(ctx contractapi.TransactionContextInterface, directiveID string) error {
+	clientID, err := consentManager(ctx)
+	if err != nil {
+		return err
+	}
+
+	directives, err := consentDirectives(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(directives, func(d ConsentDirective) bool { return d.DirectiveID == directiveID })
+	if index == -1 {
+		return fmt.Errorf("consent directive with ID %s does not exist", directiveID)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(consentObjectType, []string{clientID, directives[index].GranteeID, directiveID})
+	if err != nil {
+		return fmt.Errorf("failed to create consent directive key: %v", err)
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete consent directive: %v", err)
+	}
+	return nil
+}
+
+// ClassifyRecord sets the category and tags consent directives are matched against
+// tags is a comma separated list, only the record's patient, doctor and hospital can classify it since
+// classifying a record changes which directives give access to it
+func (c *EMRChaincode) ClassifyRecord(ctx contractapi.TransactionContextInterface, emrID string, category string, tags string) error {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("role attribute not found")
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return err
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	party := (role == "patient" && clientID == emr.PatientID) ||
+		(role == "doctor" && clientID == emr.DoctorID) ||
+		(role == "hospital" && clientID == emr.HospitalID)
+	if !party {
+		return fmt.Errorf("this %s is not authorized to classify this record", role)
+	}
+
+	// Deny rules and user statuses still apply to the doctor and hospital of the record
+	permissions, err := c.grantedPermissions(ctx, role, clientID, emr, now)
+	if err != nil {
+		return err
+	}
+	if len(permissions) == 0 {
+		return fmt.Errorf("this %s is not authorized to classify this record", role)
+	}
+
+	emr.Category = strings.TrimSpace(category)
+	emr.Tags = nil
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !slices.Contains(emr.Tags, tag) {
+			emr.Tags = append(emr.Tags, tag)
+		}
+	}
+	emr.LastModified = now.Format(time.RFC3339)
+
+	return c.putRecord(ctx, emr)
+}
+
+// consentManager returns the ID of the client if it is a patient, only patients manage consent directives
+func consentManager(ctx contractapi.TransactionContextInterface) (string, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return "", fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return "", fmt.Errorf("role attribute not found")
+	}
+	if role != "patient" {
+		return "", fmt.Errorf("this %s is not authorized to manage consent directives", role)
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get client ID: %v", err)
+	}
+	return clientID, nil
+}
+
+// consentDirectives retrieves the consent directives of a patient, optionally only those given to one grantee
+func consentDirectives(ctx contractapi.TransactionContextInterface, patientID string, granteeID ...string) ([]ConsentDirective, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(consentObjectType, append([]string{patientID}, granteeID...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get consent directives: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	directives := []ConsentDirective{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next consent directive: %v", err)
+		}
+
+		var directive ConsentDirective
+		err = json.Unmarshal(queryResponse.Value, &directive)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal consent directive: %v", err)
+		}
+		directives = append(directives, directive)
+	}
+
+	return directives, nil
+}
+
+// consentPermissions returns the permissions the consent directives of the record's patient give the grantee on the EMR
+func consentPermissions(ctx contractapi.TransactionContextInterface, role string, granteeID string, emr *EMR, now time.Time) ([]string, error) {
+	if emr.Encrypted {
+		// Directive grantees hold no wrapped key of encrypted records
+		return nil, nil
+	}
+
+	directives, err := consentDirectives(ctx, emr.PatientID, granteeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []string
+	for _, directive := range directives {
+		if directive.GranteeRole != role || !directive.covers(emr, now) {
+			continue
+		}
+		for _, permission := range directive.Permissions {
+			if !slices.Contains(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// denyObjectType is the composite key object type of patient-wide deny rules, keyed by patient ID and denied user ID
+const denyObjectType = "deny"
+
+// DenyRule denies a user access to every record of a patient, it takes precedence over grants, directives and proxies
+type DenyRule struct {
+	PatientID string `json:"patientId"`
+	DeniedID  string `json:"deniedId"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// AddDenyRule denies a user access to the records of the calling patient
+// An empty emrID denies access to every record of the patient, including records created later
+func (c *EMRChaincode) AddDenyRule(ctx contractapi.TransactionContextInterface, deniedCommonName string, emrID string) error {
+	clientID, denied, err := c.denyRuleTarget(ctx, deniedCommonName)
+	if err != nil {
+		return err
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	if emrID == "" {
+		key, err := denyKey(ctx, clientID, denied.UserID)
+		if err != nil {
+			return err
+		}
+
+		existing, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return fmt.Errorf("failed to get deny rule: %v", err)
+		}
+		if existing != nil {
+			return fmt.Errorf("user with CommonName %s is already denied access to the records of this patient", deniedCommonName)
+		}
+
+		ruleJSON, err := json.Marshal(DenyRule{
+			PatientID: clientID,
+			DeniedID:  denied.UserID,
+			CreatedAt: now.Format(time.RFC3339),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal deny rule: %v", err)
+		}
+
+		return ctx.GetStub().PutState(key, ruleJSON)
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return err
+	}
+	if emr.PatientID != clientID {
+		return fmt.Errorf("this patient is not authorized to deny access to this record")
+	}
+	if slices.Contains(emr.DeniedIDs, denied.UserID) {
+		return fmt.Errorf("user with CommonName %s is already denied access to record with ID %s", deniedCommonName, emrID)
+	}
+
+	emr.DeniedIDs = append(emr.DeniedIDs, denied.UserID)
+	emr.LastModified = now.Format(time.RFC3339)
+
+	return c.putRecord(ctx, emr)
+}
+
+// RemoveDenyRule lifts a deny rule added with AddDenyRule, with the same emrID
+func (c *EMRChaincode) RemoveDenyRule(ctx contractapi.TransactionContextInterface, deniedCommonName string, emrID string) error {
+	clientID, denied, err := c.denyRuleTarget(ctx, deniedCommonName)
+	if err != nil {
+		return err
+	}
+
+	if emrID == "" {
+		key, err := denyKey(ctx, clientID, denied.UserID)
+		if err != nil {
+			return err
+		}
+
+		existing, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return fmt.Errorf("failed to get deny rule: %v", err)
+		}
+		if existing == nil {
+			return fmt.Errorf("user with CommonName %s is not denied access to the records of this patient", deniedCommonName)
+		}
+
+		return ctx.GetStub().DelState(key)
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return err
+	}
+	if emr.PatientID != clientID {
+		return fmt.Errorf("this patient is not authorized to deny access to this record")
+	}
+
+	index := slices.Index(emr.DeniedIDs, denied.UserID)
+	if index == -1 {
+		return fmt.Errorf("user with CommonName %s is not denied access to record with ID %s", deniedCommonName, emrID)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	emr.DeniedIDs = slices.Delete(emr.DeniedIDs, index, index+1)
+	emr.LastModified = now.Format(time.RFC3339)
+
+	return c.putRecord(ctx, emr)
+}
+
+// denyRuleTarget returns the ID of the patient managing its deny rules and the user they concern
+func (c *EMRChaincode) denyRuleTarget(ctx contractapi.TransactionContextInterface, deniedCommonName string) (string, *User, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return "", nil, fmt.Errorf("role attribute not found")
+	}
+	if role != "patient" {
+		return "", nil, fmt.Errorf("this %s is not authorized to manage deny rules", role)
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	denied, err := c.GetUser(ctx, deniedCommonName)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get user to deny: %v", err)
+	}
+	if denied.UserID == clientID {
+		return "", nil, fmt.Errorf("a patient cannot deny access to themselves")
+	}
+
+	return clientID, denied, nil
+}
+
+// isDenied checks if a user is on the deny list of the EMR or of its patient
+func isDenied(ctx contractapi.TransactionContextInterface, userID string, emr *EMR) (bool, error) {
+	if slices.Contains(emr.DeniedIDs, userID) {
+		return true, nil
+	}
+
+	key, err := denyKey(ctx, emr.PatientID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	ruleJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to get deny rule: %v", err)
+	}
+	return ruleJSON != nil, nil
+}
+
+// denyKey returns the world state key of the deny rule of a patient for a user
+func denyKey(ctx contractapi.TransactionContextInterface, patientID string, userID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(denyObjectType, []string{patientID, userID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create deny rule key: %v", err)
+	}
+	return key, nil
+}
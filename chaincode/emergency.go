@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Limits of break-glass access
+const (
+	emergencyAccessDuration = 4 * time.Hour  // How long an emergency grant gives read access
+	emergencyAccessWindow   = 24 * time.Hour // Period over which emergency accesses are counted
+	emergencyAccessLimit    = 3              // Emergency accesses a user can make per window
+)
+
+// Composite key object types of the emergency access state
+const (
+	emergencyUsageObjectType  = "emergency" // Accessor ID to the times of their recent emergency accesses
+	patientSettingsObjectType = "settings"  // Patient ID to the patient's settings
+)
+
+// PatientSettings holds the preferences a patient sets on all of their records
+type PatientSettings struct {
+	PatientID               string `json:"patientId"`
+	EmergencyAccessDisabled bool   `json:"emergencyAccessDisabled"`
+}
+
+// emergencyUsage holds the times of the recent emergency accesses of a user, used to rate limit them
+type emergencyUsage struct {
+	AccessorID string   `json:"accessorId"`
+	Timestamps []string `json:"timestamps"`
+}
+
+// EmergencyAccess gives a doctor or hospital that cannot read an EMR record short-lived read access to it
+// The access is written to the record access log with the justification and an EmergencyAccess event is emitted,
+// each user can make a limited number of emergency accesses per day and patients can disable them
+// Encrypted records are refused since the chaincode cannot wrap their data key for the client
+func (c *EMRChaincode) EmergencyAccess(ctx contractapi.TransactionContextInterface, emrID string, justification string) (*EMR, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("role attribute not found")
+	}
+	if role != "doctor" && role != "hospital" {
+		return nil, fmt.Errorf("this %s is not authorized to request emergency access", role)
+	}
+
+	justification = strings.TrimSpace(justification)
+	if justification == "" {
+		return nil, fmt.Errorf("a justification is required for emergency access")
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+	if clientID == "" {
+		return nil, fmt.Errorf("this %s is not authorized to request emergency access", role)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	authorized, err := c.isAuthorizedToRead(ctx, role, clientID, emr, now)
+	if err != nil {
+		return nil, err
+	}
+	if authorized {
+		return nil, fmt.Errorf("this %s can already read this record", role)
+	}
+	if emr.Encrypted {
+		return nil, fmt.Errorf("record with ID %s is encrypted, emergency access cannot give its key", emrID)
+	}
+	if role == "hospital" && emr.HospitalID == "" {
+		// Grants give hospitals no access to records without a HospitalID, emergency ones included
+		return nil, fmt.Errorf("this hospital cannot be given emergency access to a record without a hospital")
+	}
+
+	// Deny rules also apply to emergencies
+	denied, err := isDenied(ctx, clientID, emr)
+	if err != nil {
+		return nil, err
+	}
+	if denied {
+		return nil, fmt.Errorf("this %s is denied access to this record", role)
+	}
+
+	settings, err := getPatientSettings(ctx, emr.PatientID)
+	if err != nil {
+		return nil, err
+	}
+	if settings.EmergencyAccessDisabled {
+		return nil, fmt.Errorf("emergency access to the records of this patient is disabled")
+	}
+
+	grant := Grant{
+		GrantorID:   clientID,
+		GranteeID:   clientID,
+		GrantedAt:   now.Format(time.RFC3339),
+		ExpiresAt:   now.Add(emergencyAccessDuration).Format(time.RFC3339),
+		Permissions: []string{permissionRead},
+		Emergency:   true,
+	}
+
+	// An expired grant of the client is replaced, an active one means its access is withheld for another reason
+	var added bool
+	if role == "doctor" {
+		emr.SharedWithDoctors, added = addGrant(emr.SharedWithDoctors, grant, now)
+	} else {
+		emr.SharedWithHospitals, added = addGrant(emr.SharedWithHospitals, grant, now)
+	}
+	if !added {
+		return nil, fmt.Errorf("this %s already holds a grant on this record that does not give it access", role)
+	}
+
+	err = recordEmergencyUsage(ctx, clientID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.putRecord(ctx, emr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Emergency grants are left out of the grantee index so that the record is not listed as shared with the client,
+	// the expired grant the emergency grant may replace was indexed
+	if !holdsSharedGrant(emr, clientID) {
+		err = delIndexEntry(ctx, granteeIndexObjectType, clientID, emrID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	txID := ctx.GetStub().GetTxID()
+	err = putAccessLogEntry(ctx, AccessLogEntry{
+		EMRID:      emrID,
+		AccessorID: clientID,
+		Role:       role,
+		Purpose:    justification,
+		Timestamp:  now.Format(time.RFC3339),
+		TxID:       txID,
+		Emergency:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = setEvent(ctx, EventEmergencyAccess, EmergencyAccessEvent{
+		EMRID:      emrID,
+		PatientID:  emr.PatientID,
+		AccessorID: clientID,
+		Role:       role,
+		ExpiresAt:  grant.ExpiresAt,
+		TxID:       txID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return emr, nil
+}
+
+// SetEmergencyAccess enables or disables emergency access to all records of the calling patient
+func (c *EMRChaincode) SetEmergencyAccess(ctx contractapi.TransactionContextInterface, enabled bool) error {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("role attribute not found")
+	}
+	if role != "patient" {
+		return fmt.Errorf("this %s is not authorized to change emergency access settings", role)
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	settings, err := getPatientSettings(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	settings.EmergencyAccessDisabled = !enabled
+
+	return putPatientSettings(ctx, settings)
+}
+
+// getPatientSettings retrieves the settings of a patient, patients who never changed them get the defaults
+func getPatientSettings(ctx contractapi.TransactionContextInterface, patientID string) (*PatientSettings, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(patientSettingsObjectType, []string{patientID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create patient settings key: %v", err)
+	}
+
+	settingsJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get patient settings: %v", err)
+	}
+	if settingsJSON == nil {
+		return &PatientSettings{PatientID: patientID}, nil
+	}
+
+	var settings PatientSettings
+	err = json.Unmarshal(settingsJSON, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal patient settings: %v", err)
+	}
+
+	return &settings, nil
+}
+
+// putPatientSettings writes the settings of a patient to the world state
+func putPatientSettings(ctx contractapi.TransactionContextInterface, settings *PatientSettings) error {
+	key, err := ctx.GetStub().CreateCompositeKey(patientSettingsObjectType, []string{settings.PatientID})
+	if err != nil {
+		return fmt.Errorf("failed to create patient settings key: %v", err)
+	}
+
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patient settings: %v", err)
+	}
+
+	return ctx.GetStub().PutState(key, settingsJSON)
+}
+
+// recordEmergencyUsage counts an emergency access against the limit of the accessor
+// It fails once the accessor reached the limit within the current window
+func recordEmergencyUsage(ctx contractapi.TransactionContextInterface, accessorID string, now time.Time) error {
+	key, err := ctx.GetStub().CreateCompositeKey(emergencyUsageObjectType, []string{accessorID})
+	if err != nil {
+		return fmt.Errorf("failed to create emergency usage key: %v", err)
+	}
+
+	usageJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to get emergency usage: %v", err)
+	}
+
+	usage := emergencyUsage{AccessorID: accessorID}
+	if usageJSON != nil {
+		err = json.Unmarshal(usageJSON, &usage)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal emergency usage: %v", err)
+		}
+	}
+
+	// Only keep the accesses made within the window
+	windowStart := now.Add(-emergencyAccessWindow)
+	var recent []string
+	for _, timestamp := range usage.Timestamps {
+		accessedAt, err := time.Parse(time.RFC3339, timestamp)
+		if err == nil && accessedAt.After(windowStart) {
+			recent = append(recent, timestamp)
+		}
+	}
+	if len(recent) >= emergencyAccessLimit {
+		return fmt.Errorf("emergency access limit of %d per %.0f hours reached", emergencyAccessLimit, emergencyAccessWindow.Hours())
+	}
+	usage.Timestamps = append(recent, now.Format(time.RFC3339))
+
+	usageJSON, err = json.Marshal(usage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal emergency usage: %v", err)
+	}
+
+	return ctx.GetStub().PutState(key, usageJSON)
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"slices"
@@ -12,288 +17,1868 @@ import (
 
 type EMRChaincode struct {
 	contractapi.Contract
+	clock clock // Nil uses the transaction timestamp
+}
+
+// clock gives the time transactions stamp records with
+// It must return the same time on every endorsing peer for their write sets to match
+type clock interface {
+	now(ctx contractapi.TransactionContextInterface) (time.Time, error)
+}
+
+// txClock reads the time from the transaction header
+type txClock struct{}
+
+func (txClock) now(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	return timestamp.AsTime(), nil
 }
 
 type User struct {
 	UserID     string `json:"userId"`
 	Role       string `json:"role"`
 	CommonName string `json:"CommonName"`
+	Status     string `json:"status,omitempty" metadata:",optional"` // One of the userStatus constants, empty for users registered before statuses existed
+	MSPID      string `json:"mspId,omitempty" metadata:",optional"`  // Org of the user, whose admins approve its certificate links
+	// Certificate IDs the user can call the chaincode with, UserID stays the stable ID of the user whatever certificate it uses
+	// Empty for users registered before certificates could be linked, who only use the certificate of UserID
+	CertificateIDs []string `json:"certificateIds,omitempty" metadata:",optional"`
+}
+
+type EMR struct {
+	EMRID               string          `json:"emrId"`
+	PatientID           string          `json:"patientId"`
+	DoctorID            string          `json:"doctorId"`
+	HospitalID          string          `json:"hospitalId,omitempty" metadata:",optional"`  // Optional field
+	Diagnosis           string          `json:"diagnosis,omitempty" metadata:",optional"`   // Only set on records created before content moved to private data
+	ContentHash         string          `json:"contentHash,omitempty" metadata:",optional"` // SHA-256 of the content of the latest version
+	Collection          string          `json:"collection,omitempty" metadata:",optional"`  // Private data collection holding the record content
+	Category            string          `json:"category,omitempty" metadata:",optional"`    // Matched by consent directives with the category scope
+	Tags                []string        `json:"tags,omitempty" metadata:",optional"`        // Matched by consent directives with the tag scope
+	DeniedIDs           []string        `json:"deniedIds,omitempty" metadata:",optional"`   // Users denied access to this record whatever they are allowed
+	Encrypted           bool            `json:"encrypted,omitempty" metadata:",optional"`   // Content is encrypted by the client, see WrappedKey
+	CreatedOn           string          `json:"createdOn"`
+	LastModified        string          `json:"lastModified"`
+	SharedWithDoctors   []Grant         `json:"sharedWithDoctors"`
+	SharedWithHospitals []Grant         `json:"sharedWithHospitals"`
+	Versions            []RecordVersion `json:"versions,omitempty" metadata:",optional"`
+}
+
+// RecordVersion is an immutable entry in the amendment history of an EMR
+type RecordVersion struct {
+	Version     int    `json:"version"`
+	Type        string `json:"type"`                                       // One of the versionType constants
+	Content     string `json:"content,omitempty" metadata:",optional"`     // Only set on versions written before content moved to private data
+	ContentHash string `json:"contentHash,omitempty" metadata:",optional"` // SHA-256 of the version content stored in the record collection
+	AuthorID    string `json:"authorId"`
+	Timestamp   string `json:"timestamp"`
+	Reason      string `json:"reason,omitempty" metadata:",optional"`
+}
+
+// RecordContent is the clinical content of a record version as returned by ReadRecordContent
+type RecordContent struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	Content string `json:"content"` // ClinicalData JSON for originals and amendments, appended text for addenda, base64 ciphertext for encrypted records
+}
+
+// ContentVerification is the result of checking a record content against the hashes anchored on the ledger
+type ContentVerification struct {
+	Match   bool `json:"match"`
+	Version int  `json:"version,omitempty" metadata:",optional"` // Latest version whose content matched, 0 when none did
+}
+
+// RecordHistoryEntry is a committed state of an EMR record as returned by GetRecordHistory
+type RecordHistoryEntry struct {
+	TxID      string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+	IsDelete  bool   `json:"isDelete"`
+	Record    *EMR   `json:"record,omitempty" metadata:",optional"` // Nil when the transaction deleted the record
+}
+
+// RecordPage is a page of EMR records returned by the paginated record listings
+type RecordPage struct {
+	Records      []EMR  `json:"records"`
+	FetchedCount int32  `json:"fetchedCount"` // Number of index entries read, records the client cannot read are left out
+	Bookmark     string `json:"bookmark"`     // Pass to the next call to fetch the following page
+}
+
+// MigrationPage is the result of a MigrateLegacyKeys call
+type MigrationPage struct {
+	Migrated int    `json:"migrated"` // Number of users and records moved to their composite keys
+	Bookmark string `json:"bookmark"` // Pass to the next call to continue the migration, empty once every plain key was visited
+	// Plain keys left in place because their composite key was taken, for example by a user registered again after the upgrade
+	Conflicts []string `json:"conflicts,omitempty" metadata:",optional"`
+}
+
+// AccessLogEntry records a single audited access to an EMR record
+type AccessLogEntry struct {
+	EMRID      string `json:"emrId"`
+	AccessorID string `json:"accessorId"`
+	Role       string `json:"role"`
+	Purpose    string `json:"purpose"`
+	Timestamp  string `json:"timestamp"`
+	TxID       string `json:"txId"`
+	Emergency  bool   `json:"emergency,omitempty" metadata:",optional"` // Set for break-glass accesses, Purpose then holds the justification
+}
+
+// Composite key object types keeping users and records in separate key namespaces
+const (
+	userObjectType = "user"
+	emrObjectType  = "emr"
+)
+
+// Composite key object types of the indexes used to look records up without rich queries
+const (
+	patientIndexObjectType = "patient~emr" // Patient ID to the patient's EMR IDs
+	ownerIndexObjectType   = "owner~emr"   // Doctor or hospital ID to the EMR IDs they own
+	granteeIndexObjectType = "grantee~emr" // Grantee ID to the EMR IDs shared with them
+)
+
+// accessLogObjectType is the composite key object type of access log entries, keyed by EMR ID and transaction ID
+const accessLogObjectType = "access"
+
+// contentObjectType is the composite key object type of record contents in private data, keyed by EMR ID and version
+const contentObjectType = "content"
+
+// contentTransientKey is the transient map key the clinical content of a record version is passed under
+const contentTransientKey = "content"
+
+// collectionMSPIDs are the orgs with a private data collection in collections_config.json
+// An org added to the channel, such as Org3MSP by addOrg3, needs a collection there and here before it can hold records
+var collectionMSPIDs = []string{"Org1MSP", "Org2MSP"}
+
+// Types of record versions
+const (
+	versionTypeOriginal  = "original"
+	versionTypeAmendment = "amendment"
+	versionTypeAddendum  = "addendum"
+)
+
+// maxAddendumSize is the maximum size in bytes of the content of an addendum, encrypted or not
+const maxAddendumSize = 16 * 1024
+
+// Grant gives a doctor or hospital access to an EMR, optionally until ExpiresAt
+type Grant struct {
+	GrantorID   string   `json:"grantorId"`
+	GranteeID   string   `json:"granteeId"`
+	GrantedAt   string   `json:"grantedAt"`
+	ExpiresAt   string   `json:"expiresAt,omitempty" metadata:",optional"` // Empty for grants that never expire
+	Permissions []string `json:"permissions,omitempty" metadata:",optional"`
+	Emergency   bool     `json:"emergency,omitempty" metadata:",optional"` // Set for the short-lived grants given by EmergencyAccess
+}
+
+// Permissions that can be carried by a grant
+const (
+	permissionRead   = "read"
+	permissionShare  = "share"
+	permissionAmend  = "amend"
+	permissionRevoke = "revoke"
+)
+
+// allPermissions is held by the patient and the doctor or hospital that created a record
+var allPermissions = []string{permissionRead, permissionShare, permissionAmend, permissionRevoke}
+
+// UnmarshalJSON also accepts the bare grantee IDs stored by earlier versions of the chaincode,
+// they are decoded as grants that never expire and written back as grant objects on the next update
+func (g *Grant) UnmarshalJSON(data []byte) error {
+	var granteeID string
+	if err := json.Unmarshal(data, &granteeID); err == nil {
+		*g = Grant{GranteeID: granteeID}
+		return nil
+	}
+
+	type grant Grant // Avoid recursing into this method
+	return json.Unmarshal(data, (*grant)(g))
+}
+
+// isActive checks if the grant has not expired at the given time
+func (g *Grant) isActive(now time.Time) bool {
+	return notExpired(g.ExpiresAt, now)
+}
+
+// notExpired checks if an RFC 3339 expiry date, empty for no expiry, is still ahead of the given time
+func notExpired(expiresAt string, now time.Time) bool {
+	if expiresAt == "" {
+		return true
+	}
+
+	expiry, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		// Treat unreadable expiry dates as expired
+		return false
+	}
+	return now.Before(expiry)
+}
+
+// permissions returns the permissions carried by the grant
+// Grants written before permissions existed keep the read and share access they were given
+func (g *Grant) permissions() []string {
+	if len(g.Permissions) == 0 {
+		return []string{permissionRead, permissionShare}
+	}
+	return g.Permissions
+}
+
+// CreateRecord creates a new EMR record
+// patientCommonName should be the CommonName of the patient with patient@orgName.example.com
+// The ClinicalData JSON document is passed in the transient map under the "content" key and stored in the private data collection of the client's org
+// Encrypted records pass the base64 ciphertext as content and, under the "wrappedKeys" key, a JSON object of the data key
+// wrapped for the patient, doctor and hospital of the record by role
+func (c *EMRChaincode) CreateRecord(ctx contractapi.TransactionContextInterface, emrID string, patientCommonName string, doctorCommonName string, hospitalCommonName string) error {
+	clinicalData, err := transientContent(ctx)
+	if err != nil {
+		return err
+	}
+
+	wrappedKeys, err := transientWrappedKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.createRecord(ctx, emrID, patientCommonName, doctorCommonName, hospitalCommonName, clinicalData, wrappedKeys)
+}
+
+// createRecord creates a new EMR record whose first version holds the given ClinicalData JSON document
+// The record is encrypted when wrappedKeys is not nil, clinicalData is then the base64 encoded ciphertext
+func (c *EMRChaincode) createRecord(ctx contractapi.TransactionContextInterface, emrID string, patientCommonName string, doctorCommonName string, hospitalCommonName string, clinicalData []byte, wrappedKeys map[string]string) error {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found || (role != "doctor" && role != "hospital") {
+		return fmt.Errorf("only doctors and hospitals can create records")
+	}
+
+	// Get ID from ctx
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	doctorID := ""
+	hospitalID := ""
+
+	if role == "doctor" {
+		doctorID = clientID
+	} else if role == "hospital" {
+		hospitalID = clientID
+	} else {
+		return fmt.Errorf("invalid role: %s", role)
+	}
+
+	// Check if the EMR ID already exists
+	key, err := emrKey(ctx, emrID)
+	if err != nil {
+		return err
+	}
+	existingEMR, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to check if EMR ID exists: %v", err)
+	}
+	if existingEMR != nil {
+		return fmt.Errorf("EMR with ID %s already exists", emrID)
+	}
+
+	// Retrieve doctor or hospita ID
+	if role == "doctor" { // DoctorID has already been set to UserID
+		// Check if hospital exists
+		hospital, err := c.GetUser(ctx, hospitalCommonName)
+		if err != nil || hospital == nil {
+			// Failed to get hospital or hospital does not exist (create without hospital)
+			hospitalID = ""
+		} else {
+			hospitalID = hospital.UserID
+		}
+	} else if role == "hospital" { // HospitalID has already been set to UserID
+		// Check if doctor exists
+		doctor, err := c.GetUser(ctx, doctorCommonName)
+		if err != nil || doctor == nil {
+			// Failed to get doctor or doctor does not exist (create without doctor)
+			doctorID = ""
+		} else {
+			doctorID = doctor.UserID
+		}
+	}
+
+	patient, err := c.GetUser(ctx, patientCommonName)
+	if err != nil {
+		return fmt.Errorf("failed to get patient: %v", err)
+	}
+	if patient == nil {
+		return fmt.Errorf("patient with CommonName %s does not exist", patientCommonName)
+	}
+	patientID := patient.UserID
+	if patient.Role != "patient" {
+		return fmt.Errorf("user with CommonName %s is not a patient", patientCommonName)
+	}
+
+	if wrappedKeys != nil {
+		err = validateCiphertext(clinicalData)
+	} else {
+		err = validateClinicalData(clinicalData)
+	}
+	if err != nil {
+		return err
+	}
+
+	collection, err := orgCollection(ctx)
+	if err != nil {
+		return err
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	timestamp := now.Format(time.RFC3339)
+	emr := EMR{
+		EMRID:               emrID,
+		PatientID:           patientID,
+		DoctorID:            doctorID,
+		HospitalID:          hospitalID,
+		Collection:          collection,
+		Encrypted:           wrappedKeys != nil,
+		CreatedOn:           timestamp,
+		LastModified:        timestamp,
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+
+	if emr.Encrypted {
+		err = putPartyWrappedKeys(ctx, &emr, wrappedKeys)
+		if err != nil {
+			return err
+		}
+	}
+
+	contentHash, err := putRecordContent(ctx, &emr, 1, clinicalData)
+	if err != nil {
+		return err
+	}
+	emr.ContentHash = contentHash
+	emr.Versions = []RecordVersion{{
+		Version:     1,
+		Type:        versionTypeOriginal,
+		ContentHash: contentHash,
+		AuthorID:    clientID,
+		Timestamp:   timestamp,
+	}}
+
+	err = c.putRecord(ctx, &emr)
+	if err != nil {
+		return err
+	}
+
+	err = c.indexRecord(ctx, &emr)
+	if err != nil {
+		return err
+	}
+
+	return setEvent(ctx, EventRecordCreated, RecordCreatedEvent{
+		EMRID:      emr.EMRID,
+		PatientID:  emr.PatientID,
+		DoctorID:   emr.DoctorID,
+		HospitalID: emr.HospitalID,
+	})
+}
+
+// ReadRecord retrieves an EMR record by ID, other transactions reading a record call it to authorize the client
+func (c *EMRChaincode) ReadRecord(ctx contractapi.TransactionContextInterface, emrID string) (*EMR, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("role attribute not found")
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	authorized, err := c.isAuthorizedToRead(ctx, role, clientID, emr, now)
+	if err != nil {
+		return nil, err
+	}
+	if !authorized {
+		return nil, fmt.Errorf("this %s is not authorized to read this record", role)
+	}
+
+	return emr, nil
+}
+
+// ReadRecordContent retrieves the clinical content of every version of an EMR record without logging the access
+func (c *EMRChaincode) ReadRecordContent(ctx contractapi.TransactionContextInterface, emrID string) ([]RecordContent, error) {
+	emr, err := c.ReadRecord(ctx, emrID)
+	if err != nil {
+		return nil, err
+	}
+
+	return recordContents(ctx, emr)
+}
+
+// recordContents retrieves the content of every version of an EMR record
+func recordContents(ctx contractapi.TransactionContextInterface, emr *EMR) ([]RecordContent, error) {
+	// Records created before versioning existed only hold their original diagnosis
+	if len(emr.Versions) == 0 {
+		return []RecordContent{{Version: 1, Type: versionTypeOriginal, Content: emr.Diagnosis}}, nil
+	}
+
+	contents := []RecordContent{}
+	for _, version := range emr.Versions {
+		content := []byte(version.Content)
+		if version.ContentHash != "" {
+			var err error
+			content, err = getRecordContent(ctx, emr, version)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		contents = append(contents, RecordContent{
+			Version: version.Version,
+			Type:    version.Type,
+			Content: string(content),
+		})
+	}
+
+	return contents, nil
+}
+
+// ShareRecord shares an EMR record with another entity
+// durationDays limits the grant to the given number of days, 0 grants access until it is revoked, the grant never
+// outlives the access of the sharer
+// permissions is a comma separated list of read, share, amend and revoke, read is always granted
+// and the sharer can only grant permissions it holds itself
+// Sharing an encrypted record requires the data key wrapped for the grantee in the transient map under the "wrappedKey" key
+// Records without a hospital cannot be shared with hospitals, consent directives give hospitals access to them
+func (c *EMRChaincode) ShareRecord(ctx contractapi.TransactionContextInterface, emrID string, shareWithCommonName string, shareWithRole string, durationDays int, permissions string) error {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("role attribute not found")
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return err
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	sharerPermissions, err := c.grantedPermissions(ctx, role, clientID, emr, now)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(sharerPermissions, permissionShare) {
+		return fmt.Errorf("this %s is not authorized to share this record", role)
+	}
+
+	if durationDays < 0 {
+		return fmt.Errorf("invalid share duration: %d days", durationDays)
+	}
+
+	grantedPermissions, err := parsePermissions(permissions)
+	if err != nil {
+		return err
+	}
+	for _, permission := range grantedPermissions {
+		if !slices.Contains(sharerPermissions, permission) {
+			return fmt.Errorf("this %s cannot grant the %s permission it does not hold", role, permission)
+		}
+	}
+
+	grant := Grant{
+		GrantorID:   clientID,
+		GrantedAt:   now.Format(time.RFC3339),
+		Permissions: grantedPermissions,
+	}
+	if durationDays > 0 {
+		grant.ExpiresAt = now.AddDate(0, 0, durationDays).Format(time.RFC3339)
+	}
+
+	// The shared access cannot outlive the access of the sharer
+	sharerExpiresAt, err := shareExpiry(ctx, role, clientID, emr, now)
+	if err != nil {
+		return err
+	}
+	if expiresBefore(sharerExpiresAt, grant.ExpiresAt) {
+		grant.ExpiresAt = sharerExpiresAt
+	}
+
+	var added bool
+	if shareWithRole == "doctor" {
+		// Find the doctor ID from the CommonName
+		doctor, err := c.GetUser(ctx, shareWithCommonName)
+		if err != nil || doctor == nil {
+			return fmt.Errorf("failed to get doctor: %v for sharing emr with ID %s", err, emrID)
+		}
+		if !doctor.isActive() {
+			return fmt.Errorf("user with CommonName %s is %s and cannot be given access", shareWithCommonName, doctor.Status)
+		}
+		grant.GranteeID = doctor.UserID
+		emr.SharedWithDoctors, added = addGrant(emr.SharedWithDoctors, grant, now)
+	} else if shareWithRole == "hospital" {
+		// Hospital grants are ignored on records without a HospitalID, only consent directives give access to them
+		if emr.HospitalID == "" {
+			return fmt.Errorf("record with ID %s has no hospital and can only be shared with hospitals through a consent directive", emrID)
+		}
+
+		// Find the hospital ID from the CommonName
+		hospital, err := c.GetUser(ctx, shareWithCommonName)
+		if err != nil || hospital == nil {
+			return fmt.Errorf("failed to get hospital: %v for sharing emr with ID %s", err, emrID)
+		}
+		if !hospital.isActive() {
+			return fmt.Errorf("user with CommonName %s is %s and cannot be given access", shareWithCommonName, hospital.Status)
+		}
+		grant.GranteeID = hospital.UserID
+		emr.SharedWithHospitals, added = addGrant(emr.SharedWithHospitals, grant, now)
+	} else {
+		return fmt.Errorf("invalid role to share with: %s", shareWithRole)
+	}
+	if !added {
+		return fmt.Errorf("record with ID %s is already shared with %s %s", emrID, shareWithRole, shareWithCommonName)
+	}
+
+	if emr.Encrypted {
+		wrappedKey, err := transientWrappedKey(ctx)
+		if err != nil {
+			return err
+		}
+		err = putWrappedKey(ctx, emrID, grant.GranteeID, wrappedKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.putRecord(ctx, emr)
+	if err != nil {
+		return err
+	}
+
+	err = putIndexEntry(ctx, granteeIndexObjectType, grant.GranteeID, emrID)
+	if err != nil {
+		return err
+	}
+
+	return setEvent(ctx, EventRecordShared, RecordSharedEvent{
+		EMRID:       emrID,
+		PatientID:   emr.PatientID,
+		GrantorID:   clientID,
+		GranteeID:   grant.GranteeID,
+		GranteeRole: shareWithRole,
+	})
+}
+
+// UnshareRecord revokes access to an EMR record previously granted with ShareRecord
+// The patient, the doctor or hospital that created the record and sharees holding the revoke
+// permission can revoke any grant, other sharees can only revoke their own access
+// The wrapped key of an encrypted record is deleted with the last grant of the grantee
+func (c *EMRChaincode) UnshareRecord(ctx contractapi.TransactionContextInterface, emrID string, unshareWithCommonName string, unshareWithRole string) error {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("role attribute not found")
+	}
+
+	if unshareWithRole != "doctor" && unshareWithRole != "hospital" {
+		return fmt.Errorf("invalid role to unshare with: %s", unshareWithRole)
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return err
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	// Find the grantee ID from the CommonName
+	grantee, err := c.GetUser(ctx, unshareWithCommonName)
+	if err != nil || grantee == nil {
+		return fmt.Errorf("failed to get %s: %v for unsharing emr with ID %s", unshareWithRole, err, emrID)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	authorized, err := c.isAuthorizedToUnshare(ctx, role, clientID, grantee.UserID, emr, now)
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("this %s is not authorized to revoke access to this record", role)
+	}
+
+	sharedWith := &emr.SharedWithDoctors
+	if unshareWithRole == "hospital" {
+		sharedWith = &emr.SharedWithHospitals
+	}
+
+	index := slices.IndexFunc(*sharedWith, func(g Grant) bool { return g.GranteeID == grantee.UserID })
+	if index == -1 {
+		return fmt.Errorf("record with ID %s is not shared with %s %s", emrID, unshareWithRole, unshareWithCommonName)
+	}
+	*sharedWith = slices.Delete(*sharedWith, index, index+1)
+
+	err = c.putRecord(ctx, emr)
+	if err != nil {
+		return err
+	}
+
+	// The same user can hold both a doctor and a hospital grant
+	if !holdsSharedGrant(emr, grantee.UserID) {
+		err = delIndexEntry(ctx, granteeIndexObjectType, grantee.UserID, emrID)
+		if err != nil {
+			return err
+		}
+
+		if emr.Encrypted {
+			err = delWrappedKey(ctx, emr, grantee.UserID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return setEvent(ctx, EventRecordUnshared, RecordUnsharedEvent{
+		EMRID:       emrID,
+		PatientID:   emr.PatientID,
+		RevokerID:   clientID,
+		GranteeID:   grantee.UserID,
+		GranteeRole: unshareWithRole,
+	})
+}
+
+// VerifyRecordContent checks if contentHash, the hex encoded SHA-256 of a copy of a record content, matches a version of the record
+// Private versions are checked against the hash committed with the private data, which every peer of the channel holds
+func (c *EMRChaincode) VerifyRecordContent(ctx contractapi.TransactionContextInterface, emrID string, contentHash string) (*ContentVerification, error) {
+	hash, err := hex.DecodeString(strings.TrimSpace(contentHash))
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid content hash: %s", contentHash)
+	}
+
+	// Only clients that can read the record may learn if a content matches it
+	emr, err := c.ReadRecord(ctx, emrID)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := emr.Versions
+	if len(versions) == 0 {
+		versions = []RecordVersion{{Version: 1, Type: versionTypeOriginal, Content: emr.Diagnosis}}
+	}
+
+	for _, version := range slices.Backward(versions) {
+		versionHash, err := anchoredContentHash(ctx, emr, version)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(hash, versionHash) {
+			return &ContentVerification{Match: true, Version: version.Version}, nil
+		}
+	}
+
+	return &ContentVerification{Match: false}, nil
+}
+
+// anchoredContentHash returns the SHA-256 of the content of a record version as recorded on the ledger
+func anchoredContentHash(ctx contractapi.TransactionContextInterface, emr *EMR, version RecordVersion) ([]byte, error) {
+	// Versions written before content moved to private data are public
+	if version.ContentHash == "" {
+		hash := sha256.Sum256([]byte(version.Content))
+		return hash[:], nil
+	}
+
+	key, err := contentKey(ctx, emr.EMRID, version.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := ctx.GetStub().GetPrivateDataHash(emr.Collection, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content hash of EMR ID %s from collection %s: %v", emr.EMRID, emr.Collection, err)
+	}
+	if hash != nil {
+		return hash, nil
+	}
+
+	// Fall back to the hash stored in the record envelope, e.g. once the private data was purged
+	hash, err = hex.DecodeString(version.ContentHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content hash for version %d of record %s: %v", version.Version, emr.EMRID, err)
+	}
+	return hash, nil
+}
+
+// UpdateRecord corrects the diagnosis of an EMR record, the previous diagnosis is kept in the record versions
+func (c *EMRChaincode) UpdateRecord(ctx contractapi.TransactionContextInterface, emrID string, reason string) error {
+	return c.amendRecord(ctx, emrID, versionTypeAmendment, reason)
+}
+
+// AppendAddendum adds an addendum to an EMR record without changing its diagnosis
+// The addendum is free text that cannot be blank nor larger than maxAddendumSize
+func (c *EMRChaincode) AppendAddendum(ctx contractapi.TransactionContextInterface, emrID string, reason string) error {
+	return c.amendRecord(ctx, emrID, versionTypeAddendum, reason)
+}
+
+// amendRecord appends a new version of the given type to an EMR record
+// The content of the version is passed in the transient map under the "content" key,
+// amendments replace the clinical data and must be a ClinicalData JSON document
+func (c *EMRChaincode) amendRecord(ctx contractapi.TransactionContextInterface, emrID string, versionType string, reason string) error {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("role attribute not found")
+	}
+
+	if reason == "" {
+		return fmt.Errorf("a reason is required to amend a record")
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return err
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	authorized, err := c.isAuthorizedToAmend(ctx, role, clientID, emr, now)
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return fmt.Errorf("this %s is not authorized to amend this record", role)
+	}
+
+	// Records created before versioning existed start their history with the original diagnosis
+	if len(emr.Versions) == 0 {
+		authorID := emr.DoctorID
+		if authorID == "" {
+			authorID = emr.HospitalID
+		}
+		emr.Versions = []RecordVersion{{
+			Version:   1,
+			Type:      versionTypeOriginal,
+			Content:   emr.Diagnosis,
+			AuthorID:  authorID,
+			Timestamp: emr.CreatedOn,
+		}}
+	}
+
+	content, err := transientContent(ctx)
+	if err != nil {
+		return err
+	}
+	if versionType == versionTypeAddendum && len(content) > maxAddendumSize {
+		return fmt.Errorf("the addendum is %d bytes long, the maximum is %d", len(content), maxAddendumSize)
+	}
+	if emr.Encrypted {
+		// Versions of encrypted records are encrypted with the data key of the record
+		err = validateCiphertext(content)
+		if err != nil {
+			return err
+		}
+	} else if versionType == versionTypeAmendment {
+		err = validateClinicalData(content)
+		if err != nil {
+			return err
+		}
+	} else if strings.TrimSpace(string(content)) == "" {
+		return fmt.Errorf("the addendum cannot be blank")
+	}
+
+	// Legacy records start keeping their content in the collection of the org amending them
+	if emr.Collection == "" {
+		emr.Collection, err = orgCollection(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	version := len(emr.Versions) + 1
+	contentHash, err := putRecordContent(ctx, emr, version, content)
+	if err != nil {
+		return err
+	}
+
+	timestamp := now.Format(time.RFC3339)
+	emr.Versions = append(emr.Versions, RecordVersion{
+		Version:     version,
+		Type:        versionType,
+		ContentHash: contentHash,
+		AuthorID:    clientID,
+		Timestamp:   timestamp,
+		Reason:      reason,
+	})
+	if versionType == versionTypeAmendment {
+		// The legacy public diagnosis is superseded, it stays in the first version
+		emr.Diagnosis = ""
+	}
+	emr.ContentHash = contentHash
+	emr.LastModified = timestamp
+
+	err = c.putRecord(ctx, emr)
+	if err != nil {
+		return err
+	}
+
+	return setEvent(ctx, EventRecordAmended, RecordAmendedEvent{
+		EMRID:     emrID,
+		PatientID: emr.PatientID,
+		AuthorID:  clientID,
+		Version:   version,
+		Type:      versionType,
+	})
+}
+
+// AccessRecord retrieves an EMR record like ReadRecord and writes an entry to the record access log
+// It must be submitted as a transaction for the access log entry to be committed
+func (c *EMRChaincode) AccessRecord(ctx contractapi.TransactionContextInterface, emrID string, purpose string) (*EMR, error) {
+	return c.accessRecord(ctx, emrID, purpose)
+}
+
+// AccessRecordContent retrieves the clinical content of an EMR record like ReadRecordContent and logs the access
+func (c *EMRChaincode) AccessRecordContent(ctx contractapi.TransactionContextInterface, emrID string, purpose string) ([]RecordContent, error) {
+	emr, err := c.accessRecord(ctx, emrID, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	return recordContents(ctx, emr)
+}
+
+// accessRecord authorizes the client to read an EMR record and writes an entry to the record access log
+func (c *EMRChaincode) accessRecord(ctx contractapi.TransactionContextInterface, emrID string, purpose string) (*EMR, error) {
+	if purpose == "" {
+		return nil, fmt.Errorf("a purpose is required to access a record")
+	}
+
+	emr, err := c.ReadRecord(ctx, emrID)
+	if err != nil {
+		return nil, err
+	}
+
+	role, _, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putAccessLogEntry(ctx, AccessLogEntry{
+		EMRID:      emrID,
+		AccessorID: clientID,
+		Role:       role,
+		Purpose:    purpose,
+		Timestamp:  now.Format(time.RFC3339),
+		TxID:       ctx.GetStub().GetTxID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return emr, nil
+}
+
+// putAccessLogEntry writes an entry to the access log of the record it concerns
+func putAccessLogEntry(ctx contractapi.TransactionContextInterface, entry AccessLogEntry) error {
+	entryKey, err := ctx.GetStub().CreateCompositeKey(accessLogObjectType, []string{entry.EMRID, entry.TxID})
+	if err != nil {
+		return fmt.Errorf("failed to create access log key: %v", err)
+	}
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal access log entry: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(entryKey, entryJSON)
+	if err != nil {
+		return fmt.Errorf("failed to write access log entry: %v", err)
+	}
+	return nil
+}
+
+// GetAccessLog retrieves the audited accesses to an EMR record in chronological order
+// Only the patient the record belongs to and auditors can read the access log
+func (c *EMRChaincode) GetAccessLog(ctx contractapi.TransactionContextInterface, emrID string) ([]AccessLogEntry, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("role attribute not found")
+	}
+
+	emr, err := c.getRecord(ctx, emrID)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	if role != "auditor" && (role != "patient" || clientID != emr.PatientID) {
+		return nil, fmt.Errorf("this %s is not authorized to read the access log of this record", role)
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(accessLogObjectType, []string{emrID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access log: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	entries := []AccessLogEntry{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next access log entry: %v", err)
+		}
+
+		var entry AccessLogEntry
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal access log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	// Entries are keyed by transaction ID, sort them by time of access
+	slices.SortStableFunc(entries, func(a, b AccessLogEntry) int {
+		return strings.Compare(a.Timestamp, b.Timestamp)
+	})
+
+	return entries, nil
+}
+
+// GetRecordHistory retrieves every committed state of an EMR record, oldest first
+// Records written before MigrateLegacyKeys also have a history under their legacy plain key, it comes first
+func (c *EMRChaincode) GetRecordHistory(ctx contractapi.TransactionContextInterface, emrID string) ([]RecordHistoryEntry, error) {
+	_, err := c.ReadRecord(ctx, emrID)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := recordHistory(ctx, []RecordHistoryEntry{}, emrID, emrID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := emrKey(ctx, emrID)
+	if err != nil {
+		return nil, err
+	}
+
+	return recordHistory(ctx, history, key, emrID, false)
+}
+
+// recordHistory appends the committed states of an EMR stored under key to history
+// The legacy plain key is deleted by the migration, and could have held a user, so only its record states are kept
+func recordHistory(ctx contractapi.TransactionContextInterface, history []RecordHistoryEntry, key string, emrID string, legacy bool) ([]RecordHistoryEntry, error) {
+	historyIterator, err := ctx.GetStub().GetHistoryForKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history for EMR ID %s: %v", emrID, err)
+	}
+	defer historyIterator.Close()
+
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next history entry: %v", err)
+		}
+		if legacy && modification.IsDelete {
+			continue
+		}
+
+		entry := RecordHistoryEntry{
+			TxID:      modification.TxId,
+			Timestamp: modification.Timestamp.AsTime().Format(time.RFC3339),
+			IsDelete:  modification.IsDelete,
+		}
+		if !modification.IsDelete {
+			var emr EMR
+			err = json.Unmarshal(modification.Value, &emr)
+			if err != nil {
+				if legacy {
+					continue
+				}
+				return nil, fmt.Errorf("failed to unmarshal EMR from transaction %s: %v", modification.TxId, err)
+			}
+			if legacy && emr.EMRID != emrID {
+				continue
+			}
+			entry.Record = &emr
+		}
+
+		history = append(history, entry)
+	}
+
+	return history, nil
+}
+
+// GetAllRecordsForPatient retrieves all EMR records for a given patient
+func (c *EMRChaincode) GetAllRecordsForPatient(ctx contractapi.TransactionContextInterface, patientCommonName string) ([]EMR, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("role attribute not found")
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	// Retrieve the patient ID from the CommonName
+	patient, err := c.GetUser(ctx, patientCommonName)
+	if err != nil || patient == nil {
+		return nil, fmt.Errorf("failed to get patient: %v", err)
+	}
+	if patient.Role != "patient" {
+		return nil, fmt.Errorf("user with CommonName %s is not a patient", patientCommonName)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	patientEMRs, err := c.queryRecordsForPatient(ctx, patient.UserID)
+	if err != nil {
+		// Rich queries are only supported by CouchDB, use the patient index on LevelDB
+		patientEMRs, err = c.indexedRecords(ctx, patientIndexObjectType, patient.UserID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var emrs []EMR
+	for _, emr := range patientEMRs {
+		authorized, err := c.isAuthorizedToRead(ctx, role, clientID, &emr, now)
+		if err != nil {
+			return nil, err
+		}
+		if !authorized {
+			continue // Skip records that the client is not authorized to access
+		}
+
+		emrs = append(emrs, emr)
+	}
+
+	return emrs, nil
+}
+
+// queryRecordsForPatient retrieves the EMR records of a patient with a CouchDB rich query
+func (c *EMRChaincode) queryRecordsForPatient(ctx contractapi.TransactionContextInterface, patientID string) ([]EMR, error) {
+	queryString, err := patientRecordsQuery(patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get query result: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var emrs []EMR
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next query result: %v", err)
+		}
+
+		var emr EMR
+		err = json.Unmarshal(queryResponse.Value, &emr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal EMR: %v", err)
+		}
+		if emr.EMRID == "" {
+			continue // Not a record, for example the settings or a proxy of the patient
+		}
+
+		emrs = append(emrs, emr)
+	}
+
+	return emrs, nil
+}
+
+// indexedRecords retrieves the EMR records indexed under indexedID in the given index
+func (c *EMRChaincode) indexedRecords(ctx contractapi.TransactionContextInterface, objectType string, indexedID string) ([]EMR, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, []string{indexedID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s index: %v", objectType, err)
+	}
+	defer resultsIterator.Close()
+
+	var emrs []EMR
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next %s index entry: %v", objectType, err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(attributes) != 2 {
+			return nil, fmt.Errorf("invalid %s index key %q: %v", objectType, queryResponse.Key, err)
+		}
+
+		emr, err := c.getRecord(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+
+		emrs = append(emrs, *emr)
+	}
+
+	return emrs, nil
+}
+
+// GetRecordsSharedWithMe retrieves all the EMR records shared with the calling doctor or hospital that it can read
+// Only records shared with ShareRecord are listed, records the client reads through consent directives are not
+func (c *EMRChaincode) GetRecordsSharedWithMe(ctx contractapi.TransactionContextInterface) ([]EMR, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("role attribute not found")
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedEMRs, err := c.indexedRecords(ctx, granteeIndexObjectType, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	var emrs []EMR
+	for _, emr := range sharedEMRs {
+		// Grants that expired or were given under another role stay indexed
+		authorized, err := c.isAuthorizedToRead(ctx, role, clientID, &emr, now)
+		if err != nil {
+			return nil, err
+		}
+		if !authorized {
+			continue
+		}
+
+		emrs = append(emrs, emr)
+	}
+
+	return emrs, nil
+}
+
+// GetRecordsForPatientPaginated retrieves a page of the EMR records of a patient that the client can read
+func (c *EMRChaincode) GetRecordsForPatientPaginated(ctx contractapi.TransactionContextInterface, patientCommonName string, pageSize int32, bookmark string) (*RecordPage, error) {
+	patient, err := c.GetUser(ctx, patientCommonName)
+	if err != nil || patient == nil {
+		return nil, fmt.Errorf("failed to get patient: %v", err)
+	}
+	if patient.Role != "patient" {
+		return nil, fmt.Errorf("user with CommonName %s is not a patient", patientCommonName)
+	}
+
+	return c.getIndexedRecordPage(ctx, patientIndexObjectType, patient.UserID, pageSize, bookmark)
+}
+
+// GetRecordsCreatedByMePaginated retrieves a page of the EMR records owned by the calling doctor or hospital
+func (c *EMRChaincode) GetRecordsCreatedByMePaginated(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*RecordPage, error) {
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	return c.getIndexedRecordPage(ctx, ownerIndexObjectType, clientID, pageSize, bookmark)
+}
+
+// GetRecordsSharedWithMePaginated retrieves a page of the EMR records shared with the calling doctor or hospital
+// Like GetRecordsSharedWithMe it does not list records the client reads through consent directives
+func (c *EMRChaincode) GetRecordsSharedWithMePaginated(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*RecordPage, error) {
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	return c.getIndexedRecordPage(ctx, granteeIndexObjectType, clientID, pageSize, bookmark)
+}
+
+// getIndexedRecordPage retrieves a page of the EMR records indexed under indexedID that the client can read
+func (c *EMRChaincode) getIndexedRecordPage(ctx contractapi.TransactionContextInterface, objectType string, indexedID string, pageSize int32, bookmark string) (*RecordPage, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("role attribute not found")
+	}
+
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("invalid page size: %d", pageSize)
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(objectType, []string{indexedID}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s index: %v", objectType, err)
+	}
+	defer resultsIterator.Close()
+
+	page := RecordPage{
+		Records:      []EMR{},
+		FetchedCount: metadata.FetchedRecordsCount,
+		Bookmark:     metadata.Bookmark,
+	}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next %s index entry: %v", objectType, err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(attributes) != 2 {
+			return nil, fmt.Errorf("invalid %s index key %q: %v", objectType, queryResponse.Key, err)
+		}
+
+		emr, err := c.getRecord(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+
+		authorized, err := c.isAuthorizedToRead(ctx, role, clientID, emr, now)
+		if err != nil {
+			return nil, err
+		}
+		if !authorized {
+			continue // Skip records that the client is not authorized to access
+		}
+
+		page.Records = append(page.Records, *emr)
+	}
+
+	return &page, nil
+}
+
+// patientRecordsQuery returns the CouchDB query selecting the EMR records of a patient
+// The selector uses the JSON field names of EMR and is served by the index in META-INF/statedb/couchdb/indexes
+// Other documents also have a patientId field, records are told apart by their emrId field
+func patientRecordsQuery(patientID string) (string, error) {
+	query := map[string]any{
+		"selector":  map[string]any{"patientId": patientID, "emrId": map[string]any{"$exists": true}},
+		"use_index": []string{"_design/indexPatientIdDoc", "indexPatientId"},
+	}
+
+	queryJSON, err := json.Marshal(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query: %v", err)
+	}
+	return string(queryJSON), nil
+}
+
+// MigrateLegacyKeys moves the users and records stored under plain keys by earlier versions of the chaincode
+// to their composite keys, only admins can run the migration
+// It visits at most pageSize plain keys from bookmark, it must be submitted again with the returned bookmark
+// until the bookmark is empty, entries whose composite key is already in use are skipped and reported as conflicts
+// Unlike the other admin transactions it is not scoped to the admin's org: legacy users carry no MSP ID, and the
+// migration is a one-off step of the chaincode upgrade that must move every plain key for them to be read again
+func (c *EMRChaincode) MigrateLegacyKeys(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*MigrationPage, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found || role != "admin" {
+		return nil, fmt.Errorf("only admins can migrate legacy keys")
+	}
+
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("invalid page size: %d", pageSize)
+	}
+
+	// Range queries do not return composite keys, so only plain keys are visited
+	// Paginated range queries are only supported in read-only transactions, so the page is bounded here instead
+	// and the bookmark is the plain key the next call starts from
+	resultsIterator, err := ctx.GetStub().GetStateByRange(bookmark, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get legacy keys: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	page := MigrationPage{}
+	for visited := int32(0); resultsIterator.HasNext(); visited++ {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next legacy key: %v", err)
+		}
+		if visited == pageSize {
+			page.Bookmark = queryResponse.Key
+			break
+		}
+
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(queryResponse.Value, &fields) != nil {
+			continue // Not a user or a record
+		}
+
+		// Records were stored under their EMR ID and users under their CommonName
+		var key string
+		var emr *EMR
+		if _, ok := fields["emrId"]; ok {
+			emr = &EMR{}
+			if err = json.Unmarshal(queryResponse.Value, emr); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal EMR %s: %v", queryResponse.Key, err)
+			}
+			key, err = emrKey(ctx, queryResponse.Key)
+		} else if _, ok := fields["userId"]; ok {
+			key, err = userKey(ctx, queryResponse.Key)
+		} else {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		existing, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if %s is already migrated: %v", queryResponse.Key, err)
+		}
+		if existing != nil {
+			page.Conflicts = append(page.Conflicts, queryResponse.Key)
+			continue
+		}
+
+		err = ctx.GetStub().PutState(key, queryResponse.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate %s: %v", queryResponse.Key, err)
+		}
+		err = ctx.GetStub().DelState(queryResponse.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete legacy key %s: %v", queryResponse.Key, err)
+		}
+		if emr != nil {
+			err = c.indexRecord(ctx, emr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		page.Migrated++
+	}
+
+	return &page, nil
 }
 
-type EMR struct {
-	EMRID               string   `json:"emrId"`
-	PatientID           string   `json:"patientId"`
-	DoctorID            string   `json:"doctorId"`
-	HospitalID          string   `json:"hospitalId,omitempty"` // Optional field
-	Diagnosis           string   `json:"diagnosis"`
-	CreatedOn           string   `json:"createdOn"`
-	LastModified        string   `json:"lastModified"`
-	SharedWithDoctors   []string `json:"sharedWithDoctors"`
-	SharedWithHospitals []string `json:"sharedWithHospitals"`
+// isAuthorizedToRead checks if the client is authorized to read the EMR at the given time
+func (c *EMRChaincode) isAuthorizedToRead(ctx contractapi.TransactionContextInterface, role string, clientID string, emr *EMR, now time.Time) (bool, error) {
+	return c.hasPermission(ctx, role, clientID, emr, now, permissionRead)
 }
 
-// CreateRecord creates a new EMR record
-// patientCommonName should be the CommonName of the patient with patient@orgName.example.com
-func (c *EMRChaincode) CreateRecord(ctx contractapi.TransactionContextInterface, emrID string, patientCommonName string, doctorCommonName string, hospitalCommonName string, diagnosis string) error {
-	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
-	if err != nil {
-		return fmt.Errorf("failed to get role attribute: %v", err)
+// isAuthorizedToAmend checks if the client is authorized to amend the EMR at the given time
+// Patients hold the amend permission so they can grant it, but only doctors and hospitals write clinical content
+func (c *EMRChaincode) isAuthorizedToAmend(ctx contractapi.TransactionContextInterface, role string, clientID string, emr *EMR, now time.Time) (bool, error) {
+	if role != "doctor" && role != "hospital" {
+		return false, nil
 	}
-	if !found || (role != "doctor" && role != "hospital") {
-		return fmt.Errorf("only doctors and hospitals can create records")
+
+	return c.hasPermission(ctx, role, clientID, emr, now, permissionAmend)
+}
+
+// isAuthorizedToUnshare checks if the client is authorized to revoke the grant held by granteeID
+func (c *EMRChaincode) isAuthorizedToUnshare(ctx contractapi.TransactionContextInterface, role string, clientID string, granteeID string, emr *EMR, now time.Time) (bool, error) {
+	if clientID == "" {
+		return false, nil
 	}
 
-	// Get ID from ctx
-	clientID, err := ctx.GetClientIdentity().GetID()
+	// Sharees may always give up their own access
+	if clientID == granteeID {
+		return true, nil
+	}
+	return c.hasPermission(ctx, role, clientID, emr, now, permissionRevoke)
+}
+
+// hasPermission checks if the client holds a permission on the EMR at the given time
+func (c *EMRChaincode) hasPermission(ctx contractapi.TransactionContextInterface, role string, clientID string, emr *EMR, now time.Time, permission string) (bool, error) {
+	permissions, err := c.grantedPermissions(ctx, role, clientID, emr, now)
 	if err != nil {
-		return fmt.Errorf("failed to get client ID: %v", err)
+		return false, err
 	}
+	return slices.Contains(permissions, permission), nil
+}
 
-	doctorID := ""
-	hospitalID := ""
+// grantedPermissions returns the permissions the client holds on the EMR at the given time
+// Clients on the deny list of the record or of its patient and users that are not active hold no permission, whatever they were allowed
+func (c *EMRChaincode) grantedPermissions(ctx contractapi.TransactionContextInterface, role string, clientID string, emr *EMR, now time.Time) ([]string, error) {
+	permissions, err := c.allowedPermissions(ctx, role, clientID, emr, now)
+	if err != nil || len(permissions) == 0 || clientID == emr.PatientID {
+		return permissions, err
+	}
 
-	if role == "doctor" {
-		doctorID = clientID
-	} else if role == "hospital" {
-		hospitalID = clientID
-	} else {
-		return fmt.Errorf("invalid role: %s", role)
+	denied, err := isDenied(ctx, clientID, emr)
+	if err != nil {
+		return nil, err
+	}
+	if denied {
+		return nil, nil
 	}
 
-	// Check if the EMR ID already exists
-	existingEMR, err := ctx.GetStub().GetState(emrID)
+	active, err := c.isActiveUser(ctx, clientID)
 	if err != nil {
-		return fmt.Errorf("failed to check if EMR ID exists: %v", err)
+		return nil, err
 	}
-	if existingEMR != nil {
-		return fmt.Errorf("EMR with ID %s already exists", emrID)
+	if !active {
+		return nil, nil
 	}
+	return permissions, nil
+}
 
-	// Retrieve doctor or hospita ID
-	if role == "doctor" { // DoctorID has already been set to UserID
-		// Check if hospital exists
-		hospital, err := c.GetUser(ctx, hospitalCommonName)
-		if err != nil || hospital == nil {
-			// Failed to get hospital or hospital does not exist (create without hospital)
-			hospitalID = ""
-		} else {
-			hospitalID = hospital.UserID
+// allowedPermissions returns the permissions the client is allowed on the EMR at the given time, before deny lists apply
+// Patients other than the record's patient hold the scope of their active proxy for that patient,
+// doctors and hospitals hold the permissions of their grant on the record and of the patient's consent directives
+// Proxies and consent directives do not cover encrypted records, their data key is only wrapped for their parties
+// and share grantees
+func (c *EMRChaincode) allowedPermissions(ctx contractapi.TransactionContextInterface, role string, clientID string, emr *EMR, now time.Time) ([]string, error) {
+	if clientID == "" {
+		return nil, nil
+	}
+
+	switch role {
+	case "patient":
+		if clientID == emr.PatientID {
+			return allPermissions, nil
 		}
-	} else if role == "hospital" { // HospitalID has already been set to UserID
-		// Check if doctor exists
-		doctor, err := c.GetUser(ctx, doctorCommonName)
-		if err != nil || doctor == nil {
-			// Failed to get doctor or doctor does not exist (create without doctor)
-			doctorID = ""
-		} else {
-			doctorID = doctor.UserID
+		if emr.Encrypted {
+			// Proxies hold no wrapped key of encrypted records
+			return nil, nil
+		}
+		return activeProxyScope(ctx, emr.PatientID, clientID, now)
+	case "doctor":
+		if clientID == emr.DoctorID {
+			return allPermissions, nil
+		}
+		return sharedPermissions(ctx, role, clientID, emr.SharedWithDoctors, emr, now)
+	case "hospital":
+		if clientID == emr.HospitalID {
+			return allPermissions, nil
+		}
+		if emr.HospitalID == "" {
+			// Only the consent directives of the patient give hospitals access to records without a HospitalID
+			return sharedPermissions(ctx, role, clientID, nil, emr, now)
 		}
+		return sharedPermissions(ctx, role, clientID, emr.SharedWithHospitals, emr, now)
 	}
+	return nil, nil
+}
 
-	patient, err := c.GetUser(ctx, patientCommonName)
+// sharedPermissions returns the permissions a doctor or hospital holds through its grant on the EMR and the patient's consent directives
+func sharedPermissions(ctx contractapi.TransactionContextInterface, role string, clientID string, grants []Grant, emr *EMR, now time.Time) ([]string, error) {
+	consented, err := consentPermissions(ctx, role, clientID, emr, now)
 	if err != nil {
-		return fmt.Errorf("failed to get patient: %v", err)
+		return nil, err
 	}
-	if patient == nil {
-		return fmt.Errorf("patient with CommonName %s does not exist", patientCommonName)
+
+	held := slices.Concat(activeGrantPermissions(grants, clientID, now), consented)
+	var permissions []string
+	for _, permission := range allPermissions {
+		if slices.Contains(held, permission) {
+			permissions = append(permissions, permission)
+		}
 	}
-	patientID := patient.UserID
-	if patient.Role != "patient" {
-		return fmt.Errorf("user with CommonName %s is not a patient", patientCommonName)
+	return permissions, nil
+}
+
+// activeGrantPermissions returns the permissions of the grant held by granteeID if it has not expired
+func activeGrantPermissions(grants []Grant, granteeID string, now time.Time) []string {
+	index := slices.IndexFunc(grants, func(g Grant) bool { return g.GranteeID == granteeID })
+	if index == -1 || !grants[index].isActive(now) {
+		return nil
 	}
+	return grants[index].permissions()
+}
 
-	timestamp := time.Now().Format(time.RFC3339)
-	emr := EMR{
-		EMRID:               emrID,
-		PatientID:           patientID,
-		DoctorID:            doctorID,
-		HospitalID:          hospitalID,
-		CreatedOn:           timestamp,
-		LastModified:        timestamp,
-		Diagnosis:           diagnosis,
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+// shareExpiry returns when the share permission of the client on the EMR expires, empty if it does not expire
+// Doctors and hospitals holding it through both their grant and consent directives keep it until the last one expires
+func shareExpiry(ctx contractapi.TransactionContextInterface, role string, clientID string, emr *EMR, now time.Time) (string, error) {
+	switch role {
+	case "patient":
+		if clientID == emr.PatientID {
+			return "", nil
+		}
+		proxy, err := getProxy(ctx, emr.PatientID, clientID)
+		if err != nil || proxy == nil {
+			return "", err
+		}
+		return proxy.ExpiresAt, nil
+	case "doctor", "hospital":
+		if clientID == emr.DoctorID || clientID == emr.HospitalID {
+			return "", nil
+		}
+	default:
+		return "", nil
 	}
 
-	emrJSON, err := json.Marshal(emr)
-	if err != nil {
-		return fmt.Errorf("failed to marshal EMR: %v", err)
+	grants := emr.SharedWithDoctors
+	if role == "hospital" {
+		grants = emr.SharedWithHospitals
 	}
 
-	return ctx.GetStub().PutState(emrID, emrJSON)
-}
+	var expiries []string
+	index := slices.IndexFunc(grants, func(g Grant) bool { return g.GranteeID == clientID })
+	if index != -1 && grants[index].isActive(now) && slices.Contains(grants[index].permissions(), permissionShare) {
+		expiries = append(expiries, grants[index].ExpiresAt)
+	}
 
-// ReadRecord retrieves an EMR record by ID
-func (c *EMRChaincode) ReadRecord(ctx contractapi.TransactionContextInterface, emrID string) (*EMR, error) {
-	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	directives, err := consentDirectives(ctx, emr.PatientID, clientID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+		return "", err
 	}
-	if !found {
-		return nil, fmt.Errorf("role attribute not found")
+	for _, directive := range directives {
+		if directive.GranteeRole == role && directive.covers(emr, now) && slices.Contains(directive.Permissions, permissionShare) {
+			expiries = append(expiries, directive.ExpiresAt)
+		}
 	}
 
-	emrJSON, err := ctx.GetStub().GetState(emrID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get state for EMR ID %s: %v", emrID, err)
+	var latest string
+	for i, expiresAt := range expiries {
+		if i == 0 || expiresBefore(latest, expiresAt) {
+			latest = expiresAt
+		}
 	}
-	if emrJSON == nil {
-		return nil, fmt.Errorf("record with ID %s does not exist", emrID)
+	return latest, nil
+}
+
+// expiresBefore checks if RFC 3339 expiry date a is earlier than b, empty dates never expire
+func expiresBefore(a string, b string) bool {
+	if a == "" {
+		return false
+	}
+	if b == "" {
+		return true
 	}
 
-	var emr EMR
-	err = json.Unmarshal(emrJSON, &emr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal EMR: %v", err)
+	expiryA, errA := time.Parse(time.RFC3339, a)
+	expiryB, errB := time.Parse(time.RFC3339, b)
+	return errA == nil && errB == nil && expiryA.Before(expiryB)
+}
+
+// parsePermissions parses a comma separated permission list into the permissions of a new grant
+func parsePermissions(permissions string) ([]string, error) {
+	requested := []string{permissionRead} // Every grant gives read access
+	for _, permission := range strings.Split(permissions, ",") {
+		permission = strings.TrimSpace(permission)
+		if permission == "" {
+			continue
+		}
+		if !slices.Contains(allPermissions, permission) {
+			return nil, fmt.Errorf("invalid permission: %s", permission)
+		}
+		requested = append(requested, permission)
 	}
 
-	clientID, err := ctx.GetClientIdentity().GetID()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get client ID: %v", err)
+	// Store permissions in a canonical order without duplicates
+	var parsed []string
+	for _, permission := range allPermissions {
+		if slices.Contains(requested, permission) {
+			parsed = append(parsed, permission)
+		}
 	}
+	return parsed, nil
+}
 
-	if !c.isAuthorizedToRead(role, clientID, &emr) {
-		return nil, fmt.Errorf("this %s is not authorized to read this record", role)
+// addGrant appends grant to grants, replacing an expired grant held by the same grantee
+// It returns false if the grantee already holds an active grant
+func addGrant(grants []Grant, grant Grant, now time.Time) ([]Grant, bool) {
+	index := slices.IndexFunc(grants, func(g Grant) bool { return g.GranteeID == grant.GranteeID })
+	if index == -1 {
+		return append(grants, grant), true
+	}
+	if grants[index].isActive(now) {
+		return grants, false
 	}
+	grants[index] = grant
+	return grants, true
+}
 
-	return &emr, nil
+// holdsSharedGrant reports whether the grantee holds a grant on the EMR other than an emergency one,
+// the records of those grants are listed in the grantee index
+func holdsSharedGrant(emr *EMR, granteeID string) bool {
+	return slices.ContainsFunc(slices.Concat(emr.SharedWithDoctors, emr.SharedWithHospitals), func(g Grant) bool {
+		return g.GranteeID == granteeID && !g.Emergency
+	})
 }
 
-// ShareRecord shares an EMR record with another entity
-func (c *EMRChaincode) ShareRecord(ctx contractapi.TransactionContextInterface, emrID string, shareWithCommonName string, shareWithRole string) error {
-	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+// getRecord retrieves an EMR record from the world state
+func (c *EMRChaincode) getRecord(ctx contractapi.TransactionContextInterface, emrID string) (*EMR, error) {
+	key, err := emrKey(ctx, emrID)
 	if err != nil {
-		return fmt.Errorf("failed to get role attribute: %v", err)
-	}
-	if !found {
-		return fmt.Errorf("role attribute not found")
+		return nil, err
 	}
 
-	emrJSON, err := ctx.GetStub().GetState(emrID)
+	emrJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
-		return fmt.Errorf("failed to get state for EMR ID %s: %v", emrID, err)
+		return nil, fmt.Errorf("failed to get state for EMR ID %s: %v", emrID, err)
 	}
 	if emrJSON == nil {
-		return fmt.Errorf("record with ID %s does not exist", emrID)
+		return nil, fmt.Errorf("record with ID %s does not exist", emrID)
 	}
 
 	var emr EMR
 	err = json.Unmarshal(emrJSON, &emr)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal EMR: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal EMR: %v", err)
 	}
 
-	clientID, err := ctx.GetClientIdentity().GetID()
+	return &emr, nil
+}
+
+// putRecord writes an EMR record to the world state
+func (c *EMRChaincode) putRecord(ctx contractapi.TransactionContextInterface, emr *EMR) error {
+	key, err := emrKey(ctx, emr.EMRID)
 	if err != nil {
-		return fmt.Errorf("failed to get client ID: %v", err)
+		return err
 	}
 
-	if !c.isAuthorizedToShare(role, clientID, &emr) {
-		return fmt.Errorf("this %s is not authorized to share this record", role)
+	emrJSON, err := json.Marshal(emr)
+	if err != nil {
+		return fmt.Errorf("failed to marshal EMR: %v", err)
 	}
 
-	if shareWithRole == "doctor" {
-		// Find the doctor ID from the CommonName
-		doctor, err := c.GetUser(ctx, shareWithCommonName)
-		if err != nil || doctor == nil {
-			return fmt.Errorf("failed to get doctor: %v for sharing emr with ID %s", err, emrID)
+	return ctx.GetStub().PutState(key, emrJSON)
+}
+
+// indexRecord adds an EMR record to the indexes used to look records up without rich queries
+func (c *EMRChaincode) indexRecord(ctx contractapi.TransactionContextInterface, emr *EMR) error {
+	err := putIndexEntry(ctx, patientIndexObjectType, emr.PatientID, emr.EMRID)
+	if err != nil {
+		return err
+	}
+
+	for _, ownerID := range []string{emr.DoctorID, emr.HospitalID} {
+		if ownerID == "" {
+			continue
 		}
-		emr.SharedWithDoctors = append(emr.SharedWithDoctors, doctor.UserID)
-	} else if shareWithRole == "hospital" {
-		// Find the hospital ID from the CommonName
-		hospital, err := c.GetUser(ctx, shareWithCommonName)
-		if err != nil || hospital == nil {
-			return fmt.Errorf("failed to get hospital: %v for sharing emr with ID %s", err, emrID)
+		err = putIndexEntry(ctx, ownerIndexObjectType, ownerID, emr.EMRID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, grant := range slices.Concat(emr.SharedWithDoctors, emr.SharedWithHospitals) {
+		if grant.Emergency {
+			continue // Emergency grants are not shares
+		}
+		err = putIndexEntry(ctx, granteeIndexObjectType, grant.GranteeID, emr.EMRID)
+		if err != nil {
+			return err
 		}
-		emr.SharedWithHospitals = append(emr.SharedWithHospitals, hospital.UserID)
-	} else {
-		return fmt.Errorf("invalid role to share with: %s", shareWithRole)
 	}
 
-	emrJSON, err = json.Marshal(emr)
+	return nil
+}
+
+// putIndexEntry adds an EMR ID to the entries of an index
+func putIndexEntry(ctx contractapi.TransactionContextInterface, objectType string, indexedID string, emrID string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{indexedID, emrID})
 	if err != nil {
-		return fmt.Errorf("failed to marshal EMR: %v", err)
+		return fmt.Errorf("failed to create %s index key: %v", objectType, err)
 	}
 
-	return ctx.GetStub().PutState(emrID, emrJSON)
+	// Index entries only need a key, but an empty value would delete the entry
+	return ctx.GetStub().PutState(key, []byte{0x00})
 }
 
-// GetAllRecordsForPatient retrieves all EMR records for a given patient
-func (c *EMRChaincode) GetAllRecordsForPatient(ctx contractapi.TransactionContextInterface, patientCommonName string) ([]EMR, error) {
-	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+// delIndexEntry removes an EMR ID from the entries of an index
+func delIndexEntry(ctx contractapi.TransactionContextInterface, objectType string, indexedID string, emrID string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{indexedID, emrID})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get role attribute: %v", err)
+		return fmt.Errorf("failed to create %s index key: %v", objectType, err)
 	}
-	if !found {
-		return nil, fmt.Errorf("role attribute not found")
+
+	return ctx.GetStub().DelState(key)
+}
+
+// emrKey returns the world state key of the EMR record with the given ID
+func emrKey(ctx contractapi.TransactionContextInterface, emrID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(emrObjectType, []string{emrID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create key for EMR ID %s: %v", emrID, err)
 	}
+	return key, nil
+}
 
-	clientID, err := ctx.GetClientIdentity().GetID()
+// userKey returns the world state key of the user with the given CommonName
+func userKey(ctx contractapi.TransactionContextInterface, commonName string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(userObjectType, []string{commonName})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get client ID: %v", err)
+		return "", fmt.Errorf("failed to create key for user %s: %v", commonName, err)
 	}
+	return key, nil
+}
 
-	// Retrieve the patient ID from the CommonName
-	patient, err := c.GetUser(ctx, patientCommonName)
-	if err != nil || patient == nil {
-		return nil, fmt.Errorf("failed to get patient: %v", err)
+// transientContent returns the record content passed in the transient map of the proposal
+func transientContent(ctx contractapi.TransactionContextInterface) ([]byte, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient map: %v", err)
 	}
-	if patient.Role != "patient" {
-		return nil, fmt.Errorf("user with CommonName %s is not a patient", patientCommonName)
+
+	content := transientMap[contentTransientKey]
+	if len(content) == 0 {
+		return nil, fmt.Errorf("the record content must be passed in the transient map under the %q key", contentTransientKey)
 	}
+	return content, nil
+}
 
-	queryString := fmt.Sprintf(`{"selector":{"patientID":"%s"}}`, patient.UserID)
+// orgCollection returns the private data collection of the client's org
+func orgCollection(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get client MSP ID: %v", err)
+	}
+	if !slices.Contains(collectionMSPIDs, mspID) {
+		return "", fmt.Errorf("no private collection for MSP %s", mspID)
+	}
+	return mspID + "PrivateCollection", nil
+}
 
-	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
+// contentKey returns the private data key of the content of a record version
+func contentKey(ctx contractapi.TransactionContextInterface, emrID string, version int) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(contentObjectType, []string{emrID, strconv.Itoa(version)})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get query result: %v", err)
+		return "", fmt.Errorf("failed to create content key for EMR ID %s: %v", emrID, err)
 	}
-	defer resultsIterator.Close()
+	return key, nil
+}
 
-	var emrs []EMR
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get next query result: %v", err)
-		}
+// putRecordContent stores the content of a record version in the record collection and returns its SHA-256
+func putRecordContent(ctx contractapi.TransactionContextInterface, emr *EMR, version int, content []byte) (string, error) {
+	key, err := contentKey(ctx, emr.EMRID, version)
+	if err != nil {
+		return "", err
+	}
 
-		var emr EMR
-		err = json.Unmarshal(queryResponse.Value, &emr)
-		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal EMR: %v", err)
-		}
+	err = ctx.GetStub().PutPrivateData(emr.Collection, key, content)
+	if err != nil {
+		return "", fmt.Errorf("failed to put content of EMR ID %s in collection %s: %v", emr.EMRID, emr.Collection, err)
+	}
 
-		if !c.isAuthorizedToRead(role, clientID, &emr) {
-			continue // Skip records that the client is not authorized to access
-		}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:]), nil
+}
 
-		emrs = append(emrs, emr)
+// getRecordContent retrieves the content of a record version from the record collection and checks it against its hash
+// Only peers of the org whose collection holds the record have the content, transactions reading it must be
+// evaluated or submitted on one of them
+func getRecordContent(ctx contractapi.TransactionContextInterface, emr *EMR, version RecordVersion) ([]byte, error) {
+	key, err := contentKey(ctx, emr.EMRID, version.Version)
+	if err != nil {
+		return nil, err
 	}
 
-	return emrs, nil
-}
+	content, err := ctx.GetStub().GetPrivateData(emr.Collection, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content of EMR ID %s from collection %s: %v", emr.EMRID, emr.Collection, err)
+	}
+	if content == nil {
+		return nil, fmt.Errorf("content of version %d of record %s is not available on this peer", version.Version, emr.EMRID)
+	}
 
-// isAuthorizedToRead checks if the client is authorized to read the EMR
-func (c *EMRChaincode) isAuthorizedToRead(role string, clientID string, emr *EMR) bool {
-	if role == "hospital" && (clientID == "" || emr.HospitalID == "") {
-		// Explicitly deny access if either clientID or HospitalID is empty
-		return false
+	hash, err := hex.DecodeString(version.ContentHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content hash for version %d of record %s: %v", version.Version, emr.EMRID, err)
+	}
+	actualHash := sha256.Sum256(content)
+	if !bytes.Equal(hash, actualHash[:]) {
+		return nil, fmt.Errorf("content of version %d of record %s does not match its hash", version.Version, emr.EMRID)
 	}
 
-	return (role == "patient" && clientID == emr.PatientID) ||
-		(role == "doctor" && (clientID == emr.DoctorID || slices.Contains(emr.SharedWithDoctors, clientID))) ||
-		(role == "hospital" && (clientID == emr.HospitalID || slices.Contains(emr.SharedWithHospitals, clientID)))
+	return content, nil
 }
 
-// isAuthorizedToShare checks if the client is authorized to share the EMR
-func (c *EMRChaincode) isAuthorizedToShare(role string, clientID string, emr *EMR) bool {
-	return (role == "patient" && clientID == emr.PatientID) ||
-		(role == "doctor" && (clientID == emr.DoctorID || slices.Contains(emr.SharedWithDoctors, clientID))) ||
-		(role == "hospital" && (clientID == emr.HospitalID || slices.Contains(emr.SharedWithHospitals, clientID)))
+// now returns the current time of the transaction from the chaincode clock
+func (c *EMRChaincode) now(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	if c.clock == nil {
+		return txClock{}.now(ctx)
+	}
+	return c.clock.now(ctx)
 }
 
 func main() {
-	chaincode, err := contractapi.NewChaincode(new(EMRChaincode))
+	emrChaincode := new(EMRChaincode)
+	emrChaincode.BeforeTransaction = emrChaincode.resolveCaller
+
+	chaincode, err := contractapi.NewChaincode(emrChaincode)
 	if err != nil {
 		fmt.Printf("Error create EMRChaincode: %s", err.Error())
 		return
@@ -353,6 +1938,15 @@ func (c *EMRChaincode) RegisterUser(ctx contractapi.TransactionContextInterface)
 		return fmt.Errorf("failed to get client ID: %v", err)
 	}
 
+	// A certificate linked to a user cannot register another one
+	linked, err := c.userByClientID(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	if linked != nil {
+		return fmt.Errorf("this certificate is already linked to user with CommonName %s", linked.CommonName)
+	}
+
 	// Extract the CommonName from the X.509 certificate
 	cert, err := ctx.GetClientIdentity().GetX509Certificate()
 	if err != nil {
@@ -372,7 +1966,11 @@ func (c *EMRChaincode) RegisterUser(ctx contractapi.TransactionContextInterface)
 	fullName := fmt.Sprintf("%s@%s.example.com", cert.Subject.CommonName, orgName)
 
 	// Check if the user is already registered
-	existingUser, err := ctx.GetStub().GetState(fullName)
+	key, err := userKey(ctx, fullName)
+	if err != nil {
+		return err
+	}
+	existingUser, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return fmt.Errorf("failed to check if user is already registered: %v", err)
 	}
@@ -389,11 +1987,19 @@ func (c *EMRChaincode) RegisterUser(ctx contractapi.TransactionContextInterface)
 		return fmt.Errorf("role attribute not found for client ID: %s", clientID)
 	}
 
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to get MSP ID: %v", err)
+	}
+
 	// Create a new user object
 	user := User{
-		UserID:     clientID,
-		Role:       role,
-		CommonName: fullName,
+		UserID:         clientID,
+		Role:           role,
+		CommonName:     fullName,
+		Status:         userStatusActive,
+		MSPID:          mspID,
+		CertificateIDs: []string{clientID},
 	}
 
 	// Serialize the user object to JSON
@@ -403,11 +2009,29 @@ func (c *EMRChaincode) RegisterUser(ctx contractapi.TransactionContextInterface)
 	}
 
 	// Store the user in the ledger
-	return ctx.GetStub().PutState(fullName, userJSON)
+	err = ctx.GetStub().PutState(key, userJSON)
+	if err != nil {
+		return err
+	}
+
+	err = putUserID(ctx, user.UserID, user.CommonName)
+	if err != nil {
+		return err
+	}
+
+	return setEvent(ctx, EventUserRegistered, UserRegisteredEvent{
+		UserID: user.UserID,
+		Role:   user.Role,
+	})
 }
 
 func (c *EMRChaincode) GetUser(ctx contractapi.TransactionContextInterface, commonName string) (*User, error) {
-	userJSON, err := ctx.GetStub().GetState(commonName)
+	key, err := userKey(ctx, commonName)
+	if err != nil {
+		return nil, err
+	}
+
+	userJSON, err := ctx.GetStub().GetState(key)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user with CommonName %s: %v", commonName, err)
@@ -425,3 +2049,22 @@ func (c *EMRChaincode) GetUser(ctx contractapi.TransactionContextInterface, comm
 
 	return &user, nil
 }
+
+// putUser writes a registered user under its CommonName
+func putUser(ctx contractapi.TransactionContextInterface, user *User) error {
+	key, err := userKey(ctx, user.CommonName)
+	if err != nil {
+		return err
+	}
+
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, userJSON)
+	if err != nil {
+		return fmt.Errorf("failed to write user: %v", err)
+	}
+	return nil
+}
@@ -1,18 +1,33 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
 	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/xeipuuv/gojsonschema"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// txTimestamp is the transaction timestamp returned by the mocked stubs
+var txTimestamp = time.Date(2025, 4, 1, 12, 0, 0, 0, time.UTC)
+
 type MockStub struct {
 	mock.Mock
 	shim.ChaincodeStubInterface
@@ -28,6 +43,11 @@ type MockResultsIterator struct {
 	shim.StateQueryIteratorInterface
 }
 
+type MockHistoryIterator struct {
+	mock.Mock
+	shim.HistoryQueryIteratorInterface
+}
+
 func (m *MockStub) PutState(key string, value []byte) error {
 	args := m.Called(key, value)
 	return args.Error(0)
@@ -43,9 +63,98 @@ func (m *MockStub) GetState(key string) ([]byte, error) {
 
 func (m *MockStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
 	args := m.Called(query)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(shim.StateQueryIteratorInterface), args.Error(1)
+}
+
+func (m *MockStub) GetTxTimestamp() (*timestamppb.Timestamp, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*timestamppb.Timestamp), args.Error(1)
+}
+
+func (m *MockStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	args := m.Called(key)
+	return args.Get(0).(shim.HistoryQueryIteratorInterface), args.Error(1)
+}
+
+func (m *MockStub) GetFunctionAndParameters() (string, []string) {
+	args := m.Called()
+	return args.String(0), args.Get(1).([]string)
+}
+
+func (m *MockStub) GetCreator() ([]byte, error) {
+	args := m.Called()
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *MockStub) GetTxID() string {
+	args := m.Called()
+	return args.String(0)
+}
+
+func (m *MockStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+
+func (m *MockStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	args := m.Called(objectType, keys)
 	return args.Get(0).(shim.StateQueryIteratorInterface), args.Error(1)
 }
 
+func (m *MockStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	args := m.Called(objectType, keys, pageSize, bookmark)
+	if args.Get(0) == nil {
+		return nil, nil, args.Error(2)
+	}
+	return args.Get(0).(shim.StateQueryIteratorInterface), args.Get(1).(*peer.QueryResponseMetadata), args.Error(2)
+}
+
+func (m *MockStub) GetTransient() (map[string][]byte, error) {
+	args := m.Called()
+	return args.Get(0).(map[string][]byte), args.Error(1)
+}
+
+func (m *MockStub) PutPrivateData(collection string, key string, value []byte) error {
+	args := m.Called(collection, key, value)
+	return args.Error(0)
+}
+
+func (m *MockStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	args := m.Called(collection, key)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *MockStub) GetPrivateDataHash(collection string, key string) ([]byte, error) {
+	args := m.Called(collection, key)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *MockStub) SetEvent(name string, payload []byte) error {
+	args := m.Called(name, payload)
+	return args.Error(0)
+}
+
+func (m *MockClientIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	args := m.Called()
+	return args.Get(0).(*x509.Certificate), args.Error(1)
+}
+
+func (m *MockClientIdentity) GetMSPID() (string, error) {
+	args := m.Called()
+	return args.String(0), args.Error(1)
+}
+
 func (m *MockClientIdentity) GetAttributeValue(attrName string) (string, bool, error) {
 	args := m.Called(attrName)
 	return args.String(0), args.Bool(1), args.Error(2)
@@ -71,6 +180,141 @@ func (m *MockResultsIterator) Close() error {
 	return args.Error(0)
 }
 
+func (m *MockHistoryIterator) HasNext() bool {
+	args := m.Called()
+	return args.Bool(0)
+}
+
+func (m *MockHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	args := m.Called()
+	return args.Get(0).(*queryresult.KeyModification), args.Error(1)
+}
+
+func (m *MockHistoryIterator) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	args := m.Called(startKey, endKey)
+	return args.Get(0).(shim.StateQueryIteratorInterface), args.Error(1)
+}
+
+func (m *MockStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	// Composite keys start with a separator and end each part with one
+	parts := strings.Split(compositeKey, "\x00")
+	return parts[1], parts[2 : len(parts)-1], nil
+}
+
+func (m *MockStub) DelState(key string) error {
+	args := m.Called(key)
+	return args.Error(0)
+}
+
+// emrStateKey returns the composite key an EMR record is stored under
+func emrStateKey(emrID string) string {
+	key, _ := shim.CreateCompositeKey("emr", []string{emrID})
+	return key
+}
+
+// userStateKey returns the composite key a user is stored under
+func userStateKey(commonName string) string {
+	key, _ := shim.CreateCompositeKey("user", []string{commonName})
+	return key
+}
+
+// userIDStateKey returns the composite key mapping a client ID to the CommonName of its user
+func userIDStateKey(clientID string) string {
+	key, _ := shim.CreateCompositeKey("userid", []string{clientID})
+	return key
+}
+
+// patientIndexStateKey returns the composite key of a patient index entry
+func patientIndexStateKey(patientID string, emrID string) string {
+	key, _ := shim.CreateCompositeKey("patient~emr", []string{patientID, emrID})
+	return key
+}
+
+// ownerIndexStateKey returns the composite key of an owner index entry
+func ownerIndexStateKey(ownerID string, emrID string) string {
+	key, _ := shim.CreateCompositeKey("owner~emr", []string{ownerID, emrID})
+	return key
+}
+
+// granteeIndexStateKey returns the composite key of a grantee index entry
+func granteeIndexStateKey(granteeID string, emrID string) string {
+	key, _ := shim.CreateCompositeKey("grantee~emr", []string{granteeID, emrID})
+	return key
+}
+
+// contentStateKey returns the private data key of the content of a record version
+func contentStateKey(emrID string, version int) string {
+	key, _ := shim.CreateCompositeKey("content", []string{emrID, fmt.Sprint(version)})
+	return key
+}
+
+// emergencyUsageStateKey returns the composite key the emergency accesses of a user are counted under
+func emergencyUsageStateKey(accessorID string) string {
+	key, _ := shim.CreateCompositeKey("emergency", []string{accessorID})
+	return key
+}
+
+// patientSettingsStateKey returns the composite key the settings of a patient are stored under
+func patientSettingsStateKey(patientID string) string {
+	key, _ := shim.CreateCompositeKey("settings", []string{patientID})
+	return key
+}
+
+// proxyStateKey returns the composite key of the proxy held by proxyID for a patient
+func proxyStateKey(patientID string, proxyID string) string {
+	key, _ := shim.CreateCompositeKey("proxy", []string{patientID, proxyID})
+	return key
+}
+
+// contentHash returns the hex encoded SHA-256 of a record content
+func contentHash(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+// Clinical data documents passed as record content
+const (
+	clinicalData1 = `{"schemaVersion":"1","diagnosis":"diagnosis1","icd10Codes":["J00"]}`
+	clinicalData2 = `{"schemaVersion":"1","diagnosis":"diagnosis2","medications":[{"name":"paracetamol","dose":"500 mg"}]}`
+)
+
+// eventPayload returns the JSON payload of a chaincode event
+func eventPayload(event any) []byte {
+	payload, _ := json.Marshal(event)
+	return payload
+}
+
+// mockNoConsentDirectives makes the stub return no consent directives of a patient for a grantee
+func mockNoConsentDirectives(mockStub *MockStub, patientID string, granteeID string) {
+	mockResultsIterator := new(MockResultsIterator)
+	mockResultsIterator.On("HasNext").Return(false)
+	mockResultsIterator.On("Close").Return(nil)
+	mockStub.On("GetStateByPartialCompositeKey", "consent", []string{patientID, granteeID}).Return(mockResultsIterator, nil)
+}
+
+// denyStateKey returns the composite key of the deny rule of a patient for a user
+func denyStateKey(patientID string, userID string) string {
+	key, _ := shim.CreateCompositeKey("deny", []string{patientID, userID})
+	return key
+}
+
+// authorized returns the result of an authorization check that should not fail
+func authorized(ok bool, err error) bool {
+	return err == nil && ok
+}
+
+// fixedClock is a chaincode clock that always returns the same time
+type fixedClock time.Time
+
+func (f fixedClock) now(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	return time.Time(f), nil
+}
+
 type mockTransactionContext struct {
 	contractapi.TransactionContextInterface
 	stub           *MockStub
@@ -87,26 +331,53 @@ func (ctx *mockTransactionContext) GetClientIdentity() cid.ClientIdentity {
 
 // Doctors should be able to create records for patients
 func TestCreateRecordDoctor(t *testing.T) {
-	chaincode := new(EMRChaincode)
+	chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
 	mockStub := new(MockStub)
 	mockClientIdentity := new(MockClientIdentity)
 
 	// Mock user registration (not needed for doctor since it is the one creating the record)
-	mockStub.On("GetState", "patient1@orgName.example.com").Return([]byte(`{"userId":"patient1","role":"patient","commonName":"patient1@orgName.example.com"}`), nil)
-	mockStub.On("GetState", "hospital1@orgName.example.com").Return([]byte(`{"userId":"hospital1","role":"hospital","commonName":"hospital1@orgName.example.com"}`), nil)
+	mockStub.On("GetState", userStateKey("patient1@orgName.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","commonName":"patient1@orgName.example.com"}`), nil)
+	mockStub.On("GetState", userStateKey("hospital1@orgName.example.com")).Return([]byte(`{"userId":"hospital1","role":"hospital","commonName":"hospital1@orgName.example.com"}`), nil)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentity.On("GetID").Return("doctor1", nil)
 
-	mockStub.On("GetState", "emr1").Return(nil, nil) // Mock no existing record
-	mockStub.On("PutState", "emr1", mock.Anything).Return(nil)
+	// Timestamps come from the chaincode clock
+	emrExpected := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		ContentHash:         contentHash(clinicalData1),
+		Collection:          "Org1MSPPrivateCollection",
+		CreatedOn:           "2025-04-01T12:00:00Z",
+		LastModified:        "2025-04-01T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+		Versions: []RecordVersion{
+			{Version: 1, Type: "original", ContentHash: contentHash(clinicalData1), AuthorID: "doctor1", Timestamp: "2025-04-01T12:00:00Z"},
+		},
+	}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockStub.On("GetState", emrStateKey("emr1")).Return(nil, nil) // Mock no existing record
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", patientIndexStateKey("patient1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("doctor1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("hospital1", "emr1"), []byte{0x00}).Return(nil)
+
+	// The diagnosis is only written to the private data collection of the client's org
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(clinicalData1)}, nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("PutPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 1), []byte(clinicalData1)).Return(nil)
+	mockStub.On("SetEvent", "RecordCreated", eventPayload(RecordCreatedEvent{EMRID: "emr1", PatientID: "patient1", DoctorID: "doctor1", HospitalID: "hospital1"})).Return(nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com", "diagnosis1")
+	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com")
 	assert.NoError(t, err)
 
 	mockClientIdentity.AssertExpectations(t)
@@ -115,25 +386,34 @@ func TestCreateRecordDoctor(t *testing.T) {
 
 // Hospitals should be able to create records for patients
 func TestCreateRecordHospital(t *testing.T) {
-	chaincode := new(EMRChaincode)
+	chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
 	mockStub := new(MockStub)
 	mockClientIdentity := new(MockClientIdentity)
 
 	// Mock user registration (not needed for hospital since it is the one creating the record)
-	mockStub.On("GetState", "patient1@orgName.example.com").Return([]byte(`{"userId":"patient1","role":"patient","commonName":"patient1@orgName.example.com"}`), nil)
-	mockStub.On("GetState", "doctor1@orgName.example.com").Return([]byte(`{"userId":"doctor1","role":"doctor","commonName":"doctor1@orgName.example.com"}`), nil)
+	mockStub.On("GetState", userStateKey("patient1@orgName.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","commonName":"patient1@orgName.example.com"}`), nil)
+	mockStub.On("GetState", userStateKey("doctor1@orgName.example.com")).Return([]byte(`{"userId":"doctor1","role":"doctor","commonName":"doctor1@orgName.example.com"}`), nil)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentity.On("GetID").Return("hospital1", nil)
-	mockStub.On("GetState", "emr1").Return(nil, nil) // Mock no existing record
-	mockStub.On("PutState", "emr1", mock.Anything).Return(nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(nil, nil) // Mock no existing record
+	mockStub.On("PutState", emrStateKey("emr1"), mock.Anything).Return(nil)
+	mockStub.On("PutState", patientIndexStateKey("patient1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("doctor1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("hospital1", "emr1"), []byte{0x00}).Return(nil)
+
+	// The diagnosis is only written to the private data collection of the client's org
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(clinicalData1)}, nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("PutPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 1), []byte(clinicalData1)).Return(nil)
+	mockStub.On("SetEvent", "RecordCreated", eventPayload(RecordCreatedEvent{EMRID: "emr1", PatientID: "patient1", DoctorID: "doctor1", HospitalID: "hospital1"})).Return(nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com", "diagnosis1")
+	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com")
 	assert.NoError(t, err)
 
 	mockClientIdentity.AssertExpectations(t)
@@ -149,13 +429,14 @@ func TestCreateRecordPatient(t *testing.T) {
 	// No user registration needed for patient since they are not creating the record (denied)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(clinicalData1)}, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com", "diagnosis1")
+	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com")
 	assert.Error(t, err)
 
 	mockClientIdentity.AssertExpectations(t)
@@ -170,14 +451,15 @@ func TestCreateRecordWithExistingID(t *testing.T) {
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentity.On("GetID").Return("doctor1", nil)
-	mockStub.On("GetState", "emr1").Return([]byte("existing record"), nil) // Mock existing record
+	mockStub.On("GetState", emrStateKey("emr1")).Return([]byte("existing record"), nil) // Mock existing record
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(clinicalData1)}, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.CreateRecord(ctx, "emr1", "patient1", "doctor1", "hospital1", "diagnosis1")
+	err := chaincode.CreateRecord(ctx, "emr1", "patient1", "doctor1", "hospital1")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "EMR with ID emr1 already exists")
 
@@ -189,6 +471,8 @@ func TestCreateRecordWithExistingID(t *testing.T) {
 func TestReadRecordDoctorOwner(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
 	mockClientIdentity := new(MockClientIdentity)
 
 	emr := EMR{
@@ -199,14 +483,15 @@ func TestReadRecordDoctorOwner(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentity.On("GetID").Return("doctor1", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -225,6 +510,7 @@ func TestReadRecordDoctorOwner(t *testing.T) {
 func TestReadRecordDoctorNotOwner(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
 	mockClientIdentity := new(MockClientIdentity)
 
 	emr := EMR{
@@ -235,14 +521,15 @@ func TestReadRecordDoctorNotOwner(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentity.On("GetID").Return("doctor2", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -261,6 +548,8 @@ func TestReadRecordDoctorNotOwner(t *testing.T) {
 func TestReadRecordHospitalOwner(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "hospital1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("hospital1")).Return(nil, nil)
 	mockClientIdentity := new(MockClientIdentity)
 
 	emr := EMR{
@@ -271,14 +560,15 @@ func TestReadRecordHospitalOwner(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentity.On("GetID").Return("hospital1", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -298,6 +588,7 @@ func TestReadRecordHospitalOwner(t *testing.T) {
 func TestReadRecordHospitalNotOwner(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockNoConsentDirectives(mockStub, "patient1", "hospital2")
 	mockClientIdentity := new(MockClientIdentity)
 
 	emr := EMR{
@@ -308,14 +599,15 @@ func TestReadRecordHospitalNotOwner(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentity.On("GetID").Return("hospital2", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -334,6 +626,7 @@ func TestReadRecordHospitalNotOwner(t *testing.T) {
 func TestReadRecordHospitalNoID(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockNoConsentDirectives(mockStub, "patient1", "hospital2")
 	mockClientIdentity := new(MockClientIdentity)
 
 	emr := EMR{
@@ -344,14 +637,15 @@ func TestReadRecordHospitalNoID(t *testing.T) {
 		HospitalID:          "",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentity.On("GetID").Return("hospital2", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -366,6 +660,58 @@ func TestReadRecordHospitalNoID(t *testing.T) {
 	mockStub.AssertExpectations(t)
 }
 
+// Hospitals should not share or amend records without a HospitalID they cannot read
+func TestHospitalGrantOnRecordWithoutHospital(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockNoConsentDirectives(mockStub, "patient1", "hospital2")
+	ctx := &mockTransactionContext{stub: mockStub}
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share", "amend"}}},
+	}
+
+	assert.False(t, authorized(chaincode.isAuthorizedToRead(ctx, "hospital", "hospital2", &emr, txTimestamp)))
+	assert.False(t, authorized(chaincode.hasPermission(ctx, "hospital", "hospital2", &emr, txTimestamp, permissionShare)))
+	assert.False(t, authorized(chaincode.isAuthorizedToAmend(ctx, "hospital", "hospital2", &emr, txTimestamp)))
+}
+
+// Records without a hospital should not be shared with hospitals, the grant would give no access
+func TestShareRecordWithoutHospitalToHospital(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "hospital2@orgName.example.com", "hospital", 0, "")
+	assert.EqualError(t, err, "record with ID emr1 has no hospital and can only be shared with hospitals through a consent directive")
+
+	mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+	mockStub.AssertNotCalled(t, "SetEvent", mock.Anything, mock.Anything)
+}
+
 // Empty hospital ID should not be allowed
 func TestReadRecordHospitalEmptyID(t *testing.T) {
 	chaincode := new(EMRChaincode)
@@ -380,14 +726,15 @@ func TestReadRecordHospitalEmptyID(t *testing.T) {
 		HospitalID:          "",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentity.On("GetID").Return("", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -416,14 +763,15 @@ func TestReadRecordPatientOwner(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
 	mockClientIdentity.On("GetID").Return("patient1", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -452,14 +800,16 @@ func TestReadRecordPatientNotOwner(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
 	mockClientIdentity.On("GetID").Return("patient2", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetState", proxyStateKey("patient1", "patient2")).Return(nil, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -477,6 +827,8 @@ func TestReadRecordPatientNotOwner(t *testing.T) {
 func TestShareRecordDoctorOwnerToDoctor(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
 	mockClientIdentity := new(MockClientIdentity)
 
 	emrBase := EMR{
@@ -487,19 +839,22 @@ func TestShareRecordDoctorOwnerToDoctor(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrBaseJSON, _ := json.Marshal(emrBase)
 
 	emrExpected := emrBase
-	emrExpected.SharedWithDoctors = []string{"doctor2"}
+	emrExpected.SharedWithDoctors = []Grant{{GrantorID: "doctor1", GranteeID: "doctor2", GrantedAt: txTimestamp.Format(time.RFC3339), Permissions: []string{"read"}}}
 	emrExpectedJSON, _ := json.Marshal(emrExpected)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentity.On("GetID").Return("doctor1", nil)
-	mockStub.On("GetState", "emr1").Return(emrBaseJSON, nil)
-	mockStub.On("PutState", "emr1", emrExpectedJSON).Return(nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "doctor1", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
 
 	// Mock GetUser for doctor2
 	doctor2 := User{
@@ -508,7 +863,7 @@ func TestShareRecordDoctorOwnerToDoctor(t *testing.T) {
 		CommonName: "doctor2@orgName.example.com",
 	}
 	doctor2JSON, _ := json.Marshal(doctor2)
-	mockStub.On("GetState", "doctor2@orgName.example.com").Return(doctor2JSON, nil)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -516,7 +871,7 @@ func TestShareRecordDoctorOwnerToDoctor(t *testing.T) {
 	}
 
 	// Share the record with another doctor
-	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor")
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", 0, "")
 	assert.NoError(t, err)
 
 	// Verify doctor2 can access the record
@@ -524,7 +879,11 @@ func TestShareRecordDoctorOwnerToDoctor(t *testing.T) {
 	mockClientIdentityDoctor2.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentityDoctor2.On("GetID").Return("doctor2", nil)
 	mockStubDoctor := new(MockStub)
-	mockStubDoctor.On("GetState", "emr1").Return(emrExpectedJSON, nil)
+	mockStubDoctor.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStubDoctor.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStubDoctor, "patient1", "doctor2")
+	mockStubDoctor.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil)
+	mockStubDoctor.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	ctx.clientIdentity = mockClientIdentityDoctor2
 	ctx.stub = mockStubDoctor
 	// Attempt to read the record
@@ -541,6 +900,9 @@ func TestShareRecordDoctorOwnerToDoctor(t *testing.T) {
 func TestShareRecordDoctorShareListToDoctor(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
 	mockClientIdentity := new(MockClientIdentity)
 
 	emrBase := EMR{
@@ -551,19 +913,22 @@ func TestShareRecordDoctorShareListToDoctor(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{"doctor2"},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{},
 	}
 	emrBaseJSON, _ := json.Marshal(emrBase)
 
 	emrExpected := emrBase
-	emrExpected.SharedWithDoctors = []string{"doctor2", "doctor3"}
+	emrExpected.SharedWithDoctors = append(emrBase.SharedWithDoctors, Grant{GrantorID: "doctor2", GranteeID: "doctor3", GrantedAt: txTimestamp.Format(time.RFC3339), Permissions: []string{"read"}})
 	emrExpectedJSON, _ := json.Marshal(emrExpected)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentity.On("GetID").Return("doctor2", nil)
-	mockStub.On("GetState", "emr1").Return(emrBaseJSON, nil)
-	mockStub.On("PutState", "emr1", emrExpectedJSON).Return(nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor3", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "doctor2", GranteeID: "doctor3", GranteeRole: "doctor"})).Return(nil)
 
 	// Mock GetUser for doctor3
 	doctor3 := User{
@@ -572,14 +937,14 @@ func TestShareRecordDoctorShareListToDoctor(t *testing.T) {
 		CommonName: "doctor3@orgName.example.com",
 	}
 	doctor3JSON, _ := json.Marshal(doctor3)
-	mockStub.On("GetState", "doctor3@orgName.example.com").Return(doctor3JSON, nil)
+	mockStub.On("GetState", userStateKey("doctor3@orgName.example.com")).Return(doctor3JSON, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.ShareRecord(ctx, "emr1", "doctor3@orgName.example.com", "doctor")
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor3@orgName.example.com", "doctor", 0, "")
 	assert.NoError(t, err)
 
 	// Verify doctor3 can access the record
@@ -587,7 +952,11 @@ func TestShareRecordDoctorShareListToDoctor(t *testing.T) {
 	mockClientIdentityDoctor3.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentityDoctor3.On("GetID").Return("doctor3", nil)
 	mockStubDoctor := new(MockStub)
-	mockStubDoctor.On("GetState", "emr1").Return(emrExpectedJSON, nil)
+	mockStubDoctor.On("GetState", denyStateKey("patient1", "doctor3")).Return(nil, nil)
+	mockStubDoctor.On("GetState", userIDStateKey("doctor3")).Return(nil, nil)
+	mockNoConsentDirectives(mockStubDoctor, "patient1", "doctor3")
+	mockStubDoctor.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil)
+	mockStubDoctor.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	ctx.clientIdentity = mockClientIdentityDoctor3
 	ctx.stub = mockStubDoctor
 	// Attempt to read the record
@@ -604,6 +973,8 @@ func TestShareRecordDoctorShareListToDoctor(t *testing.T) {
 func TestShareRecordDoctorOwnerToHospital(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
 	mockClientIdentity := new(MockClientIdentity)
 
 	emrBase := EMR{
@@ -614,19 +985,22 @@ func TestShareRecordDoctorOwnerToHospital(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrBaseJSON, _ := json.Marshal(emrBase)
 
 	emrExpected := emrBase
-	emrExpected.SharedWithHospitals = []string{"hospital2"}
+	emrExpected.SharedWithHospitals = []Grant{{GrantorID: "doctor1", GranteeID: "hospital2", GrantedAt: txTimestamp.Format(time.RFC3339), Permissions: []string{"read"}}}
 	emrExpectedJSON, _ := json.Marshal(emrExpected)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentity.On("GetID").Return("doctor1", nil)
-	mockStub.On("GetState", "emr1").Return(emrBaseJSON, nil)
-	mockStub.On("PutState", "emr1", emrExpectedJSON).Return(nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("hospital2", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "doctor1", GranteeID: "hospital2", GranteeRole: "hospital"})).Return(nil)
 
 	// Mock GetUser for hospital2
 	hospital2 := User{
@@ -635,14 +1009,14 @@ func TestShareRecordDoctorOwnerToHospital(t *testing.T) {
 		CommonName: "hospital2@orgName.example.com",
 	}
 	hospital2JSON, _ := json.Marshal(hospital2)
-	mockStub.On("GetState", "hospital2@orgName.example.com").Return(hospital2JSON, nil)
+	mockStub.On("GetState", userStateKey("hospital2@orgName.example.com")).Return(hospital2JSON, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.ShareRecord(ctx, "emr1", "hospital2@orgName.example.com", "hospital")
+	err := chaincode.ShareRecord(ctx, "emr1", "hospital2@orgName.example.com", "hospital", 0, "")
 	assert.NoError(t, err)
 
 	// Verify hospital2 can access the record
@@ -650,7 +1024,11 @@ func TestShareRecordDoctorOwnerToHospital(t *testing.T) {
 	mockClientIdentityHospital.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentityHospital.On("GetID").Return("hospital2", nil)
 	mockStubHospital := new(MockStub)
-	mockStubHospital.On("GetState", "emr1").Return(emrExpectedJSON, nil)
+	mockStubHospital.On("GetState", denyStateKey("patient1", "hospital2")).Return(nil, nil)
+	mockStubHospital.On("GetState", userIDStateKey("hospital2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStubHospital, "patient1", "hospital2")
+	mockStubHospital.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil)
+	mockStubHospital.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	ctx.clientIdentity = mockClientIdentityHospital
 	ctx.stub = mockStubHospital
 	// Attempt to read the record
@@ -667,6 +1045,8 @@ func TestShareRecordDoctorOwnerToHospital(t *testing.T) {
 func TestShareRecordHospitalOwnerToDoctor(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "hospital1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("hospital1")).Return(nil, nil)
 	mockClientIdentity := new(MockClientIdentity)
 
 	emrBase := EMR{
@@ -677,19 +1057,22 @@ func TestShareRecordHospitalOwnerToDoctor(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrBaseJSON, _ := json.Marshal(emrBase)
 
 	emrExpected := emrBase
-	emrExpected.SharedWithDoctors = []string{"doctor2"}
+	emrExpected.SharedWithDoctors = []Grant{{GrantorID: "hospital1", GranteeID: "doctor2", GrantedAt: txTimestamp.Format(time.RFC3339), Permissions: []string{"read"}}}
 	emrExpectedJSON, _ := json.Marshal(emrExpected)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentity.On("GetID").Return("hospital1", nil)
-	mockStub.On("GetState", "emr1").Return(emrBaseJSON, nil)
-	mockStub.On("PutState", "emr1", emrExpectedJSON).Return(nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "hospital1", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
 
 	// Mock GetUser for doctor2
 	doctor2 := User{
@@ -698,14 +1081,14 @@ func TestShareRecordHospitalOwnerToDoctor(t *testing.T) {
 		CommonName: "doctor2@orgName.example.com",
 	}
 	doctor2JSON, _ := json.Marshal(doctor2)
-	mockStub.On("GetState", "doctor2@orgName.example.com").Return(doctor2JSON, nil)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor")
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", 0, "")
 	assert.NoError(t, err)
 
 	// Verify doctor2 can access the record
@@ -713,7 +1096,11 @@ func TestShareRecordHospitalOwnerToDoctor(t *testing.T) {
 	mockClientIdentityDoctor.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentityDoctor.On("GetID").Return("doctor2", nil)
 	mockStubDoctor := new(MockStub)
-	mockStubDoctor.On("GetState", "emr1").Return(emrExpectedJSON, nil)
+	mockStubDoctor.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStubDoctor.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStubDoctor, "patient1", "doctor2")
+	mockStubDoctor.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil)
+	mockStubDoctor.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	ctx.clientIdentity = mockClientIdentityDoctor
 	ctx.stub = mockStubDoctor
 	// Attempt to read the record
@@ -730,6 +1117,9 @@ func TestShareRecordHospitalOwnerToDoctor(t *testing.T) {
 func TestShareRecordHospitalShareListToHospital(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "hospital2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("hospital2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "hospital2")
 	mockClientIdentity := new(MockClientIdentity)
 
 	emrBase := EMR{
@@ -740,19 +1130,22 @@ func TestShareRecordHospitalShareListToHospital(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{"hospital2"},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
 	}
 	emrBaseJSON, _ := json.Marshal(emrBase)
 
 	emrExpected := emrBase
-	emrExpected.SharedWithHospitals = []string{"hospital2", "hospital3"}
+	emrExpected.SharedWithHospitals = append(emrBase.SharedWithHospitals, Grant{GrantorID: "hospital2", GranteeID: "hospital3", GrantedAt: txTimestamp.Format(time.RFC3339), Permissions: []string{"read"}})
 	emrExpectedJSON, _ := json.Marshal(emrExpected)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentity.On("GetID").Return("hospital2", nil)
-	mockStub.On("GetState", "emr1").Return(emrBaseJSON, nil)
-	mockStub.On("PutState", "emr1", emrExpectedJSON).Return(nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("hospital3", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "hospital2", GranteeID: "hospital3", GranteeRole: "hospital"})).Return(nil)
 
 	// Mock GetUser for hospital3
 	hospital3 := User{
@@ -761,14 +1154,14 @@ func TestShareRecordHospitalShareListToHospital(t *testing.T) {
 		CommonName: "hospital3@orgName.example.com",
 	}
 	hospital3JSON, _ := json.Marshal(hospital3)
-	mockStub.On("GetState", "hospital3@orgName.example.com").Return(hospital3JSON, nil)
+	mockStub.On("GetState", userStateKey("hospital3@orgName.example.com")).Return(hospital3JSON, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.ShareRecord(ctx, "emr1", "hospital3@orgName.example.com", "hospital")
+	err := chaincode.ShareRecord(ctx, "emr1", "hospital3@orgName.example.com", "hospital", 0, "")
 	assert.NoError(t, err)
 
 	// Verify hospital3 can access the record
@@ -776,7 +1169,11 @@ func TestShareRecordHospitalShareListToHospital(t *testing.T) {
 	mockClientIdentityHospital.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentityHospital.On("GetID").Return("hospital3", nil)
 	mockStubHospital := new(MockStub)
-	mockStubHospital.On("GetState", "emr1").Return(emrExpectedJSON, nil)
+	mockStubHospital.On("GetState", denyStateKey("patient1", "hospital3")).Return(nil, nil)
+	mockStubHospital.On("GetState", userIDStateKey("hospital3")).Return(nil, nil)
+	mockNoConsentDirectives(mockStubHospital, "patient1", "hospital3")
+	mockStubHospital.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil)
+	mockStubHospital.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	ctx.clientIdentity = mockClientIdentityHospital
 	ctx.stub = mockStubHospital
 	// Attempt to read the record
@@ -803,19 +1200,22 @@ func TestShareRecordPatientOwnerToDoctor(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrBaseJSON, _ := json.Marshal(emrBase)
 
 	emrExpected := emrBase
-	emrExpected.SharedWithDoctors = []string{"doctor2"}
+	emrExpected.SharedWithDoctors = []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: txTimestamp.Format(time.RFC3339), Permissions: []string{"read"}}}
 	emrExpectedJSON, _ := json.Marshal(emrExpected)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
 	mockClientIdentity.On("GetID").Return("patient1", nil)
-	mockStub.On("GetState", "emr1").Return(emrBaseJSON, nil)
-	mockStub.On("PutState", "emr1", emrExpectedJSON).Return(nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
 
 	// Mock GetUser for doctor2
 	doctor2 := User{
@@ -824,14 +1224,14 @@ func TestShareRecordPatientOwnerToDoctor(t *testing.T) {
 		CommonName: "doctor2@orgName.example.com",
 	}
 	doctor2JSON, _ := json.Marshal(doctor2)
-	mockStub.On("GetState", "doctor2@orgName.example.com").Return(doctor2JSON, nil)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor")
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", 0, "")
 	assert.NoError(t, err)
 
 	// Verify doctor2 can access the record
@@ -839,7 +1239,11 @@ func TestShareRecordPatientOwnerToDoctor(t *testing.T) {
 	mockClientIdentityDoctor.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentityDoctor.On("GetID").Return("doctor2", nil)
 	mockStubDoctor := new(MockStub)
-	mockStubDoctor.On("GetState", "emr1").Return(emrExpectedJSON, nil)
+	mockStubDoctor.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStubDoctor.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStubDoctor, "patient1", "doctor2")
+	mockStubDoctor.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil)
+	mockStubDoctor.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	ctx.clientIdentity = mockClientIdentityDoctor
 	ctx.stub = mockStubDoctor
 	result, err := chaincode.ReadRecord(ctx, "emr1")
@@ -865,19 +1269,22 @@ func TestShareRecordPatientOwnerToHospital(t *testing.T) {
 		HospitalID:          "hospital1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrBaseJSON, _ := json.Marshal(emrBase)
 
 	emrExpected := emrBase
-	emrExpected.SharedWithHospitals = []string{"hospital2"}
+	emrExpected.SharedWithHospitals = []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: txTimestamp.Format(time.RFC3339), Permissions: []string{"read"}}}
 	emrExpectedJSON, _ := json.Marshal(emrExpected)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
 	mockClientIdentity.On("GetID").Return("patient1", nil)
-	mockStub.On("GetState", "emr1").Return(emrBaseJSON, nil)
-	mockStub.On("PutState", "emr1", emrExpectedJSON).Return(nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("hospital2", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "patient1", GranteeID: "hospital2", GranteeRole: "hospital"})).Return(nil)
 
 	// Mock GetUser for hospital2
 	hospital2 := User{
@@ -886,14 +1293,14 @@ func TestShareRecordPatientOwnerToHospital(t *testing.T) {
 		CommonName: "hospital2@orgName.example.com",
 	}
 	hospital2JSON, _ := json.Marshal(hospital2)
-	mockStub.On("GetState", "hospital2@orgName.example.com").Return(hospital2JSON, nil)
+	mockStub.On("GetState", userStateKey("hospital2@orgName.example.com")).Return(hospital2JSON, nil)
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
 		clientIdentity: mockClientIdentity,
 	}
 
-	err := chaincode.ShareRecord(ctx, "emr1", "hospital2@orgName.example.com", "hospital")
+	err := chaincode.ShareRecord(ctx, "emr1", "hospital2@orgName.example.com", "hospital", 0, "")
 	assert.NoError(t, err)
 
 	// Verify hospital2 can access the record
@@ -901,7 +1308,11 @@ func TestShareRecordPatientOwnerToHospital(t *testing.T) {
 	mockClientIdentityHospital.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentityHospital.On("GetID").Return("hospital2", nil)
 	mockStubHospital := new(MockStub)
-	mockStubHospital.On("GetState", "emr1").Return(emrExpectedJSON, nil)
+	mockStubHospital.On("GetState", denyStateKey("patient1", "hospital2")).Return(nil, nil)
+	mockStubHospital.On("GetState", userIDStateKey("hospital2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStubHospital, "patient1", "hospital2")
+	mockStubHospital.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil)
+	mockStubHospital.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	ctx.clientIdentity = mockClientIdentityHospital
 	ctx.stub = mockStubHospital
 	// Attempt to read the record
@@ -918,6 +1329,7 @@ func TestShareRecordPatientOwnerToHospital(t *testing.T) {
 func TestShareRecordDoctorNotAuthorizedToDoctorAndHospital(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor3")
 	mockClientIdentity := new(MockClientIdentity)
 	emr := EMR{
 		EMRID:               "emr1",
@@ -927,14 +1339,15 @@ func TestShareRecordDoctorNotAuthorizedToDoctorAndHospital(t *testing.T) {
 		Diagnosis:           "diagnosis1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{"doctor2"},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentity.On("GetID").Return("doctor3", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil).Times(2) // Once for doctor, once for hospital
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil).Times(2) // Once for doctor, once for hospital
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	// Do not set PutState expectation here since sharing should fail
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -942,12 +1355,12 @@ func TestShareRecordDoctorNotAuthorizedToDoctorAndHospital(t *testing.T) {
 	}
 
 	// Attempt to share with a doctor
-	err := chaincode.ShareRecord(ctx, "emr1", "doctor4", "doctor")
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor4", "doctor", 0, "")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "doctor is not authorized to share")
 
 	// Attempt to share with a hospital
-	err = chaincode.ShareRecord(ctx, "emr1", "hospital2", "hospital")
+	err = chaincode.ShareRecord(ctx, "emr1", "hospital2", "hospital", 0, "")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "doctor is not authorized to share")
 
@@ -958,6 +1371,7 @@ func TestShareRecordDoctorNotAuthorizedToDoctorAndHospital(t *testing.T) {
 func TestShareRecordHospitalNotAuthorizedToDoctorAndHospital(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockNoConsentDirectives(mockStub, "patient1", "hospital3")
 	mockClientIdentity := new(MockClientIdentity)
 	emr := EMR{
 		EMRID:               "emr1",
@@ -967,14 +1381,15 @@ func TestShareRecordHospitalNotAuthorizedToDoctorAndHospital(t *testing.T) {
 		Diagnosis:           "diagnosis1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{"doctor2"},
-		SharedWithHospitals: []string{"hospital2"},
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentity.On("GetID").Return("hospital3", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil).Times(2) // Once for doctor, once for hospital
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil).Times(2) // Once for doctor, once for hospital
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	// Do not set PutState expectation here since sharing should fail
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -982,12 +1397,12 @@ func TestShareRecordHospitalNotAuthorizedToDoctorAndHospital(t *testing.T) {
 	}
 
 	// Attempt to share with a doctor
-	err := chaincode.ShareRecord(ctx, "emr1", "doctor3", "doctor")
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor3", "doctor", 0, "")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "hospital is not authorized to share")
 
 	// Attempt to share with a hospital
-	err = chaincode.ShareRecord(ctx, "emr1", "hospital4", "hospital")
+	err = chaincode.ShareRecord(ctx, "emr1", "hospital4", "hospital", 0, "")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "hospital is not authorized to share")
 
@@ -1007,14 +1422,16 @@ func TestShareRecordPatientNotAuthorizedToDoctorAndHospital(t *testing.T) {
 		Diagnosis:           "diagnosis1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{"doctor2"},
-		SharedWithHospitals: []string{"hospital2"},
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
 	mockClientIdentity.On("GetID").Return("patient2", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil).Times(2) // Once for doctor, once for hospital
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil).Times(2) // Once for doctor, once for hospital
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetState", proxyStateKey("patient1", "patient2")).Return(nil, nil).Times(2)
 	// Do not set PutState expectation here since sharing should fail
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -1022,12 +1439,12 @@ func TestShareRecordPatientNotAuthorizedToDoctorAndHospital(t *testing.T) {
 	}
 
 	// Attempt to share with a doctor
-	err := chaincode.ShareRecord(ctx, "emr1", "doctor3", "doctor")
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor3", "doctor", 0, "")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "patient is not authorized to share")
 
 	// Attempt to share with a hospital
-	err = chaincode.ShareRecord(ctx, "emr1", "hospital3", "hospital")
+	err = chaincode.ShareRecord(ctx, "emr1", "hospital3", "hospital", 0, "")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "patient is not authorized to share")
 
@@ -1048,15 +1465,16 @@ func TestShareRecordUnauthorizedRole(t *testing.T) {
 		Diagnosis:           "diagnosis1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{},
-		SharedWithHospitals: []string{},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
 	}
 	emrJSON, _ := json.Marshal(emr)
 
 	// Nurse tries to share the record
 	mockClientIdentity.On("GetAttributeValue", "role").Return("nurse", true, nil)
 	mockClientIdentity.On("GetID").Return("nurse1", nil)
-	mockStub.On("GetState", "emr1").Return(emrJSON, nil).Times(2) // Once for doctor, once for hospital
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil).Times(2) // Once for doctor, once for hospital
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	// Do not set PutState expectation here since sharing should fail
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -1064,12 +1482,12 @@ func TestShareRecordUnauthorizedRole(t *testing.T) {
 	}
 
 	// Attempt to share with a doctor
-	err := chaincode.ShareRecord(ctx, "emr1", "doctor2", "doctor")
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2", "doctor", 0, "")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "nurse is not authorized to share")
 
 	// Attempt to share with a hospital
-	err = chaincode.ShareRecord(ctx, "emr1", "hospital2", "hospital")
+	err = chaincode.ShareRecord(ctx, "emr1", "hospital2", "hospital", 0, "")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "nurse is not authorized to share")
 
@@ -1081,6 +1499,8 @@ func TestShareRecordUnauthorizedRole(t *testing.T) {
 func TestShareRecordRightIDWrongRole(t *testing.T) {
 	chaincode := new(EMRChaincode)
 	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
 	mockClientIdentity := new(MockClientIdentity)
 	emrBase := EMR{
 		EMRID:               "emr1",
@@ -1090,20 +1510,23 @@ func TestShareRecordRightIDWrongRole(t *testing.T) {
 		Diagnosis:           "diagnosis1",
 		CreatedOn:           "2025-03-27T12:00:00Z",
 		LastModified:        "2025-03-27T12:00:00Z",
-		SharedWithDoctors:   []string{"doctor2"},
-		SharedWithHospitals: []string{"hospital2"},
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
 	}
 	emrBaseJSON, _ := json.Marshal(emrBase)
 
 	emrExpected := emrBase
-	emrExpected.SharedWithHospitals = []string{"hospital2", "doctor3"}
+	emrExpected.SharedWithHospitals = append(emrBase.SharedWithHospitals, Grant{GrantorID: "doctor1", GranteeID: "doctor3", GrantedAt: txTimestamp.Format(time.RFC3339), Permissions: []string{"read"}})
 	emrExpectedJSON, _ := json.Marshal(emrExpected)
 
 	// Share from doctor with access
 	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentity.On("GetID").Return("doctor1", nil)
-	mockStub.On("GetState", "emr1").Return(emrBaseJSON, nil).Once()
-	mockStub.On("PutState", "emr1", emrExpectedJSON).Return(nil).Once()
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil).Once()
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil).Once()
+	mockStub.On("PutState", granteeIndexStateKey("doctor3", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "doctor1", GranteeID: "doctor3", GranteeRole: "hospital"})).Return(nil)
 
 	// Mock GetUser for doctor3
 	doctor3 := User{
@@ -1112,7 +1535,7 @@ func TestShareRecordRightIDWrongRole(t *testing.T) {
 		CommonName: "doctor3@orgName.example.com",
 	}
 	doctor3JSON, _ := json.Marshal(doctor3)
-	mockStub.On("GetState", "doctor3@orgName.example.com").Return(doctor3JSON, nil).Once()
+	mockStub.On("GetState", userStateKey("doctor3@orgName.example.com")).Return(doctor3JSON, nil).Once()
 
 	ctx := &mockTransactionContext{
 		stub:           mockStub,
@@ -1120,7 +1543,7 @@ func TestShareRecordRightIDWrongRole(t *testing.T) {
 	}
 
 	// Share with a doctor using right ID but wrong role
-	err := chaincode.ShareRecord(ctx, "emr1", "doctor3@orgName.example.com", "hospital")
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor3@orgName.example.com", "hospital", 0, "")
 	assert.NoError(t, err)
 
 	// Verify doctor3 cannot access the record as doctor
@@ -1128,7 +1551,9 @@ func TestShareRecordRightIDWrongRole(t *testing.T) {
 	mockClientIdentityDoctor.On("GetAttributeValue", "role").Return("doctor", true, nil)
 	mockClientIdentityDoctor.On("GetID").Return("doctor3", nil)
 	mockStubDoctor := new(MockStub)
-	mockStubDoctor.On("GetState", "emr1").Return(emrExpectedJSON, nil).Once()
+	mockNoConsentDirectives(mockStubDoctor, "patient1", "doctor3")
+	mockStubDoctor.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil).Once()
+	mockStubDoctor.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	ctx.clientIdentity = mockClientIdentityDoctor
 	ctx.stub = mockStubDoctor
 	// Attempt to read the record
@@ -1142,7 +1567,11 @@ func TestShareRecordRightIDWrongRole(t *testing.T) {
 	mockClientIdentityHospital.On("GetAttributeValue", "role").Return("hospital", true, nil)
 	mockClientIdentityHospital.On("GetID").Return("doctor3", nil)
 	mockStubHospital := new(MockStub)
-	mockStubHospital.On("GetState", "emr1").Return(emrExpectedJSON, nil).Once()
+	mockStubHospital.On("GetState", denyStateKey("patient1", "doctor3")).Return(nil, nil)
+	mockStubHospital.On("GetState", userIDStateKey("doctor3")).Return(nil, nil)
+	mockNoConsentDirectives(mockStubHospital, "patient1", "doctor3")
+	mockStubHospital.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil).Once()
+	mockStubHospital.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
 	ctx.clientIdentity = mockClientIdentityHospital
 	ctx.stub = mockStubHospital
 	// Attempt to read the record
@@ -1171,7 +1600,7 @@ func TestGetAllRecordsForPatient(t *testing.T) {
 		CommonName: "patient2@orgName.example.com",
 	}
 	patientJSON, _ := json.Marshal(patient)
-	mockStub.On("GetState", "patient2@orgName.example.com").Return(patientJSON, nil)
+	mockStub.On("GetState", userStateKey("patient2@orgName.example.com")).Return(patientJSON, nil)
 
 	// Create total of 10 EMRs
 	var emrs []EMR
@@ -1193,8 +1622,8 @@ func TestGetAllRecordsForPatient(t *testing.T) {
 			Diagnosis:           fmt.Sprintf("diagnosis%d", i),
 			CreatedOn:           "2025-03-27T12:00:00Z",
 			LastModified:        "2025-03-27T12:00:00Z",
-			SharedWithDoctors:   []string{},
-			SharedWithHospitals: []string{},
+			SharedWithDoctors:   []Grant{},
+			SharedWithHospitals: []Grant{},
 		}
 		emrs = append(emrs, emr)
 		emrJSON, _ := json.Marshal(emr)
@@ -1213,6 +1642,10 @@ func TestGetAllRecordsForPatient(t *testing.T) {
 	mockResultsIterator.On("Close").Return(nil)
 
 	mockStub.On("GetQueryResult", mock.Anything).Return(mockResultsIterator, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	// patient2 is not a proxy for the other patients whose records the query returns
+	mockStub.On("GetState", proxyStateKey("patient7", "patient2")).Return(nil, nil)
+	mockStub.On("GetState", proxyStateKey("patient19", "patient2")).Return(nil, nil)
 	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
 	mockClientIdentity.On("GetID").Return("patient2", nil)
 
@@ -1235,3 +1668,5023 @@ func TestGetAllRecordsForPatient(t *testing.T) {
 	mockStub.AssertExpectations(t)
 	mockClientIdentity.AssertExpectations(t)
 }
+
+// Other documents of the patient returned by the rich query should not be mistaken for records
+func TestGetAllRecordsForPatientSkipsOtherDocuments(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+
+	patientJSON, _ := json.Marshal(User{UserID: "patient1", Role: "patient", CommonName: "patient1@org2.example.com"})
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+
+	documents := []any{
+		PatientSettings{PatientID: "patient1", EmergencyAccessDisabled: true},
+		Proxy{PatientID: "patient1", ProxyID: "proxy1", Scope: []string{"read"}, GrantedBy: "patient1", GrantedAt: "2025-03-27T12:00:00Z"},
+		ConsentDirective{DirectiveID: "tx1", PatientID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor", Scope: consentScopeAll, Permissions: []string{"read"}, GrantedAt: "2025-03-27T12:00:00Z"},
+		DenyRule{PatientID: "patient1", DeniedID: "doctor3", CreatedAt: "2025-03-27T12:00:00Z"},
+		emr,
+	}
+	for i, document := range documents {
+		documentJSON, _ := json.Marshal(document)
+		mockResultsIterator.On("Next").Return(&queryresult.KV{Key: fmt.Sprintf("document%d", i), Value: documentJSON}, nil).Once()
+	}
+	mockResultsIterator.On("HasNext").Return(true).Times(len(documents))
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	mockStub.On("GetState", userStateKey("patient1@org2.example.com")).Return(patientJSON, nil)
+	mockStub.On("GetQueryResult", mock.Anything).Return(mockResultsIterator, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	results, err := chaincode.GetAllRecordsForPatient(ctx, "patient1@org2.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []EMR{emr}, results)
+
+	mockResultsIterator.AssertExpectations(t)
+}
+
+func TestShareRecordDuplicateGrant(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+
+	doctor2 := User{
+		UserID:     "doctor2",
+		Role:       "doctor",
+		CommonName: "doctor2@orgName.example.com",
+	}
+	doctor2JSON, _ := json.Marshal(doctor2)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
+	// Do not set PutState expectation here since sharing should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", 0, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already shared with doctor doctor2@orgName.example.com")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestUnshareRecordPatientOwnerFromDoctor(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:        "emr1",
+		PatientID:    "patient1",
+		DoctorID:     "doctor1",
+		HospitalID:   "hospital1",
+		Diagnosis:    "diagnosis1",
+		CreatedOn:    "2025-03-27T12:00:00Z",
+		LastModified: "2025-03-27T12:00:00Z",
+		SharedWithDoctors: []Grant{
+			{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}},
+			{GrantorID: "patient1", GranteeID: "doctor3", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}},
+		},
+		SharedWithHospitals: []Grant{},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.SharedWithDoctors = []Grant{emrBase.SharedWithDoctors[1]}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("DelState", granteeIndexStateKey("doctor2", "emr1")).Return(nil)
+	mockStub.On("SetEvent", "RecordUnshared", eventPayload(RecordUnsharedEvent{EMRID: "emr1", PatientID: "patient1", RevokerID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
+
+	doctor2 := User{
+		UserID:     "doctor2",
+		Role:       "doctor",
+		CommonName: "doctor2@orgName.example.com",
+	}
+	doctor2JSON, _ := json.Marshal(doctor2)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UnshareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor")
+	assert.NoError(t, err)
+
+	// Verify doctor2 can no longer access the record
+	mockClientIdentityDoctor := new(MockClientIdentity)
+	mockClientIdentityDoctor.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentityDoctor.On("GetID").Return("doctor2", nil)
+	mockStubDoctor := new(MockStub)
+	mockNoConsentDirectives(mockStubDoctor, "patient1", "doctor2")
+	mockStubDoctor.On("GetState", emrStateKey("emr1")).Return(emrExpectedJSON, nil)
+	mockStubDoctor.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	ctx.clientIdentity = mockClientIdentityDoctor
+	ctx.stub = mockStubDoctor
+	result, err := chaincode.ReadRecord(ctx, "emr1")
+	assert.Error(t, err)
+	assert.Nil(t, result)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockClientIdentityDoctor.AssertExpectations(t)
+	mockStubDoctor.AssertExpectations(t)
+}
+
+func TestUnshareRecordDoctorOwnerFromHospital(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.SharedWithHospitals = []Grant{}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("DelState", granteeIndexStateKey("hospital2", "emr1")).Return(nil)
+	mockStub.On("SetEvent", "RecordUnshared", eventPayload(RecordUnsharedEvent{EMRID: "emr1", PatientID: "patient1", RevokerID: "doctor1", GranteeID: "hospital2", GranteeRole: "hospital"})).Return(nil)
+
+	hospital2 := User{
+		UserID:     "hospital2",
+		Role:       "hospital",
+		CommonName: "hospital2@orgName.example.com",
+	}
+	hospital2JSON, _ := json.Marshal(hospital2)
+	mockStub.On("GetState", userStateKey("hospital2@orgName.example.com")).Return(hospital2JSON, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UnshareRecord(ctx, "emr1", "hospital2@orgName.example.com", "hospital")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestUnshareRecordShareeRevokesOwnAccess(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.SharedWithDoctors = []Grant{}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("DelState", granteeIndexStateKey("doctor2", "emr1")).Return(nil)
+	mockStub.On("SetEvent", "RecordUnshared", eventPayload(RecordUnsharedEvent{EMRID: "emr1", PatientID: "patient1", RevokerID: "doctor2", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
+
+	doctor2 := User{
+		UserID:     "doctor2",
+		Role:       "doctor",
+		CommonName: "doctor2@orgName.example.com",
+	}
+	doctor2JSON, _ := json.Marshal(doctor2)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UnshareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestUnshareRecordShareeCannotRevokeOtherSharee(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:        "emr1",
+		PatientID:    "patient1",
+		DoctorID:     "doctor1",
+		HospitalID:   "hospital1",
+		Diagnosis:    "diagnosis1",
+		CreatedOn:    "2025-03-27T12:00:00Z",
+		LastModified: "2025-03-27T12:00:00Z",
+		SharedWithDoctors: []Grant{
+			{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}},
+			{GrantorID: "patient1", GranteeID: "doctor3", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}},
+		},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+
+	doctor3 := User{
+		UserID:     "doctor3",
+		Role:       "doctor",
+		CommonName: "doctor3@orgName.example.com",
+	}
+	doctor3JSON, _ := json.Marshal(doctor3)
+	mockStub.On("GetState", userStateKey("doctor3@orgName.example.com")).Return(doctor3JSON, nil)
+	// Do not set PutState expectation here since unsharing should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UnshareRecord(ctx, "emr1", "doctor3@orgName.example.com", "doctor")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "doctor is not authorized to revoke access")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestUnshareRecordGranteeNotShared(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+
+	// doctor2 holds a doctor grant, not a hospital grant
+	doctor2 := User{
+		UserID:     "doctor2",
+		Role:       "doctor",
+		CommonName: "doctor2@orgName.example.com",
+	}
+	doctor2JSON, _ := json.Marshal(doctor2)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
+	// Do not set PutState expectation here since unsharing should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UnshareRecord(ctx, "emr1", "doctor2@orgName.example.com", "hospital")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "record with ID emr1 is not shared with hospital doctor2@orgName.example.com")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestShareRecordWithExpiry(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.SharedWithDoctors = []Grant{{
+		GrantorID:   "patient1",
+		GranteeID:   "doctor2",
+		GrantedAt:   "2025-04-01T12:00:00Z",
+		ExpiresAt:   "2025-04-08T12:00:00Z",
+		Permissions: []string{"read"},
+	}}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
+
+	doctor2 := User{
+		UserID:     "doctor2",
+		Role:       "doctor",
+		CommonName: "doctor2@orgName.example.com",
+	}
+	doctor2JSON, _ := json.Marshal(doctor2)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", 7, "")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestShareRecordNegativeDuration(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	// Do not set PutState expectation here since sharing should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", -1, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid share duration")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// An expired grant should be replaced instead of being reported as a duplicate
+func TestShareRecordRenewsExpiredGrant(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:      "emr1",
+		PatientID:  "patient1",
+		DoctorID:   "doctor1",
+		HospitalID: "hospital1",
+		Diagnosis:  "diagnosis1",
+		CreatedOn:  "2025-03-27T12:00:00Z",
+		SharedWithDoctors: []Grant{{
+			GrantorID: "patient1",
+			GranteeID: "doctor2",
+			GrantedAt: "2025-03-27T12:00:00Z",
+			ExpiresAt: "2025-03-28T12:00:00Z",
+		}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.SharedWithDoctors = []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-04-01T12:00:00Z", Permissions: []string{"read"}}}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
+
+	doctor2 := User{
+		UserID:     "doctor2",
+		Role:       "doctor",
+		CommonName: "doctor2@orgName.example.com",
+	}
+	doctor2JSON, _ := json.Marshal(doctor2)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", 0, "")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Doctors and hospitals should lose read and share access once their grant has expired
+func TestExpiredGrantDenied(t *testing.T) {
+	chaincode := new(EMRChaincode)
+
+	emr := EMR{
+		EMRID:      "emr1",
+		PatientID:  "patient1",
+		DoctorID:   "doctor1",
+		HospitalID: "hospital1",
+		Diagnosis:  "diagnosis1",
+		CreatedOn:  "2025-03-27T12:00:00Z",
+		SharedWithDoctors: []Grant{{
+			GrantorID: "patient1",
+			GranteeID: "doctor2",
+			GrantedAt: "2025-03-27T12:00:00Z",
+			ExpiresAt: "2025-04-01T12:00:00Z", // Expires exactly at txTimestamp
+		}},
+		SharedWithHospitals: []Grant{{
+			GrantorID: "patient1",
+			GranteeID: "hospital2",
+			GrantedAt: "2025-03-27T12:00:00Z",
+			ExpiresAt: "2025-03-30T12:00:00Z",
+		}},
+	}
+
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockNoConsentDirectives(mockStub, "patient1", "hospital2")
+	ctx := &mockTransactionContext{stub: mockStub}
+
+	assert.False(t, authorized(chaincode.isAuthorizedToRead(ctx, "doctor", "doctor2", &emr, txTimestamp)))
+	assert.False(t, authorized(chaincode.hasPermission(ctx, "doctor", "doctor2", &emr, txTimestamp, permissionShare)))
+	assert.False(t, authorized(chaincode.isAuthorizedToRead(ctx, "hospital", "hospital2", &emr, txTimestamp)))
+	assert.False(t, authorized(chaincode.hasPermission(ctx, "hospital", "hospital2", &emr, txTimestamp, permissionShare)))
+
+	// Access is still granted before the expiry date
+	before := txTimestamp.Add(-time.Hour)
+	assert.True(t, authorized(chaincode.isAuthorizedToRead(ctx, "doctor", "doctor2", &emr, before)))
+	assert.True(t, authorized(chaincode.hasPermission(ctx, "doctor", "doctor2", &emr, before, permissionShare)))
+}
+
+// Records written by earlier versions of the chaincode hold bare IDs in their share lists
+func TestReadRecordLegacyShareList(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	legacyJSON := []byte(`{"emrId":"emr1","patientId":"patient1","doctorId":"doctor1","hospitalId":"hospital1",` +
+		`"diagnosis":"diagnosis1","createdOn":"2025-03-27T12:00:00Z","lastModified":"2025-03-27T12:00:00Z",` +
+		`"sharedWithDoctors":["doctor2"],"sharedWithHospitals":["hospital2"]}`)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(legacyJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.ReadRecord(ctx, "emr1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Grant{{GranteeID: "doctor2"}}, result.SharedWithDoctors)
+	assert.Equal(t, []Grant{{GranteeID: "hospital2"}}, result.SharedWithHospitals)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestShareRecordPatientGrantsPermissions(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	// Permissions are stored in canonical order and always include read
+	emrExpected := emrBase
+	emrExpected.SharedWithDoctors = []Grant{{
+		GrantorID:   "patient1",
+		GranteeID:   "doctor2",
+		GrantedAt:   "2025-04-01T12:00:00Z",
+		Permissions: []string{"read", "amend", "revoke"},
+	}}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
+
+	doctor2 := User{
+		UserID:     "doctor2",
+		Role:       "doctor",
+		CommonName: "doctor2@orgName.example.com",
+	}
+	doctor2JSON, _ := json.Marshal(doctor2)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", 0, "revoke, amend,revoke")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestShareRecordInvalidPermission(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	// Do not set PutState expectation here since sharing should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", 0, "read,delete")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid permission: delete")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// A sharee holding read access only should not be able to forward the record
+func TestShareRecordReadOnlyShareeCannotShare(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	// Do not set PutState expectation here since sharing should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor3@orgName.example.com", "doctor", 0, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "doctor is not authorized to share")
+
+	// The sharee can still read the record
+	assert.True(t, authorized(chaincode.isAuthorizedToRead(ctx, "doctor", "doctor2", &emr, txTimestamp)))
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// A sharee cannot grant more than the permissions it holds itself
+func TestShareRecordPermissionsCappedAtSharer(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	// Do not set PutState expectation here since sharing should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor3@orgName.example.com", "doctor", 0, "share,amend")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot grant the amend permission")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// A sharee cannot give access that outlives its own grant
+func TestShareRecordExpiryCappedAtSharer(t *testing.T) {
+	tests := []struct {
+		name         string
+		durationDays int
+		expected     string
+	}{
+		{"no expiry", 0, "2025-04-08T12:00:00Z"},
+		{"longer duration", 30, "2025-04-08T12:00:00Z"},
+		{"shorter duration", 1, "2025-04-02T12:00:00Z"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+			mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+			mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+			mockClientIdentity := new(MockClientIdentity)
+
+			// doctor2 was given 7 days of access when the transaction runs
+			emr := EMR{
+				EMRID:               "emr1",
+				PatientID:           "patient1",
+				DoctorID:            "doctor1",
+				CreatedOn:           "2025-03-27T12:00:00Z",
+				LastModified:        "2025-03-27T12:00:00Z",
+				SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-04-01T12:00:00Z", ExpiresAt: "2025-04-08T12:00:00Z", Permissions: []string{"read", "share"}}},
+				SharedWithHospitals: []Grant{},
+			}
+			emrJSON, _ := json.Marshal(emr)
+
+			emrExpected := emr
+			emrExpected.SharedWithDoctors = append(emr.SharedWithDoctors, Grant{GrantorID: "doctor2", GranteeID: "doctor3", GrantedAt: "2025-04-01T12:00:00Z", ExpiresAt: test.expected, Permissions: []string{"read"}})
+			emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+			mockClientIdentity.On("GetID").Return("doctor2", nil)
+			mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+			mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+			mockStub.On("GetState", userStateKey("doctor3@org1.example.com")).Return([]byte(`{"userId":"doctor3","role":"doctor","CommonName":"doctor3@org1.example.com"}`), nil)
+			mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+			mockStub.On("PutState", granteeIndexStateKey("doctor3", "emr1"), []byte{0x00}).Return(nil)
+			mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "doctor2", GranteeID: "doctor3", GranteeRole: "doctor"})).Return(nil)
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.ShareRecord(ctx, "emr1", "doctor3@org1.example.com", "doctor", test.durationDays, "")
+			assert.NoError(t, err)
+
+			mockStub.AssertExpectations(t)
+		})
+	}
+}
+
+// A sharee holding the revoke permission can revoke other sharees
+func TestUnshareRecordShareeWithRevokePermission(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:      "emr1",
+		PatientID:  "patient1",
+		DoctorID:   "doctor1",
+		HospitalID: "hospital1",
+		Diagnosis:  "diagnosis1",
+		CreatedOn:  "2025-03-27T12:00:00Z",
+		SharedWithDoctors: []Grant{
+			{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "revoke"}},
+			{GrantorID: "patient1", GranteeID: "doctor3", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}},
+		},
+		SharedWithHospitals: []Grant{},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.SharedWithDoctors = []Grant{emrBase.SharedWithDoctors[0]}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("DelState", granteeIndexStateKey("doctor3", "emr1")).Return(nil)
+	mockStub.On("SetEvent", "RecordUnshared", eventPayload(RecordUnsharedEvent{EMRID: "emr1", PatientID: "patient1", RevokerID: "doctor2", GranteeID: "doctor3", GranteeRole: "doctor"})).Return(nil)
+
+	doctor3 := User{
+		UserID:     "doctor3",
+		Role:       "doctor",
+		CommonName: "doctor3@orgName.example.com",
+	}
+	doctor3JSON, _ := json.Marshal(doctor3)
+	mockStub.On("GetState", userStateKey("doctor3@orgName.example.com")).Return(doctor3JSON, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UnshareRecord(ctx, "emr1", "doctor3@orgName.example.com", "doctor")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestUpdateRecordDoctorOwner(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		ContentHash:         contentHash("diagnosis1"),
+		Collection:          "Org1MSPPrivateCollection",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+		Versions: []RecordVersion{
+			{Version: 1, Type: "original", ContentHash: contentHash("diagnosis1"), AuthorID: "doctor1", Timestamp: "2025-03-27T12:00:00Z"},
+		},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.ContentHash = contentHash(clinicalData2)
+	emrExpected.LastModified = "2025-04-01T12:00:00Z"
+	emrExpected.Versions = append(emrBase.Versions, RecordVersion{
+		Version:     2,
+		Type:        "amendment",
+		ContentHash: contentHash(clinicalData2),
+		AuthorID:    "doctor1",
+		Timestamp:   "2025-04-01T12:00:00Z",
+		Reason:      "lab results",
+	})
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(clinicalData2)}, nil)
+	mockStub.On("PutPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 2), []byte(clinicalData2)).Return(nil)
+	mockStub.On("SetEvent", "RecordAmended", eventPayload(RecordAmendedEvent{EMRID: "emr1", PatientID: "patient1", AuthorID: "doctor1", Version: 2, Type: "amendment"})).Return(nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UpdateRecord(ctx, "emr1", "lab results")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Records created before versioning existed should get their original diagnosis as first version
+func TestAppendAddendumLegacyRecord(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "amend"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	// The addendum does not change the diagnosis, it is kept in the collection of the amending org
+	emrExpected := emrBase
+	emrExpected.ContentHash = contentHash("follow-up")
+	emrExpected.Collection = "Org1MSPPrivateCollection"
+	emrExpected.LastModified = "2025-04-01T12:00:00Z"
+	emrExpected.Versions = []RecordVersion{
+		{Version: 1, Type: "original", Content: "diagnosis1", AuthorID: "hospital1", Timestamp: "2025-03-27T12:00:00Z"},
+		{Version: 2, Type: "addendum", ContentHash: contentHash("follow-up"), AuthorID: "doctor2", Timestamp: "2025-04-01T12:00:00Z", Reason: "second opinion"},
+	}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte("follow-up")}, nil)
+	mockStub.On("PutPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 2), []byte("follow-up")).Return(nil)
+	mockStub.On("SetEvent", "RecordAmended", eventPayload(RecordAmendedEvent{EMRID: "emr1", PatientID: "patient1", AuthorID: "doctor2", Version: 2, Type: "addendum"})).Return(nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.AppendAddendum(ctx, "emr1", "second opinion")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Blank and oversized addenda should not be written
+func TestAppendAddendumInvalidContent(t *testing.T) {
+	chaincode := new(EMRChaincode)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		HospitalID:          "hospital1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "amend"}}},
+		SharedWithHospitals: []Grant{},
+		Versions:            []RecordVersion{{Version: 1, Type: "original", ContentHash: contentHash("diagnosis1"), AuthorID: "hospital1", Timestamp: "2025-03-27T12:00:00Z"}},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"blank", " \n\t", "the addendum cannot be blank"},
+		{"too large", strings.Repeat("a", maxAddendumSize+1), fmt.Sprintf("the addendum is %d bytes long, the maximum is %d", maxAddendumSize+1, maxAddendumSize)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+			mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+			mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+			mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+			mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+			mockClientIdentity.On("GetID").Return("doctor2", nil)
+			mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+			mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+			mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(test.content)}, nil)
+			// Do not set PutPrivateData and PutState expectations here since the addendum should be refused
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.AppendAddendum(ctx, "emr1", "follow-up")
+			assert.EqualError(t, err, test.expected)
+
+			mockClientIdentity.AssertExpectations(t)
+			mockStub.AssertExpectations(t)
+		})
+	}
+}
+
+// Sharees without the amend permission and patients should not be able to amend records
+func TestUpdateRecordNotAuthorized(t *testing.T) {
+	chaincode := new(EMRChaincode)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	for _, caller := range []struct{ role, clientID string }{{"doctor", "doctor2"}, {"patient", "patient1"}, {"hospital", "hospital2"}} {
+		mockStub := new(MockStub)
+		if caller.role != "patient" {
+			// Patients are refused before their consent is looked up
+			mockNoConsentDirectives(mockStub, "patient1", caller.clientID)
+		}
+		if caller.clientID == "doctor2" {
+			// Deny rules are only looked up for clients holding permissions
+			mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+			mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+		}
+		mockClientIdentity := new(MockClientIdentity)
+		mockClientIdentity.On("GetAttributeValue", "role").Return(caller.role, true, nil)
+		mockClientIdentity.On("GetID").Return(caller.clientID, nil)
+		mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+		mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+		// Do not set PutState expectation here since amending should fail
+
+		ctx := &mockTransactionContext{
+			stub:           mockStub,
+			clientIdentity: mockClientIdentity,
+		}
+
+		err := chaincode.UpdateRecord(ctx, "emr1", "correction")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), caller.role+" is not authorized to amend")
+
+		mockClientIdentity.AssertExpectations(t)
+		mockStub.AssertExpectations(t)
+	}
+}
+
+func TestUpdateRecordMissingReason(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UpdateRecord(ctx, "emr1", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "a reason is required")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// The diagnosis must be passed in the transient map so it never appears in the proposal
+func TestCreateRecordMissingContent(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockStub.On("GetTransient").Return(map[string][]byte{}, nil)
+	// Do not set PutState expectation here since creating should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "transient map")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Clients of an org without a private data collection should get a clear error rather than a failed write
+func TestCreateRecordOrgWithoutCollection(t *testing.T) {
+	chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor3", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org3MSP", nil)
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(clinicalData1)}, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(nil, nil)
+	mockStub.On("GetState", userStateKey("patient1@orgName.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","commonName":"patient1@orgName.example.com"}`), nil)
+	mockStub.On("GetState", userStateKey("hospital1@orgName.example.com")).Return(nil, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com")
+	assert.EqualError(t, err, "no private collection for MSP Org3MSP")
+
+	mockStub.AssertNotCalled(t, "PutPrivateData", mock.Anything, mock.Anything, mock.Anything)
+	mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+}
+
+// The orgs with a private data collection should be the ones declared in collections_config.json
+func TestCollectionMSPIDs(t *testing.T) {
+	configJSON, err := os.ReadFile("collections_config.json")
+	assert.NoError(t, err)
+
+	var collections []struct {
+		Name string `json:"name"`
+	}
+	assert.NoError(t, json.Unmarshal(configJSON, &collections))
+
+	var names []string
+	for _, collection := range collections {
+		names = append(names, collection.Name)
+	}
+	var expected []string
+	for _, mspID := range collectionMSPIDs {
+		expected = append(expected, mspID+"PrivateCollection")
+	}
+	assert.ElementsMatch(t, expected, names)
+}
+
+// ReadRecordContent should return legacy public contents and private contents alike
+func TestReadRecordContent(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		ContentHash:         contentHash("follow-up"),
+		Collection:          "Org1MSPPrivateCollection",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-04-01T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+		Versions: []RecordVersion{
+			{Version: 1, Type: "original", Content: "diagnosis1", AuthorID: "doctor1", Timestamp: "2025-03-27T12:00:00Z"},
+			{Version: 2, Type: "addendum", ContentHash: contentHash("follow-up"), AuthorID: "doctor1", Timestamp: "2025-04-01T12:00:00Z", Reason: "lab results"},
+		},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 2)).Return([]byte("follow-up"), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	contents, err := chaincode.ReadRecordContent(ctx, "emr1")
+	assert.NoError(t, err)
+	assert.Equal(t, []RecordContent{
+		{Version: 1, Type: "original", Content: "diagnosis1"},
+		{Version: 2, Type: "addendum", Content: "follow-up"},
+	}, contents)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestReadRecordContentHashMismatch(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		ContentHash:         contentHash("diagnosis1"),
+		Collection:          "Org1MSPPrivateCollection",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+		Versions: []RecordVersion{
+			{Version: 1, Type: "original", ContentHash: contentHash("diagnosis1"), AuthorID: "doctor1", Timestamp: "2025-03-27T12:00:00Z"},
+		},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 1)).Return([]byte("tampered"), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	contents, err := chaincode.ReadRecordContent(ctx, "emr1")
+	assert.Error(t, err)
+	assert.Nil(t, contents)
+	assert.Contains(t, err.Error(), "does not match its hash")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// VerifyRecordContent should report the latest version matching a content hash
+func TestVerifyRecordContent(t *testing.T) {
+	chaincode := new(EMRChaincode)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		ContentHash:         contentHash("follow-up"),
+		Collection:          "Org1MSPPrivateCollection",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-04-01T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}}},
+		Versions: []RecordVersion{
+			{Version: 1, Type: "original", Content: "diagnosis1", AuthorID: "doctor1", Timestamp: "2025-03-27T12:00:00Z"},
+			{Version: 2, Type: "amendment", ContentHash: contentHash("diagnosis2"), AuthorID: "doctor1", Timestamp: "2025-03-28T12:00:00Z", Reason: "lab results"},
+			{Version: 3, Type: "addendum", ContentHash: contentHash("follow-up"), AuthorID: "doctor1", Timestamp: "2025-04-01T12:00:00Z", Reason: "follow-up"},
+		},
+	}
+	emrJSON, _ := json.Marshal(emr)
+	privateDataHash := func(content string) []byte {
+		hash := sha256.Sum256([]byte(content))
+		return hash[:]
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected ContentVerification
+	}{
+		{"latest private version", "follow-up", ContentVerification{Match: true, Version: 3}},
+		{"earlier private version", "diagnosis2", ContentVerification{Match: true, Version: 2}},
+		{"legacy public version", "diagnosis1", ContentVerification{Match: true, Version: 1}},
+		{"no version", "tampered", ContentVerification{Match: false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockStub := new(MockStub)
+			mockStub.On("GetState", denyStateKey("patient1", "hospital2")).Return(nil, nil)
+			mockStub.On("GetState", userIDStateKey("hospital2")).Return(nil, nil)
+			mockNoConsentDirectives(mockStub, "patient1", "hospital2")
+			mockClientIdentity := new(MockClientIdentity)
+			mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
+			mockClientIdentity.On("GetID").Return("hospital2", nil)
+			mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+			mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+			mockStub.On("GetPrivateDataHash", "Org1MSPPrivateCollection", contentStateKey("emr1", 3)).Return(privateDataHash("follow-up"), nil).Maybe()
+			// The hash of version 2 is no longer committed with the private data, the envelope hash is used
+			mockStub.On("GetPrivateDataHash", "Org1MSPPrivateCollection", contentStateKey("emr1", 2)).Return(nil, nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			result, err := chaincode.VerifyRecordContent(ctx, "emr1", contentHash(test.content))
+			assert.NoError(t, err)
+			assert.Equal(t, &test.expected, result)
+
+			mockClientIdentity.AssertExpectations(t)
+			mockStub.AssertExpectations(t)
+		})
+	}
+}
+
+func TestVerifyRecordContentInvalidHash(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.VerifyRecordContent(ctx, "emr1", "not a sha-256")
+	assert.Error(t, err)
+	assert.Nil(t, result)
+	assert.Contains(t, err.Error(), "invalid content hash")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Registering should emit an event carrying only the user ID and role
+func TestRegisterUserEmitsEvent(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	user := User{
+		UserID:         "doctor1",
+		Role:           "doctor",
+		CommonName:     "doctor1@org1.example.com",
+		Status:         "active",
+		MSPID:          "Org1MSP",
+		CertificateIDs: []string{"doctor1"},
+	}
+	userJSON, _ := json.Marshal(user)
+
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockClientIdentity.On("GetX509Certificate").Return(&x509.Certificate{Subject: pkix.Name{CommonName: "doctor1"}}, nil)
+	mockClientIdentity.On("GetAttributeValue", "hf.Affiliation").Return("org1", true, nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return(nil, nil)
+	mockStub.On("PutState", userStateKey("doctor1@org1.example.com"), userJSON).Return(nil)
+	mockStub.On("PutState", userIDStateKey("doctor1"), []byte("doctor1@org1.example.com")).Return(nil)
+	mockStub.On("SetEvent", "UserRegistered", []byte(`{"userId":"doctor1","role":"doctor"}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.RegisterUser(ctx)
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// A certificate linked to a user should not register a second user
+func TestRegisterUserLinkedCertificate(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetID").Return("doctor1-renewed", nil)
+	mockStub.On("GetState", userIDStateKey("doctor1-renewed")).Return([]byte("doctor1@org1.example.com"), nil)
+	mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return([]byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP","certificateIds":["doctor1","doctor1-renewed"]}`), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.RegisterUser(ctx)
+	assert.EqualError(t, err, "this certificate is already linked to user with CommonName doctor1@org1.example.com")
+
+	mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+}
+
+// Clinical data should be checked against its schema version and report every invalid field
+func TestValidateClinicalData(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []string // Expected messages, none when the content is valid
+	}{
+		{"minimal", `{"schemaVersion":"1","diagnosis":"diagnosis1"}`, nil},
+		{"full", `{"schemaVersion":"1","diagnosis":"diagnosis1","icd10Codes":["J00","S52.521A"],"notes":"notes",` +
+			`"medications":[{"name":"paracetamol","dose":"500 mg","frequency":"every 6 hours"}],` +
+			`"vitals":{"heartRate":72,"systolicBloodPressure":120,"diastolicBloodPressure":80,"respiratoryRate":14,"temperature":36.8,"oxygenSaturation":98}}`, nil},
+		{"not json", `diagnosis1`, []string{"invalid clinical data"}},
+		{"missing version", `{"diagnosis":"diagnosis1"}`, []string{"schemaVersion is required"}},
+		{"unsupported version", `{"schemaVersion":"0","diagnosis":"diagnosis1"}`, []string{"unsupported schemaVersion 0"}},
+		{"invalid fields", `{"schemaVersion":"1","icd10Codes":["flu"],"medications":[{"dose":"500 mg"}],"vitals":{"heartRate":-1},"ssn":"123"}`, []string{
+			"(root): diagnosis is required",
+			"(root): Additional property ssn is not allowed",
+			"icd10Codes.0: Does not match pattern",
+			"medications.0: name is required",
+			"vitals.heartRate: Must be greater than or equal to 0",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateClinicalData([]byte(test.content))
+			if test.expected == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			for _, message := range test.expected {
+				assert.Contains(t, err.Error(), message)
+			}
+		})
+	}
+}
+
+// Invalid clinical data should not be written
+func TestCreateRecordInvalidClinicalData(t *testing.T) {
+	chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockStub.On("GetState", userStateKey("patient1@orgName.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","commonName":"patient1@orgName.example.com"}`), nil)
+	mockStub.On("GetState", userStateKey("hospital1@orgName.example.com")).Return([]byte(`{"userId":"hospital1","role":"hospital","commonName":"hospital1@orgName.example.com"}`), nil)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(nil, nil)
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(`{"schemaVersion":"1","diagnosis":""}`)}, nil)
+	// Do not set PutPrivateData and PutState expectations here since creating should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "diagnosis: String length must be greater than or equal to 1")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// ExportRecordFHIR should build the same bundle on every peer from the current clinical data and later addenda
+func TestExportRecordFHIR(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	clinicalData := `{"schemaVersion":"1","diagnosis":"Common cold","icd10Codes":["J00"],"notes":"Rest",` +
+		`"medications":[{"name":"Paracetamol","dose":"500 mg","frequency":"every 6 hours"},{"name":"Saline spray"}],"vitals":{"heartRate":72,"temperature":37.5}}`
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		ContentHash:         contentHash("follow-up"),
+		Collection:          "Org1MSPPrivateCollection",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-04-01T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+		Versions: []RecordVersion{
+			{Version: 1, Type: "original", ContentHash: contentHash(clinicalData), AuthorID: "doctor1", Timestamp: "2025-03-27T12:00:00Z"},
+			{Version: 2, Type: "addendum", ContentHash: contentHash("follow-up"), AuthorID: "doctor1", Timestamp: "2025-04-01T12:00:00Z", Reason: "follow-up"},
+		},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 1)).Return([]byte(clinicalData), nil)
+	mockStub.On("GetPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 2)).Return([]byte("follow-up"), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	expected := `{"resourceType":"Bundle","id":"emr1","type":"collection","timestamp":"2025-04-01T12:00:00Z","entry":[
+		{"fullUrl":"https://emr-net.example.com/fhir/Patient/patient","resource":{"resourceType":"Patient","id":"patient",
+			"identifier":[{"system":"urn:emr-net:user","value":"patient1"}],"managingOrganization":{"reference":"Organization/organization"}}},
+		{"fullUrl":"https://emr-net.example.com/fhir/Practitioner/practitioner","resource":{"resourceType":"Practitioner","id":"practitioner",
+			"identifier":[{"system":"urn:emr-net:user","value":"doctor1"}]}},
+		{"fullUrl":"https://emr-net.example.com/fhir/Organization/organization","resource":{"resourceType":"Organization","id":"organization",
+			"identifier":[{"system":"urn:emr-net:user","value":"hospital1"}]}},
+		{"fullUrl":"https://emr-net.example.com/fhir/Condition/condition","resource":{"resourceType":"Condition","id":"condition",
+			"identifier":[{"system":"urn:emr-net:emr","value":"emr1"}],
+			"code":{"coding":[{"system":"http://hl7.org/fhir/sid/icd-10","code":"J00"}],"text":"Common cold"},
+			"subject":{"reference":"Patient/patient"},"asserter":{"reference":"Practitioner/practitioner"},
+			"recordedDate":"2025-03-27T12:00:00Z","note":[{"text":"Rest"},{"text":"follow-up"}]}},
+		{"fullUrl":"https://emr-net.example.com/fhir/Observation/observation-8867-4","resource":{"resourceType":"Observation","id":"observation-8867-4","status":"final",
+			"code":{"coding":[{"system":"http://loinc.org","code":"8867-4","display":"Heart rate"}]},"subject":{"reference":"Patient/patient"},
+			"valueQuantity":{"value":72,"unit":"/min","system":"http://unitsofmeasure.org","code":"/min"}}},
+		{"fullUrl":"https://emr-net.example.com/fhir/Observation/observation-8310-5","resource":{"resourceType":"Observation","id":"observation-8310-5","status":"final",
+			"code":{"coding":[{"system":"http://loinc.org","code":"8310-5","display":"Body temperature"}]},"subject":{"reference":"Patient/patient"},
+			"valueQuantity":{"value":37.5,"unit":"Cel","system":"http://unitsofmeasure.org","code":"Cel"}}},
+		{"fullUrl":"https://emr-net.example.com/fhir/MedicationStatement/medication-1","resource":{"resourceType":"MedicationStatement","id":"medication-1",
+			"status":"active","medicationCodeableConcept":{"text":"Paracetamol"},"subject":{"reference":"Patient/patient"},
+			"dosage":[{"text":"500 mg","timing":{"code":{"text":"every 6 hours"}}}]}},
+		{"fullUrl":"https://emr-net.example.com/fhir/MedicationStatement/medication-2","resource":{"resourceType":"MedicationStatement","id":"medication-2",
+			"status":"active","medicationCodeableConcept":{"text":"Saline spray"},"subject":{"reference":"Patient/patient"}}}
+	]}`
+
+	bundle, err := chaincode.ExportRecordFHIR(ctx, "emr1")
+	assert.NoError(t, err)
+	assert.JSONEq(t, expected, bundle)
+
+	// Exporting again should give the exact same bytes
+	again, err := chaincode.ExportRecordFHIR(ctx, "emr1")
+	assert.NoError(t, err)
+	assert.Equal(t, bundle, again)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// ImportRecordFHIR should create a record whose clinical data is mapped from the bundle
+func TestImportRecordFHIR(t *testing.T) {
+	chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	bundle := `{"resourceType":"Bundle","type":"collection","entry":[
+		{"resource":{"resourceType":"Patient","id":"p1"}},
+		{"resource":{"resourceType":"Condition","id":"c1","code":{"coding":[{"system":"http://hl7.org/fhir/sid/icd-10-cm","code":"J02.9","display":"Acute pharyngitis"}]},
+			"subject":{"reference":"Patient/p1"},"note":[{"text":"Sore throat"},{"text":"No fever"}]}},
+		{"resource":{"resourceType":"Observation","id":"o1","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"8867-4"}]},
+			"valueQuantity":{"value":88.4,"unit":"/min","system":"http://unitsofmeasure.org","code":"/min"}}},
+		{"resource":{"resourceType":"Observation","id":"o2","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"8310-5"}]},
+			"valueQuantity":{"value":36.9,"unit":"Cel","system":"http://unitsofmeasure.org","code":"Cel"}}}
+	]}`
+	clinicalData := `{"schemaVersion":"1","diagnosis":"Acute pharyngitis","icd10Codes":["J02.9"],"notes":"Sore throat\nNo fever","vitals":{"heartRate":88,"temperature":36.9}}`
+
+	mockStub.On("GetState", userStateKey("patient1@orgName.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","commonName":"patient1@orgName.example.com"}`), nil)
+	mockStub.On("GetState", userStateKey("hospital1@orgName.example.com")).Return([]byte(`{"userId":"hospital1","role":"hospital","commonName":"hospital1@orgName.example.com"}`), nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(bundle)}, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(nil, nil)
+	mockStub.On("PutPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 1), []byte(clinicalData)).Return(nil)
+	mockStub.On("PutState", emrStateKey("emr1"), mock.Anything).Return(nil)
+	mockStub.On("PutState", patientIndexStateKey("patient1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("doctor1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("hospital1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordCreated", mock.Anything).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ImportRecordFHIR(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestFHIRToClinicalDataErrors(t *testing.T) {
+	condition := FHIRBundleEntry{Resource: FHIRResource{ResourceType: "Condition", Code: &FHIRCodeableConcept{Text: "diagnosis1"}}}
+	tests := []struct {
+		name     string
+		bundle   FHIRBundle
+		expected string
+	}{
+		{"not a bundle", FHIRBundle{ResourceType: "Condition"}, "expected a FHIR Bundle"},
+		{"no condition", FHIRBundle{ResourceType: "Bundle"}, "exactly one Condition, found 0"},
+		{"two conditions", FHIRBundle{ResourceType: "Bundle", Entry: []FHIRBundleEntry{condition, condition}}, "exactly one Condition, found 2"},
+		{"unsupported observation", FHIRBundle{ResourceType: "Bundle", Entry: []FHIRBundleEntry{condition, {Resource: FHIRResource{
+			ResourceType:  "Observation",
+			ID:            "o1",
+			Code:          &FHIRCodeableConcept{Coding: []FHIRCoding{{System: "http://loinc.org", Code: "29463-7"}}},
+			ValueQuantity: &FHIRQuantity{Value: 70, Unit: "kg"},
+		}}}}, "FHIR Observation o1 is not a supported vital sign"},
+		{"wrong unit", FHIRBundle{ResourceType: "Bundle", Entry: []FHIRBundleEntry{condition, {Resource: FHIRResource{
+			ResourceType:  "Observation",
+			ID:            "o1",
+			Code:          &FHIRCodeableConcept{Coding: []FHIRCoding{{System: "http://loinc.org", Code: "8310-5"}}},
+			ValueQuantity: &FHIRQuantity{Value: 98.6, Unit: "[degF]", Code: "[degF]"},
+		}}}}, "FHIR Observation o1 must be measured in Cel"},
+		{"medication without name", FHIRBundle{ResourceType: "Bundle", Entry: []FHIRBundleEntry{condition, {Resource: FHIRResource{
+			ResourceType:              "MedicationStatement",
+			ID:                        "m1",
+			MedicationCodeableConcept: &FHIRCodeableConcept{Coding: []FHIRCoding{{System: "http://www.nlm.nih.gov/research/umls/rxnorm", Code: "161"}}},
+		}}}}, "FHIR MedicationStatement m1 has no medication name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clinicalData, err := fhirToClinicalData(&test.bundle)
+			assert.Error(t, err)
+			assert.Nil(t, clinicalData)
+			assert.Contains(t, err.Error(), test.expected)
+		})
+	}
+}
+
+// Exported bundles should import back to the same clinical data
+func TestFHIRRoundTrip(t *testing.T) {
+	clinicalData := ClinicalData{
+		SchemaVersion: "1",
+		Diagnosis:     "Hypertension",
+		ICD10Codes:    []string{"I10"},
+		Notes:         "Reduce salt",
+		Medications:   []Medication{{Name: "Amlodipine", Dose: "5 mg", Frequency: "once daily"}, {Name: "Aspirin", Dose: "75 mg"}},
+		Vitals:        &Vitals{HeartRate: 80, SystolicBloodPressure: 150, DiastolicBloodPressure: 95, RespiratoryRate: 16, Temperature: 36.6, OxygenSaturation: 97},
+	}
+	clinicalDataJSON, _ := json.Marshal(clinicalData)
+	emr := EMR{EMRID: "emr1", PatientID: "patient1", DoctorID: "doctor1"}
+
+	bundle := recordToFHIR(&emr, []RecordContent{{Version: 1, Type: "original", Content: string(clinicalDataJSON)}})
+	imported, err := fhirToClinicalData(bundle)
+	assert.NoError(t, err)
+	assert.Equal(t, &clinicalData, imported)
+}
+
+func TestGetRecordHistory(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+	mockHistoryIterator := new(MockHistoryIterator)
+
+	emrCreated := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrCreatedJSON, _ := json.Marshal(emrCreated)
+
+	emrShared := emrCreated
+	emrShared.SharedWithDoctors = []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-28T12:00:00Z", Permissions: []string{"read"}}}
+	emrSharedJSON, _ := json.Marshal(emrShared)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrSharedJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetHistoryForKey", emrStateKey("emr1")).Return(mockHistoryIterator, nil)
+
+	// The record was never stored under a legacy key
+	mockLegacyHistoryIterator := new(MockHistoryIterator)
+	mockStub.On("GetHistoryForKey", "emr1").Return(mockLegacyHistoryIterator, nil)
+	mockLegacyHistoryIterator.On("HasNext").Return(false).Once()
+	mockLegacyHistoryIterator.On("Close").Return(nil)
+
+	mockHistoryIterator.On("HasNext").Return(true).Times(3)
+	mockHistoryIterator.On("HasNext").Return(false).Once()
+	mockHistoryIterator.On("Next").Return(&queryresult.KeyModification{
+		TxId:      "tx1",
+		Value:     emrCreatedJSON,
+		Timestamp: timestamppb.New(time.Date(2025, 3, 27, 12, 0, 0, 0, time.UTC)),
+	}, nil).Once()
+	mockHistoryIterator.On("Next").Return(&queryresult.KeyModification{
+		TxId:      "tx2",
+		Value:     emrSharedJSON,
+		Timestamp: timestamppb.New(time.Date(2025, 3, 28, 12, 0, 0, 0, time.UTC)),
+	}, nil).Once()
+	mockHistoryIterator.On("Next").Return(&queryresult.KeyModification{
+		TxId:      "tx3",
+		Timestamp: timestamppb.New(time.Date(2025, 3, 29, 12, 0, 0, 0, time.UTC)),
+		IsDelete:  true,
+	}, nil).Once()
+	mockHistoryIterator.On("Close").Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	history, err := chaincode.GetRecordHistory(ctx, "emr1")
+	assert.NoError(t, err)
+	assert.Equal(t, []RecordHistoryEntry{
+		{TxID: "tx1", Timestamp: "2025-03-27T12:00:00Z", Record: &emrCreated},
+		{TxID: "tx2", Timestamp: "2025-03-28T12:00:00Z", Record: &emrShared},
+		{TxID: "tx3", Timestamp: "2025-03-29T12:00:00Z", IsDelete: true},
+	}, history)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockHistoryIterator.AssertExpectations(t)
+}
+
+// The history written under the legacy plain key of a migrated record should come before its composite key history
+func TestGetRecordHistoryLegacyKey(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+	mockHistoryIterator := new(MockHistoryIterator)
+	mockLegacyHistoryIterator := new(MockHistoryIterator)
+
+	emrCreated := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrCreatedJSON, _ := json.Marshal(emrCreated)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrCreatedJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetHistoryForKey", "emr1").Return(mockLegacyHistoryIterator, nil)
+	mockStub.On("GetHistoryForKey", emrStateKey("emr1")).Return(mockHistoryIterator, nil)
+
+	// The legacy key was written by tx1 and deleted by the migration in tx2
+	mockLegacyHistoryIterator.On("HasNext").Return(true).Times(2)
+	mockLegacyHistoryIterator.On("HasNext").Return(false).Once()
+	mockLegacyHistoryIterator.On("Next").Return(&queryresult.KeyModification{
+		TxId:      "tx1",
+		Value:     emrCreatedJSON,
+		Timestamp: timestamppb.New(time.Date(2025, 3, 27, 12, 0, 0, 0, time.UTC)),
+	}, nil).Once()
+	mockLegacyHistoryIterator.On("Next").Return(&queryresult.KeyModification{
+		TxId:      "tx2",
+		Timestamp: timestamppb.New(time.Date(2025, 3, 28, 12, 0, 0, 0, time.UTC)),
+		IsDelete:  true,
+	}, nil).Once()
+	mockLegacyHistoryIterator.On("Close").Return(nil)
+
+	mockHistoryIterator.On("HasNext").Return(true).Once()
+	mockHistoryIterator.On("HasNext").Return(false).Once()
+	mockHistoryIterator.On("Next").Return(&queryresult.KeyModification{
+		TxId:      "tx2",
+		Value:     emrCreatedJSON,
+		Timestamp: timestamppb.New(time.Date(2025, 3, 28, 12, 0, 0, 0, time.UTC)),
+	}, nil).Once()
+	mockHistoryIterator.On("Close").Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	history, err := chaincode.GetRecordHistory(ctx, "emr1")
+	assert.NoError(t, err)
+	assert.Equal(t, []RecordHistoryEntry{
+		{TxID: "tx1", Timestamp: "2025-03-27T12:00:00Z", Record: &emrCreated},
+		{TxID: "tx2", Timestamp: "2025-03-28T12:00:00Z", Record: &emrCreated},
+	}, history)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockHistoryIterator.AssertExpectations(t)
+	mockLegacyHistoryIterator.AssertExpectations(t)
+}
+
+// Users that cannot read a record should not be able to read its history either
+func TestGetRecordHistoryNotAuthorized(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	// Do not set GetHistoryForKey expectation here since the history should not be read
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	history, err := chaincode.GetRecordHistory(ctx, "emr1")
+	assert.Error(t, err)
+	assert.Nil(t, history)
+	assert.Contains(t, err.Error(), "doctor is not authorized to read")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestAccessRecordWritesAccessLog(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	entry := AccessLogEntry{
+		EMRID:      "emr1",
+		AccessorID: "doctor2",
+		Role:       "doctor",
+		Purpose:    "treatment",
+		Timestamp:  "2025-04-01T12:00:00Z",
+		TxID:       "tx1",
+	}
+	entryJSON, _ := json.Marshal(entry)
+	entryKey, _ := shim.CreateCompositeKey("access", []string{"emr1", "tx1"})
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetTxID").Return("tx1")
+	mockStub.On("PutState", entryKey, entryJSON).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.AccessRecord(ctx, "emr1", "treatment")
+	assert.NoError(t, err)
+	assert.Equal(t, &emr, result)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Denied accesses should not be logged as accesses
+func TestAccessRecordNotAuthorized(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	// Do not set PutState expectation here since reading should fail
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.AccessRecord(ctx, "emr1", "treatment")
+	assert.Error(t, err)
+	assert.Nil(t, result)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Reading the clinical content of a record through the audited read should be logged
+func TestAccessRecordContentWritesAccessLog(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		ContentHash:         contentHash("diagnosis1"),
+		Collection:          "Org1MSPPrivateCollection",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+		Versions: []RecordVersion{
+			{Version: 1, Type: "original", ContentHash: contentHash("diagnosis1"), AuthorID: "doctor1", Timestamp: "2025-03-27T12:00:00Z"},
+		},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	entryJSON, _ := json.Marshal(AccessLogEntry{
+		EMRID:      "emr1",
+		AccessorID: "patient1",
+		Role:       "patient",
+		Purpose:    "personal review",
+		Timestamp:  "2025-04-01T12:00:00Z",
+		TxID:       "tx1",
+	})
+	entryKey, _ := shim.CreateCompositeKey("access", []string{"emr1", "tx1"})
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetTxID").Return("tx1")
+	mockStub.On("PutState", entryKey, entryJSON).Return(nil)
+	mockStub.On("GetPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 1)).Return([]byte("diagnosis1"), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	contents, err := chaincode.AccessRecordContent(ctx, "emr1", "personal review")
+	assert.NoError(t, err)
+	assert.Equal(t, []RecordContent{{Version: 1, Type: "original", Content: "diagnosis1"}}, contents)
+
+	// The audited read needs a purpose
+	_, err = chaincode.AccessRecordContent(ctx, "emr1", "")
+	assert.Error(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockStub.AssertNumberOfCalls(t, "PutState", 1)
+}
+
+// Exporting a record through the audited export should be logged
+func TestAccessRecordFHIRWritesAccessLog(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	clinicalData := `{"schemaVersion":"1","diagnosis":"Common cold"}`
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		ContentHash:         contentHash(clinicalData),
+		Collection:          "Org1MSPPrivateCollection",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+		Versions: []RecordVersion{
+			{Version: 1, Type: "original", ContentHash: contentHash(clinicalData), AuthorID: "doctor1", Timestamp: "2025-03-27T12:00:00Z"},
+		},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	entryJSON, _ := json.Marshal(AccessLogEntry{
+		EMRID:      "emr1",
+		AccessorID: "patient1",
+		Role:       "patient",
+		Purpose:    "transfer of care",
+		Timestamp:  "2025-04-01T12:00:00Z",
+		TxID:       "tx1",
+	})
+	entryKey, _ := shim.CreateCompositeKey("access", []string{"emr1", "tx1"})
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetTxID").Return("tx1")
+	mockStub.On("PutState", entryKey, entryJSON).Return(nil)
+	mockStub.On("GetPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 1)).Return([]byte(clinicalData), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	bundle, err := chaincode.AccessRecordFHIR(ctx, "emr1", "transfer of care")
+	assert.NoError(t, err)
+	assert.Contains(t, bundle, `"text":"Common cold"`)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+func TestGetAccessLog(t *testing.T) {
+	chaincode := new(EMRChaincode)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	// Entries are returned by key order and should be sorted by time of access
+	entries := []AccessLogEntry{
+		{EMRID: "emr1", AccessorID: "doctor1", Role: "doctor", Purpose: "follow-up", Timestamp: "2025-03-29T12:00:00Z", TxID: "a"},
+		{EMRID: "emr1", AccessorID: "hospital1", Role: "hospital", Purpose: "billing", Timestamp: "2025-03-28T12:00:00Z", TxID: "b"},
+	}
+
+	for _, caller := range []struct{ role, clientID string }{{"patient", "patient1"}, {"auditor", "auditor1"}} {
+		mockStub := new(MockStub)
+		mockClientIdentity := new(MockClientIdentity)
+		mockResultsIterator := new(MockResultsIterator)
+
+		for _, entry := range entries {
+			entryJSON, _ := json.Marshal(entry)
+			mockResultsIterator.On("Next").Return(&queryresult.KV{Value: entryJSON}, nil).Once()
+		}
+		mockResultsIterator.On("HasNext").Return(true).Times(len(entries))
+		mockResultsIterator.On("HasNext").Return(false).Once()
+		mockResultsIterator.On("Close").Return(nil)
+
+		mockClientIdentity.On("GetAttributeValue", "role").Return(caller.role, true, nil)
+		mockClientIdentity.On("GetID").Return(caller.clientID, nil)
+		mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+		mockStub.On("GetStateByPartialCompositeKey", "access", []string{"emr1"}).Return(mockResultsIterator, nil)
+
+		ctx := &mockTransactionContext{
+			stub:           mockStub,
+			clientIdentity: mockClientIdentity,
+		}
+
+		result, err := chaincode.GetAccessLog(ctx, "emr1")
+		assert.NoError(t, err)
+		assert.Equal(t, []AccessLogEntry{entries[1], entries[0]}, result)
+
+		mockClientIdentity.AssertExpectations(t)
+		mockStub.AssertExpectations(t)
+		mockResultsIterator.AssertExpectations(t)
+	}
+}
+
+// Doctors, hospitals and other patients should not be able to read the access log
+func TestGetAccessLogNotAuthorized(t *testing.T) {
+	chaincode := new(EMRChaincode)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	for _, caller := range []struct{ role, clientID string }{{"doctor", "doctor1"}, {"hospital", "hospital1"}, {"patient", "patient2"}} {
+		mockStub := new(MockStub)
+		mockClientIdentity := new(MockClientIdentity)
+
+		mockClientIdentity.On("GetAttributeValue", "role").Return(caller.role, true, nil)
+		mockClientIdentity.On("GetID").Return(caller.clientID, nil)
+		mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+
+		ctx := &mockTransactionContext{
+			stub:           mockStub,
+			clientIdentity: mockClientIdentity,
+		}
+
+		result, err := chaincode.GetAccessLog(ctx, "emr1")
+		assert.Error(t, err)
+		assert.Nil(t, result)
+		assert.Contains(t, err.Error(), caller.role+" is not authorized to read the access log")
+
+		mockClientIdentity.AssertExpectations(t)
+		mockStub.AssertExpectations(t)
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+
+	userJSON := []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com"}`)
+	emrJSON := []byte(`{"emrId":"emr1","patientId":"patient1","doctorId":"doctor1","diagnosis":"diagnosis1",` +
+		`"createdOn":"2025-03-27T12:00:00Z","lastModified":"2025-03-27T12:00:00Z","sharedWithDoctors":["doctor2"],"sharedWithHospitals":[]}`)
+
+	mockResultsIterator.On("HasNext").Return(true).Times(3)
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: "doctor1@org1.example.com", Value: userJSON}, nil).Once()
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: "emr1", Value: emrJSON}, nil).Once()
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: "unrelated", Value: []byte("not json")}, nil).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	mockStub.On("GetStateByRange", "", "").Return(mockResultsIterator, nil)
+
+	// Entries are copied unchanged to their composite keys and the plain keys are deleted
+	mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return(nil, nil)
+	mockStub.On("PutState", userStateKey("doctor1@org1.example.com"), userJSON).Return(nil)
+	mockStub.On("DelState", "doctor1@org1.example.com").Return(nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(nil, nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrJSON).Return(nil)
+	mockStub.On("DelState", "emr1").Return(nil)
+	mockStub.On("PutState", patientIndexStateKey("patient1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("doctor1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	page, err := chaincode.MigrateLegacyKeys(ctx, 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, &MigrationPage{Migrated: 2}, page)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockResultsIterator.AssertExpectations(t)
+}
+
+// The migration should stop after pageSize plain keys and return the key to continue from
+func TestMigrateLegacyKeysPaginated(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+
+	userJSON := []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com"}`)
+
+	mockResultsIterator.On("HasNext").Return(true).Times(3)
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: "doctor1@org1.example.com", Value: userJSON}, nil).Once()
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: "unrelated", Value: []byte("not json")}, nil).Once()
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: "patient1@org2.example.com", Value: []byte(`{"userId":"patient1"}`)}, nil).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	mockStub.On("GetStateByRange", "bookmark1", "").Return(mockResultsIterator, nil)
+	mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return(nil, nil)
+	mockStub.On("PutState", userStateKey("doctor1@org1.example.com"), userJSON).Return(nil)
+	mockStub.On("DelState", "doctor1@org1.example.com").Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	page, err := chaincode.MigrateLegacyKeys(ctx, 2, "bookmark1")
+	assert.NoError(t, err)
+	assert.Equal(t, &MigrationPage{Migrated: 1, Bookmark: "patient1@org2.example.com"}, page)
+
+	_, err = chaincode.MigrateLegacyKeys(ctx, 0, "")
+	assert.EqualError(t, err, "invalid page size: 0")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockResultsIterator.AssertExpectations(t)
+	mockStub.AssertNumberOfCalls(t, "PutState", 1)
+}
+
+// Entries whose composite key is already in use should be skipped without stopping the migration
+func TestMigrateLegacyKeysKeyInUse(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+	firstPage := new(MockResultsIterator)
+	nextPage := new(MockResultsIterator)
+
+	emrJSON := []byte(`{"emrId":"emr1","patientId":"patient1","doctorId":"doctor1","diagnosis":"diagnosis1"}`)
+	userJSON := []byte(`{"userId":"patient1","role":"patient","CommonName":"patient1@org2.example.com"}`)
+
+	firstPage.On("HasNext").Return(true).Times(2)
+	firstPage.On("Next").Return(&queryresult.KV{Key: "emr1", Value: emrJSON}, nil).Once()
+	firstPage.On("Next").Return(&queryresult.KV{Key: "patient1@org2.example.com", Value: userJSON}, nil).Once()
+	firstPage.On("Close").Return(nil)
+	nextPage.On("HasNext").Return(true).Once()
+	nextPage.On("HasNext").Return(false).Once()
+	nextPage.On("Next").Return(&queryresult.KV{Key: "patient1@org2.example.com", Value: userJSON}, nil).Once()
+	nextPage.On("Close").Return(nil)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	mockStub.On("GetStateByRange", "", "").Return(firstPage, nil)
+	mockStub.On("GetStateByRange", "patient1@org2.example.com", "").Return(nextPage, nil)
+	// The record ID was used again after the upgrade, the legacy record stays under its plain key
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetState", userStateKey("patient1@org2.example.com")).Return(nil, nil)
+	mockStub.On("PutState", userStateKey("patient1@org2.example.com"), userJSON).Return(nil)
+	mockStub.On("DelState", "patient1@org2.example.com").Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	page, err := chaincode.MigrateLegacyKeys(ctx, 1, "")
+	assert.NoError(t, err)
+	assert.Equal(t, &MigrationPage{Bookmark: "patient1@org2.example.com", Conflicts: []string{"emr1"}}, page)
+
+	page, err = chaincode.MigrateLegacyKeys(ctx, 1, page.Bookmark)
+	assert.NoError(t, err)
+	assert.Equal(t, &MigrationPage{Migrated: 1}, page)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	firstPage.AssertExpectations(t)
+	nextPage.AssertExpectations(t)
+	mockStub.AssertNotCalled(t, "DelState", "emr1")
+}
+
+func TestMigrateLegacyKeysNotAdmin(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	_, err := chaincode.MigrateLegacyKeys(ctx, 10, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "only admins can migrate legacy keys")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// A record ID equal to a user's CommonName should not read back the user
+func TestReadRecordWithUserCommonName(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	patient1 := User{
+		UserID:     "patient1",
+		Role:       "patient",
+		CommonName: "patient1@orgName.example.com",
+	}
+	patient1JSON, _ := json.Marshal(patient1)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockStub.On("GetState", userStateKey("patient1@orgName.example.com")).Return(patient1JSON, nil).Maybe()
+	mockStub.On("GetState", emrStateKey("patient1@orgName.example.com")).Return(nil, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.ReadRecord(ctx, "patient1@orgName.example.com")
+	assert.Error(t, err)
+	assert.Nil(t, result)
+	assert.Contains(t, err.Error(), "does not exist")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// GetAllRecordsForPatient should use the patient index when rich queries are not supported
+func TestGetAllRecordsForPatientLevelDBFallback(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+
+	patient := User{
+		UserID:     "patient2",
+		Role:       "patient",
+		CommonName: "patient2@orgName.example.com",
+	}
+	patientJSON, _ := json.Marshal(patient)
+	mockStub.On("GetState", userStateKey("patient2@orgName.example.com")).Return(patientJSON, nil)
+
+	var expectedEMRs []EMR
+	for i := 0; i < 3; i++ {
+		emr := EMR{
+			EMRID:               fmt.Sprintf("emr%d", i),
+			PatientID:           "patient2",
+			DoctorID:            "doctor1",
+			HospitalID:          "hospital1",
+			Diagnosis:           fmt.Sprintf("diagnosis%d", i),
+			CreatedOn:           "2025-03-27T12:00:00Z",
+			LastModified:        "2025-03-27T12:00:00Z",
+			SharedWithDoctors:   []Grant{},
+			SharedWithHospitals: []Grant{},
+		}
+		emrJSON, _ := json.Marshal(emr)
+		mockStub.On("GetState", emrStateKey(emr.EMRID)).Return(emrJSON, nil)
+		mockResultsIterator.On("Next").Return(&queryresult.KV{Key: patientIndexStateKey("patient2", emr.EMRID)}, nil).Once()
+		expectedEMRs = append(expectedEMRs, emr)
+	}
+	mockResultsIterator.On("HasNext").Return(true).Times(len(expectedEMRs))
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	mockStub.On("GetQueryResult", mock.Anything).Return(nil, fmt.Errorf("ExecuteQuery not supported for leveldb"))
+	mockStub.On("GetStateByPartialCompositeKey", "patient~emr", []string{"patient2"}).Return(mockResultsIterator, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient2", nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	results, err := chaincode.GetAllRecordsForPatient(ctx, "patient2@orgName.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, expectedEMRs, results)
+
+	mockResultsIterator.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockClientIdentity.AssertExpectations(t)
+}
+
+// Paginated listings should return the index page's bookmark and skip records the client cannot read
+func TestGetRecordsForPatientPaginated(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor1")
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+
+	patient := User{
+		UserID:     "patient1",
+		Role:       "patient",
+		CommonName: "patient1@orgName.example.com",
+	}
+	patientJSON, _ := json.Marshal(patient)
+	mockStub.On("GetState", userStateKey("patient1@orgName.example.com")).Return(patientJSON, nil)
+
+	var emrs []EMR
+	for i, doctorID := range []string{"doctor1", "doctor2"} {
+		emr := EMR{
+			EMRID:               fmt.Sprintf("emr%d", i),
+			PatientID:           "patient1",
+			DoctorID:            doctorID,
+			HospitalID:          "hospital1",
+			Diagnosis:           fmt.Sprintf("diagnosis%d", i),
+			CreatedOn:           "2025-03-27T12:00:00Z",
+			LastModified:        "2025-03-27T12:00:00Z",
+			SharedWithDoctors:   []Grant{},
+			SharedWithHospitals: []Grant{},
+		}
+		emrJSON, _ := json.Marshal(emr)
+		mockStub.On("GetState", emrStateKey(emr.EMRID)).Return(emrJSON, nil)
+		mockResultsIterator.On("Next").Return(&queryresult.KV{Key: patientIndexStateKey("patient1", emr.EMRID)}, nil).Once()
+		emrs = append(emrs, emr)
+	}
+	mockResultsIterator.On("HasNext").Return(true).Times(len(emrs))
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	metadata := &peer.QueryResponseMetadata{FetchedRecordsCount: 2, Bookmark: "bookmark2"}
+	mockStub.On("GetStateByPartialCompositeKeyWithPagination", "patient~emr", []string{"patient1"}, int32(2), "bookmark1").Return(mockResultsIterator, metadata, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	page, err := chaincode.GetRecordsForPatientPaginated(ctx, "patient1@orgName.example.com", 2, "bookmark1")
+	assert.NoError(t, err)
+	assert.Equal(t, &RecordPage{Records: []EMR{emrs[0]}, FetchedCount: 2, Bookmark: "bookmark2"}, page)
+
+	mockResultsIterator.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockClientIdentity.AssertExpectations(t)
+}
+
+func TestGetRecordsCreatedByMePaginated(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "hospital1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("hospital1")).Return(nil, nil)
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+
+	mockResultsIterator.On("HasNext").Return(true).Once()
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: ownerIndexStateKey("hospital1", "emr1")}, nil).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	metadata := &peer.QueryResponseMetadata{FetchedRecordsCount: 1, Bookmark: ""}
+	mockStub.On("GetStateByPartialCompositeKeyWithPagination", "owner~emr", []string{"hospital1"}, int32(10), "").Return(mockResultsIterator, metadata, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("hospital", true, nil)
+	mockClientIdentity.On("GetID").Return("hospital1", nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	page, err := chaincode.GetRecordsCreatedByMePaginated(ctx, 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, &RecordPage{Records: []EMR{emr}, FetchedCount: 1, Bookmark: ""}, page)
+
+	mockResultsIterator.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockClientIdentity.AssertExpectations(t)
+}
+
+func TestGetRecordsSharedWithMePaginated(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+
+	mockResultsIterator.On("HasNext").Return(true).Once()
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: granteeIndexStateKey("doctor2", "emr1")}, nil).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	metadata := &peer.QueryResponseMetadata{FetchedRecordsCount: 1, Bookmark: "bookmark1"}
+	mockStub.On("GetStateByPartialCompositeKeyWithPagination", "grantee~emr", []string{"doctor2"}, int32(1), "").Return(mockResultsIterator, metadata, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	page, err := chaincode.GetRecordsSharedWithMePaginated(ctx, 1, "")
+	assert.NoError(t, err)
+	assert.Equal(t, &RecordPage{Records: []EMR{emr}, FetchedCount: 1, Bookmark: "bookmark1"}, page)
+
+	mockResultsIterator.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockClientIdentity.AssertExpectations(t)
+}
+
+// Records whose grant expired should be left out of the shared-with-me inbox
+func TestGetRecordsSharedWithMe(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+
+	var emrs []EMR
+	for i, expiresAt := range []string{"", "2025-03-31T12:00:00Z"} {
+		emr := EMR{
+			EMRID:               fmt.Sprintf("emr%d", i),
+			PatientID:           "patient1",
+			DoctorID:            "doctor1",
+			HospitalID:          "hospital1",
+			Diagnosis:           fmt.Sprintf("diagnosis%d", i),
+			CreatedOn:           "2025-03-27T12:00:00Z",
+			LastModified:        "2025-03-27T12:00:00Z",
+			SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", ExpiresAt: expiresAt, Permissions: []string{"read"}}},
+			SharedWithHospitals: []Grant{},
+		}
+		emrJSON, _ := json.Marshal(emr)
+		mockStub.On("GetState", emrStateKey(emr.EMRID)).Return(emrJSON, nil)
+		mockResultsIterator.On("Next").Return(&queryresult.KV{Key: granteeIndexStateKey("doctor2", emr.EMRID)}, nil).Once()
+		emrs = append(emrs, emr)
+	}
+	mockResultsIterator.On("HasNext").Return(true).Times(len(emrs))
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	mockStub.On("GetStateByPartialCompositeKey", "grantee~emr", []string{"doctor2"}).Return(mockResultsIterator, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	results, err := chaincode.GetRecordsSharedWithMe(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []EMR{emrs[0]}, results)
+
+	mockResultsIterator.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockClientIdentity.AssertExpectations(t)
+}
+
+func TestGetRecordsCreatedByMePaginatedInvalidPageSize(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	// Do not set GetStateByPartialCompositeKeyWithPagination expectation here since the page size is rejected
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	page, err := chaincode.GetRecordsCreatedByMePaginated(ctx, 0, "")
+	assert.Error(t, err)
+	assert.Nil(t, page)
+	assert.Contains(t, err.Error(), "invalid page size")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// A grantee holding both a doctor and a hospital grant should stay in the grantee index until both are revoked
+func TestUnshareRecordKeepsGranteeIndexEntry(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Diagnosis:           "diagnosis1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}}},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}}},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.SharedWithHospitals = []Grant{}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("SetEvent", "RecordUnshared", eventPayload(RecordUnsharedEvent{EMRID: "emr1", PatientID: "patient1", RevokerID: "patient1", GranteeID: "doctor2", GranteeRole: "hospital"})).Return(nil)
+	// Do not set DelState expectation here since doctor2 still holds a doctor grant
+
+	doctor2 := User{
+		UserID:     "doctor2",
+		Role:       "doctor",
+		CommonName: "doctor2@orgName.example.com",
+	}
+	doctor2JSON, _ := json.Marshal(doctor2)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return(doctor2JSON, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UnshareRecord(ctx, "emr1", "doctor2@orgName.example.com", "hospital")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// emrJSONFields returns the JSON field names of EMR
+func emrJSONFields() []string {
+	var fields []string
+	emrType := reflect.TypeOf(EMR{})
+	for i := 0; i < emrType.NumField(); i++ {
+		name, _, _ := strings.Cut(emrType.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// The rich query selector must use the JSON field names of EMR, not the Go field names
+func TestPatientRecordsQuerySelectorFields(t *testing.T) {
+	queryString, err := patientRecordsQuery("patient1")
+	assert.NoError(t, err)
+
+	var query struct {
+		Selector map[string]any `json:"selector"`
+		UseIndex []string       `json:"use_index"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(queryString), &query))
+	assert.Equal(t, map[string]any{"patientId": "patient1", "emrId": map[string]any{"$exists": true}}, query.Selector)
+	for field := range query.Selector {
+		assert.Contains(t, emrJSONFields(), field)
+	}
+
+	// The query should name the index shipped with the chaincode
+	indexJSON, err := os.ReadFile("META-INF/statedb/couchdb/indexes/indexPatientId.json")
+	assert.NoError(t, err)
+
+	var index struct {
+		Index struct {
+			Fields []string `json:"fields"`
+		} `json:"index"`
+		DDoc string `json:"ddoc"`
+		Name string `json:"name"`
+	}
+	assert.NoError(t, json.Unmarshal(indexJSON, &index))
+	assert.Equal(t, []string{"_design/" + index.DDoc, index.Name}, query.UseIndex)
+	for _, field := range index.Index.Fields {
+		assert.Contains(t, emrJSONFields(), field)
+		assert.Contains(t, query.Selector, field)
+	}
+}
+
+// Emergency access should grant short-lived read access, log the justification and notify listeners
+func TestEmergencyAccess(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	// One access made within the last day and one made before it
+	usageJSON := []byte(`{"accessorId":"doctor2","timestamps":["2025-03-30T11:00:00Z","2025-04-01T02:00:00Z"]}`)
+
+	emr.SharedWithDoctors = []Grant{{
+		GrantorID:   "doctor2",
+		GranteeID:   "doctor2",
+		GrantedAt:   "2025-04-01T12:00:00Z",
+		ExpiresAt:   "2025-04-01T16:00:00Z",
+		Permissions: []string{"read"},
+		Emergency:   true,
+	}}
+	updatedJSON, _ := json.Marshal(emr)
+
+	entry := AccessLogEntry{
+		EMRID:      "emr1",
+		AccessorID: "doctor2",
+		Role:       "doctor",
+		Purpose:    "unconscious patient in the ER",
+		Timestamp:  "2025-04-01T12:00:00Z",
+		TxID:       "tx1",
+		Emergency:  true,
+	}
+	entryJSON, _ := json.Marshal(entry)
+	entryKey, _ := shim.CreateCompositeKey("access", []string{"emr1", "tx1"})
+
+	event := EmergencyAccessEvent{
+		EMRID:      "emr1",
+		PatientID:  "patient1",
+		AccessorID: "doctor2",
+		Role:       "doctor",
+		ExpiresAt:  "2025-04-01T16:00:00Z",
+		TxID:       "tx1",
+	}
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetTxID").Return("tx1")
+	mockStub.On("GetState", patientSettingsStateKey("patient1")).Return(nil, nil)
+	mockStub.On("GetState", emergencyUsageStateKey("doctor2")).Return(usageJSON, nil)
+	mockStub.On("PutState", emergencyUsageStateKey("doctor2"), []byte(`{"accessorId":"doctor2","timestamps":["2025-04-01T02:00:00Z","2025-04-01T12:00:00Z"]}`)).Return(nil)
+	mockStub.On("PutState", emrStateKey("emr1"), updatedJSON).Return(nil)
+	// The record is not listed as shared with the client, an entry of an expired grant it replaced is removed
+	mockStub.On("DelState", granteeIndexStateKey("doctor2", "emr1")).Return(nil)
+	mockStub.On("PutState", entryKey, entryJSON).Return(nil)
+	mockStub.On("SetEvent", "EmergencyAccess", eventPayload(event)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.EmergencyAccess(ctx, "emr1", "  unconscious patient in the ER ")
+	assert.NoError(t, err)
+	assert.Equal(t, &emr, result)
+
+	// The grant gives read access until it expires
+	assert.True(t, authorized(chaincode.isAuthorizedToRead(ctx, "doctor", "doctor2", result, txTimestamp.Add(3*time.Hour))))
+	assert.False(t, authorized(chaincode.isAuthorizedToRead(ctx, "doctor", "doctor2", result, txTimestamp.Add(4*time.Hour))))
+	assert.False(t, authorized(chaincode.hasPermission(ctx, "doctor", "doctor2", result, txTimestamp, permissionShare)))
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Rebuilding the indexes of a record should leave emergency grants out of the grantee index
+func TestIndexRecordSkipsEmergencyGrants(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+
+	emr := EMR{
+		EMRID:     "emr1",
+		PatientID: "patient1",
+		DoctorID:  "doctor1",
+		SharedWithDoctors: []Grant{
+			{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}},
+			{GrantorID: "doctor3", GranteeID: "doctor3", GrantedAt: "2025-04-01T12:00:00Z", ExpiresAt: "2025-04-01T16:00:00Z", Permissions: []string{"read"}, Emergency: true},
+		},
+		SharedWithHospitals: []Grant{},
+	}
+
+	mockStub.On("PutState", patientIndexStateKey("patient1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("doctor1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+
+	ctx := &mockTransactionContext{stub: mockStub}
+
+	err := chaincode.indexRecord(ctx, &emr)
+	assert.NoError(t, err)
+
+	mockStub.AssertExpectations(t)
+	mockStub.AssertNotCalled(t, "PutState", granteeIndexStateKey("doctor3", "emr1"), mock.Anything)
+}
+
+// Emergency access should be refused without changing the record when it is not allowed
+func TestEmergencyAccessDenied(t *testing.T) {
+	// doctor3 holds a grant but is suspended
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor3", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	tests := []struct {
+		name          string
+		role          string
+		clientID      string
+		justification string
+		settings      []byte
+		usage         []byte
+		expected      string
+	}{
+		{"patient", "patient", "patient1", "emergency", nil, nil, "this patient is not authorized to request emergency access"},
+		{"no justification", "doctor", "doctor2", "  ", nil, nil, "a justification is required for emergency access"},
+		{"already authorized", "doctor", "doctor1", "emergency", nil, nil, "this doctor can already read this record"},
+		{"disabled by patient", "doctor", "doctor2", "emergency", []byte(`{"patientId":"patient1","emergencyAccessDisabled":true}`), nil, "emergency access to the records of this patient is disabled"},
+		{"rate limited", "doctor", "doctor2", "emergency", nil,
+			[]byte(`{"accessorId":"doctor2","timestamps":["2025-03-31T13:00:00Z","2025-04-01T08:00:00Z","2025-04-01T11:00:00Z"]}`),
+			"emergency access limit of 3 per 24 hours reached"},
+		{"hospital on a record without hospital", "hospital", "hospital2", "emergency", nil, nil, "this hospital cannot be given emergency access to a record without a hospital"},
+		{"withheld grant", "doctor", "doctor3", "emergency", nil, nil, "this doctor already holds a grant on this record that does not give it access"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockNoConsentDirectives(mockStub, "patient1", test.clientID)
+			mockStub.On("GetState", denyStateKey("patient1", test.clientID)).Return(nil, nil)
+			if test.clientID == "doctor3" {
+				mockStub.On("GetState", userIDStateKey("doctor3")).Return([]byte("doctor3@org1.example.com"), nil)
+				mockStub.On("GetState", userStateKey("doctor3@org1.example.com")).Return([]byte(`{"userId":"doctor3","role":"doctor","CommonName":"doctor3@org1.example.com","status":"suspended"}`), nil)
+			} else {
+				mockStub.On("GetState", userIDStateKey(test.clientID)).Return(nil, nil)
+			}
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return(test.role, true, nil)
+			mockClientIdentity.On("GetID").Return(test.clientID, nil).Maybe()
+			mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil).Maybe()
+			mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil).Maybe()
+			mockStub.On("GetState", patientSettingsStateKey("patient1")).Return(test.settings, nil).Maybe()
+			mockStub.On("GetState", emergencyUsageStateKey(test.clientID)).Return(test.usage, nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			result, err := chaincode.EmergencyAccess(ctx, "emr1", test.justification)
+			assert.Error(t, err)
+			assert.Nil(t, result)
+			assert.EqualError(t, err, test.expected)
+
+			mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+			mockStub.AssertNotCalled(t, "SetEvent", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// Patients should be able to disable emergency access to their records
+func TestSetEmergencyAccess(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", patientSettingsStateKey("patient1")).Return(nil, nil)
+	mockStub.On("PutState", patientSettingsStateKey("patient1"), []byte(`{"patientId":"patient1","emergencyAccessDisabled":true}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.SetEmergencyAccess(ctx, false)
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Registrars should be able to link a guardian to a patient
+func TestAddProxyByRegistrar(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	proxy := Proxy{
+		PatientID: "patient1",
+		ProxyID:   "guardian1",
+		Scope:     []string{"read", "share"},
+		GrantedBy: "registrar1",
+		GrantedAt: "2025-04-01T12:00:00Z",
+		ExpiresAt: "2025-05-01T12:00:00Z",
+	}
+	proxyJSON, _ := json.Marshal(proxy)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("registrar", true, nil)
+	mockClientIdentity.On("GetID").Return("registrar1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org2MSP", nil)
+	mockStub.On("GetState", userStateKey("patient1@org2.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","CommonName":"patient1@org2.example.com","mspId":"Org2MSP"}`), nil)
+	mockStub.On("GetState", userStateKey("guardian1@org2.example.com")).Return([]byte(`{"userId":"guardian1","role":"patient","CommonName":"guardian1@org2.example.com"}`), nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetState", proxyStateKey("patient1", "guardian1")).Return(nil, nil)
+	mockStub.On("PutState", proxyStateKey("patient1", "guardian1"), proxyJSON).Return(nil)
+	mockStub.On("SetEvent", "ProxyAdded", []byte(`{"patientId":"patient1","proxyId":"guardian1","grantedBy":"registrar1","expiresAt":"2025-05-01T12:00:00Z"}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.AddProxy(ctx, "patient1@org2.example.com", "guardian1@org2.example.com", "share", 30)
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Only the patient and registrars should be able to add proxies
+func TestAddProxyNotAuthorized(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient2", nil)
+	mockStub.On("GetState", userStateKey("patient1@org2.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","CommonName":"patient1@org2.example.com"}`), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.AddProxy(ctx, "patient1@org2.example.com", "patient2@org2.example.com", "share", 0)
+	assert.EqualError(t, err, "this patient is not authorized to add proxies for this patient")
+
+	mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+}
+
+// Registrars should only manage the proxies of patients of their org
+func TestProxyByRegistrarOfAnotherOrg(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("registrar", true, nil)
+	mockClientIdentity.On("GetID").Return("registrar1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetState", userStateKey("patient1@org2.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","CommonName":"patient1@org2.example.com","mspId":"Org2MSP"}`), nil)
+	mockStub.On("GetState", userStateKey("guardian1@org2.example.com")).Return([]byte(`{"userId":"guardian1","role":"patient","CommonName":"guardian1@org2.example.com","mspId":"Org2MSP"}`), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.AddProxy(ctx, "patient1@org2.example.com", "guardian1@org2.example.com", "share", 0)
+	assert.EqualError(t, err, "this registrar is not authorized to add proxies for this patient")
+
+	err = chaincode.RemoveProxy(ctx, "patient1@org2.example.com", "guardian1@org2.example.com")
+	assert.EqualError(t, err, "this registrar is not authorized to remove proxies for this patient")
+
+	mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+	mockStub.AssertNotCalled(t, "DelState", mock.Anything)
+}
+
+// Proxies should hold the permissions of their scope until they expire
+func TestProxyPermissions(t *testing.T) {
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+
+	tests := []struct {
+		name     string
+		proxy    []byte
+		canRead  bool
+		canShare bool
+	}{
+		{"no proxy", nil, false, false},
+		{"read only", []byte(`{"patientId":"patient1","proxyId":"guardian1","scope":["read"]}`), true, false},
+		{"read and share", []byte(`{"patientId":"patient1","proxyId":"guardian1","scope":["read","share"],"expiresAt":"2025-04-02T12:00:00Z"}`), true, true},
+		{"expired", []byte(`{"patientId":"patient1","proxyId":"guardian1","scope":["read","share"],"expiresAt":"2025-04-01T12:00:00Z"}`), false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockStub.On("GetState", denyStateKey("patient1", "guardian1")).Return(nil, nil)
+			mockStub.On("GetState", userIDStateKey("guardian1")).Return(nil, nil)
+			mockStub.On("GetState", proxyStateKey("patient1", "guardian1")).Return(test.proxy, nil)
+
+			ctx := &mockTransactionContext{stub: mockStub}
+
+			assert.Equal(t, test.canRead, authorized(chaincode.isAuthorizedToRead(ctx, "patient", "guardian1", &emr, txTimestamp)))
+			assert.Equal(t, test.canShare, authorized(chaincode.hasPermission(ctx, "patient", "guardian1", &emr, txTimestamp, permissionShare)))
+			// Proxies never write clinical content
+			assert.False(t, authorized(chaincode.isAuthorizedToAmend(ctx, "patient", "guardian1", &emr, txTimestamp)))
+		})
+	}
+}
+
+// Proxies should be able to give up their own access
+func TestRemoveProxyByProxy(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("guardian1", nil)
+	mockStub.On("GetState", userStateKey("patient1@org2.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","CommonName":"patient1@org2.example.com"}`), nil)
+	mockStub.On("GetState", userStateKey("guardian1@org2.example.com")).Return([]byte(`{"userId":"guardian1","role":"patient","CommonName":"guardian1@org2.example.com"}`), nil)
+	mockStub.On("GetState", proxyStateKey("patient1", "guardian1")).Return([]byte(`{"patientId":"patient1","proxyId":"guardian1","scope":["read"]}`), nil)
+	mockStub.On("DelState", proxyStateKey("patient1", "guardian1")).Return(nil)
+	mockStub.On("SetEvent", "ProxyRemoved", []byte(`{"patientId":"patient1","proxyId":"guardian1","removedBy":"guardian1"}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.RemoveProxy(ctx, "patient1@org2.example.com", "guardian1@org2.example.com")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// consentStateKey returns the composite key of a consent directive
+func consentStateKey(patientID string, granteeID string, directiveID string) string {
+	key, _ := shim.CreateCompositeKey("consent", []string{patientID, granteeID, directiveID})
+	return key
+}
+
+// mockConsentDirectives makes the stub return the given consent directives for a partial consent key, once
+func mockConsentDirectives(mockStub *MockStub, attributes []string, directives ...ConsentDirective) {
+	mockResultsIterator := new(MockResultsIterator)
+	for _, directive := range directives {
+		directiveJSON, _ := json.Marshal(directive)
+		mockResultsIterator.On("Next").Return(&queryresult.KV{Value: directiveJSON}, nil).Once()
+	}
+	if len(directives) > 0 {
+		mockResultsIterator.On("HasNext").Return(true).Times(len(directives))
+	}
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Close").Return(nil)
+	mockStub.On("GetStateByPartialCompositeKey", "consent", attributes).Return(mockResultsIterator, nil).Once()
+}
+
+// Patients should be able to give a hospital access to all of their records at once
+func TestAddConsentDirective(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	directive := ConsentDirective{
+		DirectiveID: "tx1",
+		PatientID:   "patient1",
+		GranteeID:   "hospital2",
+		GranteeRole: "hospital",
+		Scope:       "all",
+		Permissions: []string{"read"},
+		GrantedAt:   "2025-04-01T12:00:00Z",
+		ExpiresAt:   "2025-04-11T12:00:00Z",
+	}
+	directiveJSON, _ := json.Marshal(directive)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", userStateKey("hospital2@org1.example.com")).Return([]byte(`{"userId":"hospital2","role":"hospital","CommonName":"hospital2@org1.example.com"}`), nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetTxID").Return("tx1")
+	mockStub.On("PutState", consentStateKey("patient1", "hospital2", "tx1"), directiveJSON).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	directiveID, err := chaincode.AddConsentDirective(ctx, "hospital2@org1.example.com", "hospital", "all", "ignored", "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "tx1", directiveID)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Invalid consent directives should be refused
+func TestAddConsentDirectiveInvalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		role        string
+		granteeRole string
+		scope       string
+		scopeValue  string
+		permissions string
+		expected    string
+	}{
+		{"not a patient", "doctor", "hospital", "all", "", "", "this doctor is not authorized to manage consent directives"},
+		{"invalid grantee role", "patient", "auditor", "all", "", "", "invalid role to give consent to: auditor"},
+		{"grantee role mismatch", "patient", "doctor", "all", "", "", "user with CommonName hospital2@org1.example.com is not a doctor"},
+		{"invalid scope", "patient", "hospital", "everything", "", "", "invalid consent scope: everything"},
+		{"missing category", "patient", "hospital", "category", "", "", "a category is required for a consent directive with the category scope"},
+		{"invalid permission", "patient", "hospital", "all", "", "delete", "invalid permission: delete"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return(test.role, true, nil)
+			mockClientIdentity.On("GetID").Return("patient1", nil).Maybe()
+			mockStub.On("GetState", userStateKey("hospital2@org1.example.com")).Return([]byte(`{"userId":"hospital2","role":"hospital","CommonName":"hospital2@org1.example.com"}`), nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			_, err := chaincode.AddConsentDirective(ctx, "hospital2@org1.example.com", test.granteeRole, test.scope, test.scopeValue, test.permissions, 0)
+			assert.EqualError(t, err, test.expected)
+
+			mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// Consent directives should give access to the records matching their scope, alongside per-record grants
+func TestConsentDirectivePermissions(t *testing.T) {
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Category:            "cardiology",
+		Tags:                []string{"chronic", "hypertension"},
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "revoke"}}},
+	}
+	directive := func(granteeRole string, scope string, scopeValue string, expiresAt string, permissions ...string) ConsentDirective {
+		return ConsentDirective{
+			DirectiveID: "tx1",
+			PatientID:   "patient1",
+			GranteeID:   "hospital2",
+			GranteeRole: granteeRole,
+			Scope:       scope,
+			ScopeValue:  scopeValue,
+			Permissions: append([]string{"read"}, permissions...),
+			GrantedAt:   "2025-03-27T12:00:00Z",
+			ExpiresAt:   expiresAt,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		directives []ConsentDirective
+		expected   []string
+	}{
+		{"no directive", nil, []string{"read", "revoke"}},
+		{"all records", []ConsentDirective{directive("hospital", "all", "", "", "share")}, []string{"read", "share", "revoke"}},
+		{"matching category", []ConsentDirective{directive("hospital", "category", "cardiology", "", "amend")}, []string{"read", "amend", "revoke"}},
+		{"other category", []ConsentDirective{directive("hospital", "category", "oncology", "", "amend")}, []string{"read", "revoke"}},
+		{"matching tag", []ConsentDirective{directive("hospital", "tag", "chronic", "", "share")}, []string{"read", "share", "revoke"}},
+		{"other tag", []ConsentDirective{directive("hospital", "tag", "acute", "", "share")}, []string{"read", "revoke"}},
+		{"expired", []ConsentDirective{directive("hospital", "all", "", "2025-04-01T12:00:00Z", "share")}, []string{"read", "revoke"}},
+		{"given under another role", []ConsentDirective{directive("doctor", "all", "", "", "share")}, []string{"read", "revoke"}},
+		{"several directives", []ConsentDirective{directive("hospital", "tag", "chronic", "", "share"), directive("hospital", "category", "cardiology", "", "amend")}, []string{"read", "share", "amend", "revoke"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockStub.On("GetState", denyStateKey("patient1", "hospital2")).Return(nil, nil)
+			mockStub.On("GetState", userIDStateKey("hospital2")).Return(nil, nil)
+			mockConsentDirectives(mockStub, []string{"patient1", "hospital2"}, test.directives...)
+
+			ctx := &mockTransactionContext{stub: mockStub}
+
+			permissions, err := chaincode.grantedPermissions(ctx, "hospital", "hospital2", &emr, txTimestamp)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, permissions)
+		})
+	}
+}
+
+// Records created after a directive should be readable without being shared
+func TestReadRecordThroughConsentDirective(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return(nil, nil)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		CreatedOn:           "2025-03-31T12:00:00Z",
+		LastModified:        "2025-03-31T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockConsentDirectives(mockStub, []string{"patient1", "doctor2"}, ConsentDirective{
+		DirectiveID: "tx1",
+		PatientID:   "patient1",
+		GranteeID:   "doctor2",
+		GranteeRole: "doctor",
+		Scope:       "all",
+		Permissions: []string{"read"},
+		GrantedAt:   "2025-03-01T12:00:00Z",
+	})
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.ReadRecord(ctx, "emr1")
+	assert.NoError(t, err)
+	assert.Equal(t, &emr, result)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Patients should be able to withdraw their own directives by ID
+func TestWithdrawConsentDirective(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	directives := []ConsentDirective{
+		{DirectiveID: "tx1", PatientID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor", Scope: "all", Permissions: []string{"read"}, GrantedAt: "2025-03-01T12:00:00Z"},
+		{DirectiveID: "tx2", PatientID: "patient1", GranteeID: "hospital2", GranteeRole: "hospital", Scope: "tag", ScopeValue: "chronic", Permissions: []string{"read"}, GrantedAt: "2025-03-02T12:00:00Z"},
+	}
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockConsentDirectives(mockStub, []string{"patient1"}, directives...)
+	mockStub.On("DelState", consentStateKey("patient1", "hospital2", "tx2")).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.WithdrawConsentDirective(ctx, "tx2")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Doctors that can amend a record should be able to classify it
+func TestClassifyRecord(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	emr.Category = "cardiology"
+	emr.Tags = []string{"chronic", "hypertension"}
+	emr.LastModified = "2025-04-01T12:00:00Z"
+	updatedJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), updatedJSON).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ClassifyRecord(ctx, "emr1", " cardiology ", "chronic, hypertension,,chronic")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// A hospital directive with the all scope should also cover records without a HospitalID
+func TestConsentDirectiveCoversRecordWithoutHospital(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockConsentDirectives(mockStub, []string{"patient1", "hospital2"}, ConsentDirective{
+		DirectiveID: "tx1",
+		PatientID:   "patient1",
+		GranteeID:   "hospital2",
+		GranteeRole: "hospital",
+		Scope:       consentScopeAll,
+		Permissions: []string{"read"},
+		GrantedAt:   "2025-03-27T12:00:00Z",
+	})
+	mockStub.On("GetState", denyStateKey("patient1", "hospital2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("hospital2")).Return(nil, nil)
+	ctx := &mockTransactionContext{stub: mockStub}
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+
+	assert.True(t, authorized(chaincode.isAuthorizedToRead(ctx, "hospital", "hospital2", &emr, txTimestamp)))
+	mockStub.AssertExpectations(t)
+}
+
+// Only the parties of a record should classify it, not sharees that can amend it
+func TestClassifyRecordParties(t *testing.T) {
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "amend"}}},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	tests := []struct {
+		name     string
+		role     string
+		clientID string
+		expected string
+	}{
+		{"patient", "patient", "patient1", ""},
+		{"amend sharee", "doctor", "doctor2", "this doctor is not authorized to classify this record"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return(test.role, true, nil)
+			mockClientIdentity.On("GetID").Return(test.clientID, nil)
+			mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+			mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+			mockStub.On("PutState", emrStateKey("emr1"), mock.Anything).Return(nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.ClassifyRecord(ctx, "emr1", "cardiology", "")
+			if test.expected == "" {
+				assert.NoError(t, err)
+				mockStub.AssertCalled(t, "PutState", emrStateKey("emr1"), mock.Anything)
+			} else {
+				assert.EqualError(t, err, test.expected)
+				mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+// Deny rules should override every way of being allowed access to a record
+func TestDenyRulesOverrideAllows(t *testing.T) {
+	baseEMR := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+		SharedWithHospitals: []Grant{{GrantorID: "patient1", GranteeID: "hospital2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}}},
+	}
+	baseEMR.SharedWithDoctors = append(baseEMR.SharedWithDoctors, Grant{GrantorID: "doctor4", GranteeID: "doctor4", GrantedAt: "2025-04-01T10:00:00Z", ExpiresAt: "2025-04-01T14:00:00Z", Permissions: []string{"read"}, Emergency: true})
+
+	allows := []struct {
+		name      string
+		role      string
+		clientID  string
+		directive *ConsentDirective
+		proxy     []byte
+		canShare  bool
+	}{
+		{"doctor owner", "doctor", "doctor1", nil, nil, true},
+		{"hospital owner", "hospital", "hospital1", nil, nil, true},
+		{"doctor grant", "doctor", "doctor2", nil, nil, true},
+		{"hospital grant", "hospital", "hospital2", nil, nil, true},
+		{"emergency grant", "doctor", "doctor4", nil, nil, false},
+		{"consent directive", "doctor", "doctor3", &ConsentDirective{DirectiveID: "tx1", PatientID: "patient1", GranteeID: "doctor3", GranteeRole: "doctor", Scope: "all", Permissions: []string{"read", "share"}}, nil, true},
+		{"proxy", "patient", "guardian1", nil, []byte(`{"patientId":"patient1","proxyId":"guardian1","scope":["read","share"]}`), true},
+	}
+	denials := []struct {
+		name        string
+		recordDeny  bool
+		patientDeny bool
+	}{
+		{"not denied", false, false},
+		{"denied on record", true, false},
+		{"denied by patient", false, true},
+		{"denied on record and by patient", true, true},
+	}
+
+	for _, allow := range allows {
+		for _, denial := range denials {
+			t.Run(allow.name+"/"+denial.name, func(t *testing.T) {
+				chaincode := new(EMRChaincode)
+				mockStub := new(MockStub)
+
+				emr := baseEMR
+				if denial.recordDeny {
+					emr.DeniedIDs = []string{"someone-else", allow.clientID}
+				}
+
+				if allow.directive != nil {
+					// Once for each authorization check
+					mockConsentDirectives(mockStub, []string{"patient1", allow.clientID}, *allow.directive)
+					mockConsentDirectives(mockStub, []string{"patient1", allow.clientID}, *allow.directive)
+				} else {
+					mockNoConsentDirectives(mockStub, "patient1", allow.clientID)
+				}
+				mockStub.On("GetState", proxyStateKey("patient1", allow.clientID)).Return(allow.proxy, nil)
+				var rule []byte
+				if denial.patientDeny {
+					rule = []byte(`{"patientId":"patient1","deniedId":"` + allow.clientID + `","createdAt":"2025-03-01T12:00:00Z"}`)
+				}
+				mockStub.On("GetState", denyStateKey("patient1", allow.clientID)).Return(rule, nil)
+				mockStub.On("GetState", userIDStateKey(allow.clientID)).Return(nil, nil)
+
+				ctx := &mockTransactionContext{stub: mockStub}
+
+				allowed := !denial.recordDeny && !denial.patientDeny
+				assert.Equal(t, allowed, authorized(chaincode.isAuthorizedToRead(ctx, allow.role, allow.clientID, &emr, txTimestamp)))
+				assert.Equal(t, allowed && allow.canShare, authorized(chaincode.hasPermission(ctx, allow.role, allow.clientID, &emr, txTimestamp, permissionShare)))
+			})
+		}
+	}
+}
+
+// Patients are never subject to deny rules on their own records
+func TestDenyRulesDoNotApplyToPatient(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	emr := EMR{EMRID: "emr1", PatientID: "patient1", DoctorID: "doctor1", DeniedIDs: []string{"patient1"}}
+
+	// The stub is never called
+	ctx := &mockTransactionContext{stub: new(MockStub)}
+
+	assert.True(t, authorized(chaincode.isAuthorizedToRead(ctx, "patient", "patient1", &emr, txTimestamp)))
+	assert.True(t, authorized(chaincode.hasPermission(ctx, "patient", "patient1", &emr, txTimestamp, permissionShare)))
+}
+
+// Denied clinicians should not be able to break the glass either
+func TestEmergencyAccessDeniedByDenyRule(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return([]byte(`{"patientId":"patient1","deniedId":"doctor2","createdAt":"2025-03-01T12:00:00Z"}`), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.EmergencyAccess(ctx, "emr1", "unconscious patient in the ER")
+	assert.EqualError(t, err, "this doctor is denied access to this record")
+	assert.Nil(t, result)
+
+	mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Patients should be able to deny a user access to all of their records
+func TestAddDenyRulePatientWide(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com"}`), nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("PutState", denyStateKey("patient1", "doctor2"), []byte(`{"patientId":"patient1","deniedId":"doctor2","createdAt":"2025-04-01T12:00:00Z"}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.AddDenyRule(ctx, "doctor2@org1.example.com", "")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Patients should be able to deny a user access to one of their records
+func TestAddDenyRuleOnRecord(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	emr.DeniedIDs = []string{"doctor2"}
+	emr.LastModified = "2025-04-01T12:00:00Z"
+	updatedJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com"}`), nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("PutState", emrStateKey("emr1"), updatedJSON).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.AddDenyRule(ctx, "doctor2@org1.example.com", "emr1")
+	assert.NoError(t, err)
+
+	// Only the patient of the record can deny access to it
+	mockClientIdentity2 := new(MockClientIdentity)
+	mockClientIdentity2.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity2.On("GetID").Return("patient2", nil)
+	ctx.clientIdentity = mockClientIdentity2
+
+	err = chaincode.AddDenyRule(ctx, "doctor2@org1.example.com", "emr1")
+	assert.EqualError(t, err, "this patient is not authorized to deny access to this record")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+	mockStub.AssertNumberOfCalls(t, "PutState", 1)
+}
+
+// attachmentStateKey returns the composite key of a document attached to a record
+func attachmentStateKey(emrID string, docID string) string {
+	key, _ := shim.CreateCompositeKey("attachment", []string{emrID, docID})
+	return key
+}
+
+// Doctors that can amend a record should be able to attach documents to it
+func TestAttachDocument(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	hash := contentHash("%PDF-1.7")
+	attachment := Attachment{
+		EMRID:      "emr1",
+		DocID:      "xray1",
+		MediaType:  "application/pdf",
+		SHA256:     hash,
+		SizeBytes:  8,
+		StorageURI: "s3://emr-documents/emr1/xray1.pdf",
+		AuthorID:   "doctor1",
+		AttachedAt: "2025-04-01T12:00:00Z",
+	}
+	attachmentJSON, _ := json.Marshal(attachment)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
+	mockStub.On("GetState", attachmentStateKey("emr1", "xray1")).Return(nil, nil)
+	mockStub.On("PutState", attachmentStateKey("emr1", "xray1"), attachmentJSON).Return(nil)
+	mockStub.On("SetEvent", "DocumentAttached", []byte(`{"emrId":"emr1","patientId":"patient1","docId":"xray1","authorId":"doctor1"}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	// Hashes are stored in lowercase
+	err := chaincode.AttachDocument(ctx, "emr1", "xray1", "application/pdf", strings.ToUpper(hash), 8, "s3://emr-documents/emr1/xray1.pdf")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Invalid or unauthorized attachments should be refused
+func TestAttachDocumentInvalid(t *testing.T) {
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+	hash := contentHash("%PDF-1.7")
+
+	tests := []struct {
+		name       string
+		role       string
+		clientID   string
+		docID      string
+		mediaType  string
+		sha256     string
+		sizeBytes  int64
+		storageURI string
+		existing   []byte
+		expected   string
+	}{
+		{"missing document ID", "doctor", "doctor1", "", "application/pdf", hash, 8, "s3://bucket/doc", nil, "a document ID is required to attach a document"},
+		{"invalid media type", "doctor", "doctor1", "xray1", "pdf;", hash, 8, "s3://bucket/doc", nil, "invalid media type: pdf;"},
+		{"invalid hash", "doctor", "doctor1", "xray1", "application/pdf", "abc", 8, "s3://bucket/doc", nil, "invalid document hash: abc"},
+		{"empty document", "doctor", "doctor1", "xray1", "application/pdf", hash, 0, "s3://bucket/doc", nil, "invalid document size: 0 bytes"},
+		{"relative URI", "doctor", "doctor1", "xray1", "application/pdf", hash, 8, "bucket/doc", nil, "invalid storage URI: bucket/doc"},
+		{"patient", "patient", "patient1", "xray1", "application/pdf", hash, 8, "s3://bucket/doc", nil, "this patient is not authorized to attach documents to this record"},
+		{"already attached", "doctor", "doctor1", "xray1", "application/pdf", hash, 8, "s3://bucket/doc", []byte(`{"docId":"xray1"}`), "document with ID xray1 is already attached to record with ID emr1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return(test.role, true, nil)
+			mockClientIdentity.On("GetID").Return(test.clientID, nil).Maybe()
+			mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil).Maybe()
+			mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil).Maybe()
+			mockStub.On("GetState", denyStateKey("patient1", test.clientID)).Return(nil, nil).Maybe()
+			mockStub.On("GetState", userIDStateKey(test.clientID)).Return(nil, nil).Maybe()
+			mockStub.On("GetState", attachmentStateKey("emr1", "xray1")).Return(test.existing, nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.AttachDocument(ctx, "emr1", test.docID, test.mediaType, test.sha256, test.sizeBytes, test.storageURI)
+			assert.EqualError(t, err, test.expected)
+
+			mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// Clients that can read a record should be able to list its attachments
+func TestListAttachments(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	attachments := []Attachment{
+		{EMRID: "emr1", DocID: "lab1", MediaType: "text/csv", SHA256: contentHash("a,b"), SizeBytes: 3, StorageURI: "s3://bucket/lab1.csv", AuthorID: "doctor1", AttachedAt: "2025-03-28T12:00:00Z"},
+		{EMRID: "emr1", DocID: "xray1", MediaType: "application/pdf", SHA256: contentHash("%PDF-1.7"), SizeBytes: 8, StorageURI: "s3://bucket/xray1.pdf", AuthorID: "doctor1", AttachedAt: "2025-03-29T12:00:00Z"},
+	}
+	for _, attachment := range attachments {
+		attachmentJSON, _ := json.Marshal(attachment)
+		mockResultsIterator.On("Next").Return(&queryresult.KV{Value: attachmentJSON}, nil).Once()
+	}
+	mockResultsIterator.On("HasNext").Return(true).Times(len(attachments))
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetStateByPartialCompositeKey", "attachment", []string{"emr1"}).Return(mockResultsIterator, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.ListAttachments(ctx, "emr1")
+	assert.NoError(t, err)
+	assert.Equal(t, attachments, result)
+
+	mockResultsIterator.AssertExpectations(t)
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// wrappedKeyStateKey returns the composite key of the data key of a record wrapped for a party
+func wrappedKeyStateKey(emrID string, partyID string) string {
+	key, _ := shim.CreateCompositeKey("wrappedkey", []string{emrID, partyID})
+	return key
+}
+
+// Encrypted records should store the ciphertext and the data key wrapped for each party of the record
+func TestCreateEncryptedRecord(t *testing.T) {
+	chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("ciphertext1"))
+	wrappedKeys := map[string]string{
+		"patient":  base64.StdEncoding.EncodeToString([]byte("key-patient1")),
+		"doctor":   base64.StdEncoding.EncodeToString([]byte("key-doctor1")),
+		"hospital": base64.StdEncoding.EncodeToString([]byte("key-hospital1")),
+	}
+	wrappedKeysJSON, _ := json.Marshal(wrappedKeys)
+
+	mockStub.On("GetState", userStateKey("patient1@orgName.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","commonName":"patient1@orgName.example.com"}`), nil)
+	mockStub.On("GetState", userStateKey("hospital1@orgName.example.com")).Return([]byte(`{"userId":"hospital1","role":"hospital","commonName":"hospital1@orgName.example.com"}`), nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+
+	emrExpected := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		ContentHash:         contentHash(ciphertext),
+		Collection:          "Org1MSPPrivateCollection",
+		Encrypted:           true,
+		CreatedOn:           "2025-04-01T12:00:00Z",
+		LastModified:        "2025-04-01T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+		Versions: []RecordVersion{
+			{Version: 1, Type: "original", ContentHash: contentHash(ciphertext), AuthorID: "doctor1", Timestamp: "2025-04-01T12:00:00Z"},
+		},
+	}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(ciphertext), "wrappedKeys": wrappedKeysJSON}, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(nil, nil)
+	for role, partyID := range map[string]string{"patient": "patient1", "doctor": "doctor1", "hospital": "hospital1"} {
+		wrappedKeyJSON, _ := json.Marshal(WrappedKey{EMRID: "emr1", PartyID: partyID, WrappedKey: wrappedKeys[role]})
+		mockStub.On("PutState", wrappedKeyStateKey("emr1", partyID), wrappedKeyJSON).Return(nil)
+	}
+	mockStub.On("PutPrivateData", "Org1MSPPrivateCollection", contentStateKey("emr1", 1), []byte(ciphertext)).Return(nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", patientIndexStateKey("patient1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("doctor1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("hospital1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("SetEvent", "RecordCreated", eventPayload(RecordCreatedEvent{EMRID: "emr1", PatientID: "patient1", DoctorID: "doctor1", HospitalID: "hospital1"})).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Encrypted records should be refused when their content is not base64 or a party has no wrapped key
+func TestCreateEncryptedRecordInvalid(t *testing.T) {
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("ciphertext1"))
+	wrappedKey := base64.StdEncoding.EncodeToString([]byte("key"))
+
+	tests := []struct {
+		name        string
+		content     string
+		wrappedKeys string
+		expected    string
+	}{
+		{"plaintext content", clinicalData1, `{"patient":"` + wrappedKey + `","doctor":"` + wrappedKey + `"}`, "invalid encrypted content: it must be base64 encoded"},
+		{"invalid wrapped keys", ciphertext, `["` + wrappedKey + `"]`, "failed to unmarshal wrapped keys: json: cannot unmarshal array into Go value of type map[string]string"},
+		{"missing party", ciphertext, `{"patient":"` + wrappedKey + `"}`, "the key of an encrypted record must be wrapped for its doctor"},
+		{"unknown party", ciphertext, `{"patient":"` + wrappedKey + `","doctor":"` + wrappedKey + `","hospital":"` + wrappedKey + `"}`, "a key is wrapped for the hospital of a record that has none"},
+		{"invalid wrapped key", ciphertext, `{"patient":"not base64!","doctor":"` + wrappedKey + `"}`, "invalid wrapped key: it must be base64 encoded"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			// The record has no hospital
+			mockStub.On("GetState", userStateKey("patient1@orgName.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","commonName":"patient1@orgName.example.com"}`), nil).Maybe()
+			mockStub.On("GetState", userStateKey("hospital1@orgName.example.com")).Return(nil, nil).Maybe()
+			mockStub.On("GetState", emrStateKey("emr1")).Return(nil, nil).Maybe()
+			mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(test.content), "wrappedKeys": []byte(test.wrappedKeys)}, nil)
+			mockStub.On("PutState", wrappedKeyStateKey("emr1", "patient1"), mock.Anything).Return(nil).Maybe()
+			mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil).Maybe()
+			mockClientIdentity.On("GetID").Return("doctor1", nil).Maybe()
+			mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.CreateRecord(ctx, "emr1", "patient1@orgName.example.com", "doctor1@orgName.example.com", "hospital1@orgName.example.com")
+			assert.EqualError(t, err, test.expected)
+
+			mockStub.AssertNotCalled(t, "PutPrivateData", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// Amendments of encrypted records should be ciphertext as well
+func TestUpdateEncryptedRecordPlaintext(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		Collection:          "Org1MSPPrivateCollection",
+		Encrypted:           true,
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+		Versions:            []RecordVersion{{Version: 1, Type: "original", AuthorID: "doctor1"}},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetState", denyStateKey("patient1", "doctor1")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return(nil, nil)
+	mockStub.On("GetTransient").Return(map[string][]byte{"content": []byte(clinicalData2)}, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UpdateRecord(ctx, "emr1", "lab results")
+	assert.EqualError(t, err, "invalid encrypted content: it must be base64 encoded")
+
+	mockStub.AssertNotCalled(t, "PutPrivateData", mock.Anything, mock.Anything, mock.Anything)
+}
+
+// Sharing an encrypted record should store the data key wrapped for the grantee
+func TestShareEncryptedRecord(t *testing.T) {
+	emrBase := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		Encrypted:           true,
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.SharedWithDoctors = []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-04-01T12:00:00Z", Permissions: []string{"read"}}}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	wrappedKey := base64.StdEncoding.EncodeToString([]byte("key-doctor2"))
+	wrappedKeyJSON, _ := json.Marshal(WrappedKey{EMRID: "emr1", PartyID: "doctor2", WrappedKey: wrappedKey})
+
+	tests := []struct {
+		name      string
+		transient map[string][]byte
+		expected  string
+	}{
+		{"wrapped key", map[string][]byte{"wrappedKey": []byte(wrappedKey)}, ""},
+		{"missing wrapped key", map[string][]byte{}, `the key of an encrypted record must be wrapped for the grantee and passed in the transient map under the "wrappedKey" key`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+			mockClientIdentity.On("GetID").Return("patient1", nil)
+			mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+			mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+			mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","commonName":"doctor2@orgName.example.com"}`), nil)
+			mockStub.On("GetTransient").Return(test.transient, nil)
+			if test.expected == "" {
+				mockStub.On("PutState", wrappedKeyStateKey("emr1", "doctor2"), wrappedKeyJSON).Return(nil)
+				mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+				mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+				mockStub.On("SetEvent", "RecordShared", eventPayload(RecordSharedEvent{EMRID: "emr1", PatientID: "patient1", GrantorID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
+			}
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.ShareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor", 0, "")
+			if test.expected == "" {
+				assert.NoError(t, err)
+				mockStub.AssertExpectations(t)
+			} else {
+				assert.EqualError(t, err, test.expected)
+				mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+// Consent directives, proxies and emergency access should not give access to encrypted records, whose keys they cannot get
+func TestEncryptedRecordIndirectAccess(t *testing.T) {
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Encrypted:           true,
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	ctx := &mockTransactionContext{stub: mockStub}
+
+	// Neither the directives nor the proxy are looked up
+	assert.False(t, authorized(chaincode.isAuthorizedToRead(ctx, "doctor", "doctor2", &emr, txTimestamp)))
+	assert.False(t, authorized(chaincode.isAuthorizedToRead(ctx, "patient", "guardian1", &emr, txTimestamp)))
+	mockStub.AssertNotCalled(t, "GetStateByPartialCompositeKey", mock.Anything, mock.Anything)
+	mockStub.AssertNotCalled(t, "GetState", mock.Anything)
+
+	mockClientIdentity := new(MockClientIdentity)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockClientIdentity.On("GetID").Return("doctor2", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	ctx.clientIdentity = mockClientIdentity
+
+	result, err := chaincode.EmergencyAccess(ctx, "emr1", "unconscious patient")
+	assert.EqualError(t, err, "record with ID emr1 is encrypted, emergency access cannot give its key")
+	assert.Nil(t, result)
+	mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+}
+
+// Revoking the last grant of a grantee on an encrypted record should delete its wrapped key
+func TestUnshareEncryptedRecordDeletesWrappedKey(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emrBase := EMR{
+		EMRID:     "emr1",
+		PatientID: "patient1",
+		DoctorID:  "doctor1",
+		Encrypted: true,
+		SharedWithDoctors: []Grant{
+			{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}},
+		},
+		SharedWithHospitals: []Grant{},
+	}
+	emrBaseJSON, _ := json.Marshal(emrBase)
+
+	emrExpected := emrBase
+	emrExpected.SharedWithDoctors = []Grant{}
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrBaseJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetState", userStateKey("doctor2@orgName.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","commonName":"doctor2@orgName.example.com"}`), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("DelState", granteeIndexStateKey("doctor2", "emr1")).Return(nil)
+	mockStub.On("DelState", wrappedKeyStateKey("emr1", "doctor2")).Return(nil)
+	mockStub.On("SetEvent", "RecordUnshared", eventPayload(RecordUnsharedEvent{EMRID: "emr1", PatientID: "patient1", RevokerID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor"})).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.UnshareRecord(ctx, "emr1", "doctor2@orgName.example.com", "doctor")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Clients that can read an encrypted record should get the data key wrapped for them
+func TestGetWrappedKey(t *testing.T) {
+	emr := EMR{
+		EMRID:     "emr1",
+		PatientID: "patient1",
+		DoctorID:  "doctor1",
+		Encrypted: true,
+		SharedWithDoctors: []Grant{
+			{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}},
+		},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+	plainEMR := emr
+	plainEMR.Encrypted = false
+	plainEMRJSON, _ := json.Marshal(plainEMR)
+
+	wrappedKey := base64.StdEncoding.EncodeToString([]byte("key-patient1"))
+	wrappedKeyJSON, _ := json.Marshal(WrappedKey{EMRID: "emr1", PartyID: "patient1", WrappedKey: wrappedKey})
+
+	tests := []struct {
+		name       string
+		emrJSON    []byte
+		wrappedKey []byte
+		expected   string
+	}{
+		{"wrapped key", emrJSON, wrappedKeyJSON, ""},
+		{"no wrapped key", emrJSON, nil, "no key of record with ID emr1 is wrapped for this client"},
+		{"not encrypted", plainEMRJSON, nil, "record with ID emr1 is not encrypted"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+			mockClientIdentity.On("GetID").Return("patient1", nil)
+			mockStub.On("GetState", emrStateKey("emr1")).Return(test.emrJSON, nil)
+			mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+			mockStub.On("GetState", wrappedKeyStateKey("emr1", "patient1")).Return(test.wrappedKey, nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			result, err := chaincode.GetWrappedKey(ctx, "emr1")
+			if test.expected == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, wrappedKey, result)
+			} else {
+				assert.EqualError(t, err, test.expected)
+			}
+		})
+	}
+}
+
+// Admins should be able to suspend a user, the client ID mapping lets the chaincode check the status of callers
+func TestSetUserStatus(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	// Users registered before statuses existed have no status
+	mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	mockClientIdentity.On("GetID").Return("admin1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","mspId":"Org1MSP"}`), nil)
+	mockStub.On("PutState", userStateKey("doctor2@org1.example.com"), []byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","status":"suspended","mspId":"Org1MSP"}`)).Return(nil)
+	mockStub.On("PutState", userIDStateKey("doctor2"), []byte("doctor2@org1.example.com")).Return(nil)
+	mockStub.On("SetEvent", "UserStatusChanged", []byte(`{"userId":"doctor2","status":"suspended","changedBy":"admin1"}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.SetUserStatus(ctx, "doctor2@org1.example.com", "suspended")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Only admins should change user statuses, and only to a different valid status
+func TestSetUserStatusInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		role       string
+		commonName string
+		status     string
+		expected   string
+	}{
+		{"doctor", "doctor", "doctor2@org1.example.com", "suspended", "only admins can change user statuses"},
+		{"invalid status", "admin", "doctor2@org1.example.com", "retired", "invalid user status: retired"},
+		{"own status", "admin", "admin1@org1.example.com", "deactivated", "an admin cannot change their own status"},
+		{"already active", "admin", "doctor2@org1.example.com", "active", "user with CommonName doctor2@org1.example.com is already active"},
+		{"already suspended", "admin", "doctor3@org1.example.com", "suspended", "user with CommonName doctor3@org1.example.com is already suspended"},
+		{"another org", "admin", "patient1@org2.example.com", "suspended", "this admin is not authorized to manage users of another org"},
+		{"no org", "admin", "patient2@org2.example.com", "suspended", "user with CommonName patient2@org2.example.com has no org, it must be repaired with RepairUser first"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return(test.role, true, nil)
+			mockClientIdentity.On("GetID").Return("admin1", nil).Maybe()
+			mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil).Maybe()
+			mockStub.On("GetState", userStateKey("admin1@org1.example.com")).Return([]byte(`{"userId":"admin1","role":"admin","CommonName":"admin1@org1.example.com","status":"active","mspId":"Org1MSP"}`), nil).Maybe()
+			mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","mspId":"Org1MSP"}`), nil).Maybe()
+			mockStub.On("GetState", userStateKey("doctor3@org1.example.com")).Return([]byte(`{"userId":"doctor3","role":"doctor","CommonName":"doctor3@org1.example.com","status":"suspended","mspId":"Org1MSP"}`), nil).Maybe()
+			mockStub.On("GetState", userStateKey("patient1@org2.example.com")).Return([]byte(`{"userId":"patient1","role":"patient","CommonName":"patient1@org2.example.com","mspId":"Org2MSP"}`), nil).Maybe()
+			mockStub.On("GetState", userStateKey("patient2@org2.example.com")).Return([]byte(`{"userId":"patient2","role":"patient","CommonName":"patient2@org2.example.com"}`), nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.SetUserStatus(ctx, test.commonName, test.status)
+			assert.EqualError(t, err, test.expected)
+
+			mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// Transactions should be rejected before they run when the caller is not active or its certificate was unlinked,
+// and certificates linked to a user should get the stable ID of the user
+func TestResolveCaller(t *testing.T) {
+	tests := []struct {
+		name          string
+		certificateID string
+		role          string
+		user          []byte // User mapped to the certificate ID, nil when the client is not registered
+		expectedID    string
+		expected      string
+	}{
+		{"not registered", "doctor1", "doctor", nil, "doctor1", ""},
+		{"registered before statuses", "doctor1", "doctor", []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com"}`), "doctor1", ""},
+		{"active", "doctor1", "doctor", []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","status":"active","certificateIds":["doctor1"]}`), "doctor1", ""},
+		{"suspended", "doctor1", "doctor", []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","status":"suspended"}`), "", "user with CommonName doctor1@org1.example.com is suspended"},
+		{"deactivated", "doctor1", "doctor", []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","status":"deactivated"}`), "", "user with CommonName doctor1@org1.example.com is deactivated"},
+		{"linked certificate", "cert2", "doctor", []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","status":"active","certificateIds":["doctor1","cert2"]}`), "doctor1", ""},
+		{"unlinked certificate", "doctor1", "doctor", []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","status":"active","certificateIds":["cert2"]}`), "", "this certificate is no longer linked to user with CommonName doctor1@org1.example.com"},
+		{"linked certificate of another role", "cert2", "hospital", []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","status":"active","certificateIds":["doctor1","cert2"]}`), "", "this certificate does not have the role of user with CommonName doctor1@org1.example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetID").Return(test.certificateID, nil)
+			mockClientIdentity.On("GetAttributeValue", "role").Return(test.role, true, nil).Maybe()
+			if test.user != nil {
+				mockStub.On("GetState", userIDStateKey(test.certificateID)).Return([]byte("doctor1@org1.example.com"), nil)
+				mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return(test.user, nil)
+			} else {
+				mockStub.On("GetState", userIDStateKey(test.certificateID)).Return(nil, nil)
+			}
+
+			// The hook gets the context contractapi creates for each transaction
+			ctx := new(contractapi.TransactionContext)
+			ctx.SetStub(mockStub)
+			ctx.SetClientIdentity(mockClientIdentity)
+
+			err := chaincode.resolveCaller(ctx)
+			if test.expected == "" {
+				assert.NoError(t, err)
+				clientID, _ := ctx.GetClientIdentity().GetID()
+				assert.Equal(t, test.expectedID, clientID)
+			} else {
+				assert.EqualError(t, err, test.expected)
+			}
+
+			mockClientIdentity.AssertExpectations(t)
+			mockStub.AssertExpectations(t)
+		})
+	}
+}
+
+// Grants held by users that are not active should be ignored
+func TestInactiveGranteeHoldsNoPermission(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+
+	emr := EMR{
+		EMRID:     "emr1",
+		PatientID: "patient1",
+		DoctorID:  "doctor1",
+		SharedWithDoctors: []Grant{
+			{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read", "share"}},
+		},
+		SharedWithHospitals: []Grant{},
+	}
+
+	mockNoConsentDirectives(mockStub, "patient1", "doctor2")
+	mockStub.On("GetState", denyStateKey("patient1", "doctor2")).Return(nil, nil)
+	mockStub.On("GetState", userIDStateKey("doctor2")).Return([]byte("doctor2@org1.example.com"), nil)
+	mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","status":"deactivated"}`), nil)
+
+	ctx := &mockTransactionContext{stub: mockStub}
+
+	assert.False(t, authorized(chaincode.isAuthorizedToRead(ctx, "doctor", "doctor2", &emr, txTimestamp)))
+
+	mockStub.AssertExpectations(t)
+}
+
+// Records should not be shared with users that are not active
+func TestShareRecordInactiveGrantee(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("patient", true, nil)
+	mockClientIdentity.On("GetID").Return("patient1", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetTxTimestamp").Return(timestamppb.New(txTimestamp), nil)
+	mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","status":"suspended"}`), nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ShareRecord(ctx, "emr1", "doctor2@org1.example.com", "doctor", 0, "")
+	assert.EqualError(t, err, "user with CommonName doctor2@org1.example.com is suspended and cannot be given access")
+
+	mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+}
+
+// certificateLinkStateKey returns the composite key of a pending certificate link
+func certificateLinkStateKey(commonName string, certificateID string) string {
+	key, _ := shim.CreateCompositeKey("certlink", []string{certificateID, commonName})
+	return key
+}
+
+// mockPendingCertificateLinks mocks the pending links of a certificate
+func mockPendingCertificateLinks(mockStub *MockStub, certificateID string, links ...CertificateLink) *mock.Call {
+	mockResultsIterator := new(MockResultsIterator)
+	for _, link := range links {
+		linkJSON, _ := json.Marshal(link)
+		mockResultsIterator.On("Next").Return(&queryresult.KV{Value: linkJSON}, nil).Once()
+	}
+	mockResultsIterator.On("HasNext").Return(len(links) > 0).Once()
+	mockResultsIterator.On("Close").Return(nil)
+	return mockStub.On("GetStateByPartialCompositeKey", "certlink", []string{certificateID}).Return(mockResultsIterator, nil)
+}
+
+// A re-enrolled certificate should be able to request a link to its user
+func TestLinkCertificate(t *testing.T) {
+	chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetID").Return("cert2", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+	mockStub.On("GetState", userIDStateKey("cert2")).Return(nil, nil)
+	mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return([]byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP","certificateIds":["doctor1"]}`), nil)
+	mockPendingCertificateLinks(mockStub, "cert2")
+	mockStub.On("PutState", certificateLinkStateKey("doctor1@org1.example.com", "cert2"), []byte(`{"CommonName":"doctor1@org1.example.com","certificateId":"cert2","requestedAt":"2025-04-01T12:00:00Z"}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.LinkCertificate(ctx, "doctor1@org1.example.com")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Certificates already linked to a user or from another org should not be able to request a link
+func TestLinkCertificateInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		linked   []byte // CommonName the certificate is already mapped to
+		mspID    string
+		role     string
+		pending  []CertificateLink
+		expected string
+	}{
+		{"already linked", []byte("doctor2@org1.example.com"), "Org1MSP", "doctor", nil, "this certificate is already linked to user with CommonName doctor2@org1.example.com"},
+		{"another org", nil, "Org2MSP", "doctor", nil, "this certificate cannot be linked to a user of another org"},
+		{"another role", nil, "Org1MSP", "hospital", nil, "this certificate cannot be linked to a user with another role"},
+		{"already requested", nil, "Org1MSP", "doctor", []CertificateLink{{CommonName: "doctor1@org1.example.com", CertificateID: "cert2"}}, "this certificate is already waiting to be linked to user with CommonName doctor1@org1.example.com"},
+		{"requested for another user", nil, "Org1MSP", "doctor", []CertificateLink{{CommonName: "doctor2@org1.example.com", CertificateID: "cert2"}}, "this certificate is already waiting to be linked to user with CommonName doctor2@org1.example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetID").Return("cert2", nil)
+			mockClientIdentity.On("GetMSPID").Return(test.mspID, nil).Maybe()
+			mockClientIdentity.On("GetAttributeValue", "role").Return(test.role, true, nil).Maybe()
+			mockStub.On("GetState", userIDStateKey("cert2")).Return(test.linked, nil)
+			mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","mspId":"Org1MSP"}`), nil).Maybe()
+			mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return([]byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP"}`), nil).Maybe()
+			mockPendingCertificateLinks(mockStub, "cert2", test.pending...).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.LinkCertificate(ctx, "doctor1@org1.example.com")
+			assert.EqualError(t, err, test.expected)
+
+			mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// Admins of the user's org should be able to approve a requested certificate link
+func TestApproveCertificateLink(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	mockClientIdentity.On("GetID").Return("admin1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return([]byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP"}`), nil)
+	mockStub.On("GetState", certificateLinkStateKey("doctor1@org1.example.com", "cert2")).Return([]byte(`{"CommonName":"doctor1@org1.example.com","certificateId":"cert2","requestedAt":"2025-04-01T12:00:00Z"}`), nil)
+	mockStub.On("DelState", certificateLinkStateKey("doctor1@org1.example.com", "cert2")).Return(nil)
+	mockStub.On("GetState", userIDStateKey("cert2")).Return(nil, nil)
+
+	// Users registered before certificates could be linked keep their registration certificate
+	mockStub.On("PutState", userStateKey("doctor1@org1.example.com"), []byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP","certificateIds":["doctor1","cert2"]}`)).Return(nil)
+	mockStub.On("PutState", userIDStateKey("cert2"), []byte("doctor1@org1.example.com")).Return(nil)
+	mockStub.On("SetEvent", "CertificateLinked", []byte(`{"userId":"doctor1","certificateId":"cert2","approvedBy":"admin1"}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ApproveCertificateLink(ctx, "doctor1@org1.example.com", "cert2")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Only admins of the user's org should approve certificate links, and only links that were requested
+func TestApproveCertificateLinkInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		mspID    string
+		pending  []byte
+		linked   []byte // CommonName the certificate was mapped to after the link was requested
+		expected string
+	}{
+		{"doctor", "doctor", "Org1MSP", []byte(`{}`), nil, "only admins can manage the certificates of users"},
+		{"admin of another org", "admin", "Org2MSP", []byte(`{}`), nil, "this admin is not authorized to manage users of another org"},
+		{"not requested", "admin", "Org1MSP", nil, nil, "no link of certificate cert2 to user with CommonName doctor1@org1.example.com was requested"},
+		{"registered since requested", "admin", "Org1MSP", []byte(`{}`), []byte("doctor2@org1.example.com"), "certificate cert2 is already linked to user with CommonName doctor2@org1.example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return(test.role, true, nil)
+			mockClientIdentity.On("GetID").Return("admin1", nil).Maybe()
+			mockClientIdentity.On("GetMSPID").Return(test.mspID, nil).Maybe()
+			mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return([]byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP"}`), nil).Maybe()
+			mockStub.On("GetState", certificateLinkStateKey("doctor1@org1.example.com", "cert2")).Return(test.pending, nil).Maybe()
+			mockStub.On("GetState", userIDStateKey("cert2")).Return(test.linked, nil).Maybe()
+			mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"cert2","role":"doctor","CommonName":"doctor2@org1.example.com","mspId":"Org1MSP"}`), nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.ApproveCertificateLink(ctx, "doctor1@org1.example.com", "cert2")
+			assert.EqualError(t, err, test.expected)
+
+			mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// Admins of the user's org should be able to unlink any certificate of a user but its last one
+func TestUnlinkCertificate(t *testing.T) {
+	tests := []struct {
+		name          string
+		certificateID string
+		user          string
+		expectedUser  string
+		expected      string
+	}{
+		{"registration certificate", "doctor1", `{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP","certificateIds":["doctor1","cert2"]}`,
+			`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP","certificateIds":["cert2"]}`, ""},
+		{"not linked", "cert3", `{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP","certificateIds":["doctor1","cert2"]}`,
+			"", "certificate cert3 is not linked to user with CommonName doctor1@org1.example.com"},
+		{"last certificate", "doctor1", `{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP"}`,
+			"", "the last certificate of user with CommonName doctor1@org1.example.com cannot be unlinked"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+			mockClientIdentity.On("GetID").Return("admin1", nil)
+			mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+			mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return([]byte(test.user), nil)
+			if test.expected == "" {
+				// The certificate stays mapped to the user so that it is rejected
+				mockStub.On("PutState", userStateKey("doctor1@org1.example.com"), []byte(test.expectedUser)).Return(nil)
+				mockStub.On("PutState", userIDStateKey(test.certificateID), []byte("doctor1@org1.example.com")).Return(nil)
+				mockStub.On("SetEvent", "CertificateUnlinked", []byte(`{"userId":"doctor1","certificateId":"`+test.certificateID+`","unlinkedBy":"admin1"}`)).Return(nil)
+			}
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.UnlinkCertificate(ctx, "doctor1@org1.example.com", test.certificateID)
+			if test.expected == "" {
+				assert.NoError(t, err)
+				mockStub.AssertExpectations(t)
+			} else {
+				assert.EqualError(t, err, test.expected)
+				mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+// Admins should only list the users of their own org
+func TestListUsers(t *testing.T) {
+	users := []User{
+		{UserID: "doctor1", Role: "doctor", CommonName: "doctor1@org1.example.com", Status: "active", MSPID: "Org1MSP"},
+		{UserID: "hospital1", Role: "hospital", CommonName: "hospital1@org1.example.com", Status: "active", MSPID: "Org1MSP"},
+		{UserID: "patient1", Role: "patient", CommonName: "patient1@org2.example.com", Status: "active", MSPID: "Org2MSP"},
+		{UserID: "doctor2", Role: "doctor", CommonName: "doctor2@org1.example.com", Status: "suspended", MSPID: "Org1MSP"},
+	}
+
+	tests := []struct {
+		name     string
+		role     string
+		expected []User
+	}{
+		{"all roles", "", []User{users[0], users[1], users[3]}},
+		{"doctors", "doctor", []User{users[0], users[3]}},
+		{"patients of another org", "patient", []User{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+			mockResultsIterator := new(MockResultsIterator)
+
+			for _, user := range users {
+				userJSON, _ := json.Marshal(user)
+				mockResultsIterator.On("Next").Return(&queryresult.KV{Key: userStateKey(user.CommonName), Value: userJSON}, nil).Once()
+			}
+			mockResultsIterator.On("HasNext").Return(true).Times(len(users))
+			mockResultsIterator.On("HasNext").Return(false).Once()
+			mockResultsIterator.On("Close").Return(nil)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+			mockClientIdentity.On("GetID").Return("admin1", nil)
+			mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+			mockStub.On("GetStateByPartialCompositeKey", "user", []string{}).Return(mockResultsIterator, nil)
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			result, err := chaincode.ListUsers(ctx, test.role)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, result)
+
+			mockResultsIterator.AssertExpectations(t)
+			mockStub.AssertExpectations(t)
+		})
+	}
+}
+
+// Only admins should list users
+func TestListUsersNotAdmin(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockClientIdentity := new(MockClientIdentity)
+	mockClientIdentity.On("GetAttributeValue", "role").Return("doctor", true, nil)
+
+	ctx := &mockTransactionContext{
+		stub:           new(MockStub),
+		clientIdentity: mockClientIdentity,
+	}
+
+	result, err := chaincode.ListUsers(ctx, "")
+	assert.EqualError(t, err, "only admins can list users")
+	assert.Nil(t, result)
+}
+
+// Force-deactivating a user should revoke every grant and consent directive it holds, including wrapped keys of encrypted records
+func TestDeactivateUser(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+	mockResultsIterator := new(MockResultsIterator)
+	mockConsentIterator := new(MockResultsIterator)
+
+	// Only the directive given to doctor2 is withdrawn
+	directives := []ConsentDirective{
+		{DirectiveID: "tx1", PatientID: "patient1", GranteeID: "doctor2", GranteeRole: "doctor", Scope: consentScopeAll, Permissions: []string{"read"}},
+		{DirectiveID: "tx2", PatientID: "patient1", GranteeID: "doctor3", GranteeRole: "doctor", Scope: consentScopeAll, Permissions: []string{"read"}},
+	}
+	for _, directive := range directives {
+		directiveJSON, _ := json.Marshal(directive)
+		mockConsentIterator.On("Next").Return(&queryresult.KV{Key: consentStateKey(directive.PatientID, directive.GranteeID, directive.DirectiveID), Value: directiveJSON}, nil).Once()
+	}
+	mockConsentIterator.On("HasNext").Return(true).Times(len(directives))
+	mockConsentIterator.On("HasNext").Return(false).Once()
+	mockConsentIterator.On("Close").Return(nil)
+	mockStub.On("GetStateByPartialCompositeKey", "consent", []string{}).Return(mockConsentIterator, nil)
+	mockStub.On("DelState", consentStateKey("patient1", "doctor2", "tx1")).Return(nil)
+
+	// Only the proxy held by doctor2 is removed
+	mockProxyIterator := new(MockResultsIterator)
+	proxies := []Proxy{
+		{PatientID: "patient1", ProxyID: "doctor2", Scope: []string{"read"}, GrantedBy: "patient1", GrantedAt: "2025-03-27T12:00:00Z"},
+		{PatientID: "patient2", ProxyID: "doctor3", Scope: []string{"read"}, GrantedBy: "patient2", GrantedAt: "2025-03-27T12:00:00Z"},
+	}
+	for _, proxy := range proxies {
+		proxyJSON, _ := json.Marshal(proxy)
+		mockProxyIterator.On("Next").Return(&queryresult.KV{Key: proxyStateKey(proxy.PatientID, proxy.ProxyID), Value: proxyJSON}, nil).Once()
+	}
+	mockProxyIterator.On("HasNext").Return(true).Times(len(proxies))
+	mockProxyIterator.On("HasNext").Return(false).Once()
+	mockProxyIterator.On("Close").Return(nil)
+	mockStub.On("GetStateByPartialCompositeKey", "proxy", []string{}).Return(mockProxyIterator, nil)
+	mockStub.On("DelState", proxyStateKey("patient1", "doctor2")).Return(nil)
+
+	emr1 := EMR{
+		EMRID:     "emr1",
+		PatientID: "patient1",
+		DoctorID:  "doctor1",
+		SharedWithDoctors: []Grant{
+			{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}},
+			{GrantorID: "patient1", GranteeID: "doctor3", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}},
+		},
+		SharedWithHospitals: []Grant{},
+	}
+	emr1JSON, _ := json.Marshal(emr1)
+	emr1Expected := emr1
+	emr1Expected.SharedWithDoctors = []Grant{emr1.SharedWithDoctors[1]}
+	emr1ExpectedJSON, _ := json.Marshal(emr1Expected)
+
+	// doctor2 holds both a doctor and a hospital grant on the encrypted emr2
+	emr2 := EMR{
+		EMRID:               "emr2",
+		PatientID:           "patient2",
+		DoctorID:            "doctor1",
+		Encrypted:           true,
+		SharedWithDoctors:   []Grant{{GrantorID: "patient2", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}}},
+		SharedWithHospitals: []Grant{{GrantorID: "patient2", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}}},
+	}
+	emr2JSON, _ := json.Marshal(emr2)
+	emr2Expected := emr2
+	emr2Expected.SharedWithDoctors = []Grant{}
+	emr2Expected.SharedWithHospitals = []Grant{}
+	emr2ExpectedJSON, _ := json.Marshal(emr2Expected)
+
+	mockResultsIterator.On("HasNext").Return(true).Times(2)
+	mockResultsIterator.On("HasNext").Return(false).Once()
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: granteeIndexStateKey("doctor2", "emr1")}, nil).Once()
+	mockResultsIterator.On("Next").Return(&queryresult.KV{Key: granteeIndexStateKey("doctor2", "emr2")}, nil).Once()
+	mockResultsIterator.On("Close").Return(nil)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	mockClientIdentity.On("GetID").Return("admin1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","status":"suspended","mspId":"Org1MSP"}`), nil)
+	mockStub.On("GetStateByPartialCompositeKey", "grantee~emr", []string{"doctor2"}).Return(mockResultsIterator, nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emr1JSON, nil)
+	mockStub.On("GetState", emrStateKey("emr2")).Return(emr2JSON, nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emr1ExpectedJSON).Return(nil)
+	mockStub.On("PutState", emrStateKey("emr2"), emr2ExpectedJSON).Return(nil)
+	mockStub.On("DelState", granteeIndexStateKey("doctor2", "emr1")).Return(nil)
+	mockStub.On("DelState", granteeIndexStateKey("doctor2", "emr2")).Return(nil)
+	mockStub.On("DelState", wrappedKeyStateKey("emr2", "doctor2")).Return(nil)
+	mockStub.On("PutState", userStateKey("doctor2@org1.example.com"), []byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","status":"deactivated","mspId":"Org1MSP"}`)).Return(nil)
+	mockStub.On("PutState", userIDStateKey("doctor2"), []byte("doctor2@org1.example.com")).Return(nil)
+	mockStub.On("SetEvent", "UserStatusChanged", []byte(`{"userId":"doctor2","status":"deactivated","changedBy":"admin1"}`)).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	revoked, err := chaincode.DeactivateUser(ctx, "doctor2@org1.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, revoked)
+
+	mockResultsIterator.AssertExpectations(t)
+	mockConsentIterator.AssertExpectations(t)
+	mockProxyIterator.AssertExpectations(t)
+	mockStub.AssertNotCalled(t, "DelState", consentStateKey("patient1", "doctor3", "tx2"))
+	mockStub.AssertNotCalled(t, "DelState", proxyStateKey("patient2", "doctor3"))
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Admins should be able to hand a record over to another doctor of their org
+func TestReassignRecordOwner(t *testing.T) {
+	chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		HospitalID:          "hospital1",
+		Collection:          "Org1MSPPrivateCollection",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+	emrExpected := emr
+	emrExpected.DoctorID = "doctor2"
+	emrExpected.LastModified = "2025-04-01T12:00:00Z"
+	emrExpectedJSON, _ := json.Marshal(emrExpected)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	mockClientIdentity.On("GetID").Return("admin1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","status":"active","mspId":"Org1MSP"}`), nil)
+	mockStub.On("PutState", emrStateKey("emr1"), emrExpectedJSON).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("DelState", ownerIndexStateKey("doctor1", "emr1")).Return(nil)
+	mockStub.On("SetEvent", "RecordReassigned", eventPayload(RecordReassignedEvent{EMRID: "emr1", PatientID: "patient1", OwnerRole: "doctor", PreviousOwnerID: "doctor1", OwnerID: "doctor2", ReassignedBy: "admin1"})).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.ReassignRecordOwner(ctx, "emr1", "doctor", "doctor2@org1.example.com")
+	assert.NoError(t, err)
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Records should only be reassigned within the admin's org, to an active user of the right role
+func TestReassignRecordOwnerInvalid(t *testing.T) {
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		Collection:          "Org1MSPPrivateCollection",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	tests := []struct {
+		name       string
+		mspID      string
+		ownerRole  string
+		commonName string
+		expected   string
+	}{
+		{"invalid role", "Org1MSP", "patient", "patient1@org2.example.com", "invalid owner role: patient"},
+		{"record of another org", "Org2MSP", "doctor", "doctor3@org2.example.com", "this admin is not authorized to manage records of another org"},
+		{"user of another org", "Org1MSP", "doctor", "doctor3@org2.example.com", "this admin is not authorized to manage users of another org"},
+		{"wrong role", "Org1MSP", "doctor", "hospital1@org1.example.com", "user with CommonName hospital1@org1.example.com is not a doctor"},
+		{"inactive owner", "Org1MSP", "doctor", "doctor2@org1.example.com", "user with CommonName doctor2@org1.example.com is deactivated and cannot own records"},
+		{"current owner", "Org1MSP", "doctor", "doctor1@org1.example.com", "user with CommonName doctor1@org1.example.com already owns record with ID emr1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := &EMRChaincode{clock: fixedClock(txTimestamp)}
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+			mockClientIdentity.On("GetID").Return("admin1", nil)
+			mockClientIdentity.On("GetMSPID").Return(test.mspID, nil)
+			mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil).Maybe()
+			mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return([]byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP"}`), nil).Maybe()
+			mockStub.On("GetState", userStateKey("doctor2@org1.example.com")).Return([]byte(`{"userId":"doctor2","role":"doctor","CommonName":"doctor2@org1.example.com","status":"deactivated","mspId":"Org1MSP"}`), nil).Maybe()
+			mockStub.On("GetState", userStateKey("doctor3@org2.example.com")).Return([]byte(`{"userId":"doctor3","role":"doctor","CommonName":"doctor3@org2.example.com","mspId":"Org2MSP"}`), nil).Maybe()
+			mockStub.On("GetState", userStateKey("hospital1@org1.example.com")).Return([]byte(`{"userId":"hospital1","role":"hospital","CommonName":"hospital1@org1.example.com","mspId":"Org1MSP"}`), nil).Maybe()
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.ReassignRecordOwner(ctx, "emr1", test.ownerRole, test.commonName)
+			assert.EqualError(t, err, test.expected)
+
+			mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// Admins should be able to complete the entries of users registered by earlier versions of the chaincode
+// legacyClientID returns the client ID cid derives from a certificate of the given subject issued by the CA of an org
+func legacyClientID(subject string, org string) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("x509::%s::CN=ca.%s.example.com,O=%s.example.com", subject, org, org)))
+}
+
+func TestRepairUser(t *testing.T) {
+	doctorID := legacyClientID("CN=doctor1,OU=client", "org1")
+	tests := []struct {
+		name     string
+		mspID    string
+		issuer   string // Org whose CA issued the admin's certificate
+		expected string
+	}{
+		{"user of the admin's org", "Org1MSP", "org1", ""},
+		// The affiliation of the admin's certificate is set by its own CA and is not trusted
+		{"admin of another org with the user's affiliation", "Org2MSP", "org2", "this admin is not authorized to manage users of another org"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chaincode := new(EMRChaincode)
+			mockStub := new(MockStub)
+			mockClientIdentity := new(MockClientIdentity)
+
+			cert := &x509.Certificate{Issuer: pkix.Name{CommonName: fmt.Sprintf("ca.%s.example.com", test.issuer), Organization: []string{fmt.Sprintf("%s.example.com", test.issuer)}}}
+			userJSON := fmt.Sprintf(`{"userId":%q,"role":"doctor","CommonName":"doctor1@org1.example.com"}`, doctorID)
+
+			mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+			mockClientIdentity.On("GetAttributeValue", "hf.Affiliation").Return("org1", true, nil).Maybe()
+			mockClientIdentity.On("GetID").Return("admin1", nil)
+			mockClientIdentity.On("GetMSPID").Return(test.mspID, nil)
+			mockClientIdentity.On("GetX509Certificate").Return(cert, nil)
+			mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return([]byte(userJSON), nil)
+			if test.expected == "" {
+				repairedJSON := fmt.Sprintf(`{"userId":%q,"role":"doctor","CommonName":"doctor1@org1.example.com","status":"active","mspId":"Org1MSP","certificateIds":[%q]}`, doctorID, doctorID)
+				mockStub.On("PutState", userStateKey("doctor1@org1.example.com"), []byte(repairedJSON)).Return(nil)
+				mockStub.On("PutState", userIDStateKey(doctorID), []byte("doctor1@org1.example.com")).Return(nil)
+			}
+
+			ctx := &mockTransactionContext{
+				stub:           mockStub,
+				clientIdentity: mockClientIdentity,
+			}
+
+			err := chaincode.RepairUser(ctx, "doctor1@org1.example.com")
+			if test.expected == "" {
+				assert.NoError(t, err)
+				mockStub.AssertExpectations(t)
+			} else {
+				assert.EqualError(t, err, test.expected)
+				mockStub.AssertNotCalled(t, "PutState", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+// Admins should be able to rewrite the index entries of a record of their org
+func TestRepairRecordIndexes(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:      "emr1",
+		PatientID:  "patient1",
+		DoctorID:   "doctor1",
+		Collection: "Org1MSPPrivateCollection",
+		SharedWithDoctors: []Grant{
+			{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z", Permissions: []string{"read"}},
+		},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	mockClientIdentity.On("GetID").Return("admin1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("PutState", patientIndexStateKey("patient1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("doctor1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", granteeIndexStateKey("doctor2", "emr1"), []byte{0x00}).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.RepairRecordIndexes(ctx, "emr1")
+	assert.NoError(t, err)
+
+	// Admins of other orgs cannot repair the record
+	otherClientIdentity := new(MockClientIdentity)
+	otherClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	otherClientIdentity.On("GetID").Return("admin2", nil)
+	otherClientIdentity.On("GetMSPID").Return("Org2MSP", nil)
+	ctx.clientIdentity = otherClientIdentity
+
+	err = chaincode.RepairRecordIndexes(ctx, "emr1")
+	assert.EqualError(t, err, "this admin is not authorized to manage records of another org")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Records created before private data collections should belong to the org of their doctor
+func TestRepairRecordIndexesLegacyRecord(t *testing.T) {
+	chaincode := new(EMRChaincode)
+	mockStub := new(MockStub)
+	mockClientIdentity := new(MockClientIdentity)
+
+	emr := EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		Diagnosis:           "diagnosis1",
+		SharedWithDoctors:   []Grant{},
+		SharedWithHospitals: []Grant{},
+	}
+	emrJSON, _ := json.Marshal(emr)
+
+	mockClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	mockClientIdentity.On("GetID").Return("admin1", nil)
+	mockClientIdentity.On("GetMSPID").Return("Org1MSP", nil)
+	mockStub.On("GetState", emrStateKey("emr1")).Return(emrJSON, nil)
+	mockStub.On("GetState", userIDStateKey("doctor1")).Return([]byte("doctor1@org1.example.com"), nil)
+	mockStub.On("GetState", userStateKey("doctor1@org1.example.com")).Return([]byte(`{"userId":"doctor1","role":"doctor","CommonName":"doctor1@org1.example.com","mspId":"Org1MSP"}`), nil)
+	mockStub.On("PutState", patientIndexStateKey("patient1", "emr1"), []byte{0x00}).Return(nil)
+	mockStub.On("PutState", ownerIndexStateKey("doctor1", "emr1"), []byte{0x00}).Return(nil)
+
+	ctx := &mockTransactionContext{
+		stub:           mockStub,
+		clientIdentity: mockClientIdentity,
+	}
+
+	err := chaincode.RepairRecordIndexes(ctx, "emr1")
+	assert.NoError(t, err)
+
+	// Admins of other orgs cannot repair the record
+	otherClientIdentity := new(MockClientIdentity)
+	otherClientIdentity.On("GetAttributeValue", "role").Return("admin", true, nil)
+	otherClientIdentity.On("GetID").Return("admin2", nil)
+	otherClientIdentity.On("GetMSPID").Return("Org2MSP", nil)
+	ctx.clientIdentity = otherClientIdentity
+
+	err = chaincode.RepairRecordIndexes(ctx, "emr1")
+	assert.EqualError(t, err, "this admin is not authorized to manage records of another org")
+
+	mockClientIdentity.AssertExpectations(t)
+	mockStub.AssertExpectations(t)
+}
+
+// Values returned by the contract should match the schema contractapi generates from the structs,
+// optional fields left out of the JSON included
+func TestContractSchemaOptionalFields(t *testing.T) {
+	chaincode, err := contractapi.NewChaincode(new(EMRChaincode))
+	assert.NoError(t, err)
+
+	mockStub := new(MockStub)
+	mockStub.On("GetFunctionAndParameters").Return("org.hyperledger.fabric:GetMetadata", []string{})
+	mockStub.On("GetCreator").Return([]byte(nil), nil)
+
+	response := chaincode.Invoke(mockStub)
+	assert.Equal(t, int32(shim.OK), response.Status, response.Message)
+
+	var contractMetadata struct {
+		Components map[string]any `json:"components"`
+	}
+	err = json.Unmarshal(response.Payload, &contractMetadata)
+	assert.NoError(t, err)
+
+	// A record without hospital, classification or versions, shared with a grant without expiry or permissions
+	emrJSON, _ := json.Marshal(EMR{
+		EMRID:               "emr1",
+		PatientID:           "patient1",
+		DoctorID:            "doctor1",
+		CreatedOn:           "2025-03-27T12:00:00Z",
+		LastModified:        "2025-03-27T12:00:00Z",
+		SharedWithDoctors:   []Grant{{GrantorID: "patient1", GranteeID: "doctor2", GrantedAt: "2025-03-27T12:00:00Z"}},
+		SharedWithHospitals: []Grant{},
+	})
+
+	tests := []struct {
+		name   string
+		schema string
+		value  []byte
+	}{
+		{"record", "EMR", emrJSON},
+		// A user registered before statuses, orgs and certificate links existed
+		{"user", "User", []byte(`{"userId":"patient1","role":"patient","CommonName":"patient1@org2.example.com"}`)},
+		{"migration page", "MigrationPage", []byte(`{"migrated":0,"bookmark":""}`)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// References to other schemas resolve against the components of the metadata
+			schema := map[string]any{
+				"$ref":       "#/components/schemas/" + test.schema,
+				"components": contractMetadata.Components,
+			}
+
+			result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(schema), gojsonschema.NewBytesLoader(test.value))
+			assert.NoError(t, err)
+			assert.True(t, result.Valid(), "%v", result.Errors())
+		})
+	}
+
+	mockStub.AssertExpectations(t)
+}
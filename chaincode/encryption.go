@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// wrappedKeyObjectType is the composite key object type of the wrapped data keys of encrypted records, keyed by EMR ID and party ID
+const wrappedKeyObjectType = "wrappedkey"
+
+// Transient map keys of the wrapped data keys of encrypted records
+const (
+	wrappedKeysTransientKey = "wrappedKeys" // JSON object of the wrapped keys of the record parties by role, passed to CreateRecord
+	wrappedKeyTransientKey  = "wrappedKey"  // Wrapped key of the grantee, passed to ShareRecord
+)
+
+// WrappedKey is the data key of an encrypted record wrapped with the public key of a party that can read the record
+// The chaincode never sees the data key, parties unwrap it with their private key to decrypt the record content
+type WrappedKey struct {
+	EMRID      string `json:"emrId"`
+	PartyID    string `json:"partyId"`
+	WrappedKey string `json:"wrappedKey"` // Base64 encoded
+}
+
+// GetWrappedKey retrieves the data key of an encrypted record wrapped for the client
+func (c *EMRChaincode) GetWrappedKey(ctx contractapi.TransactionContextInterface, emrID string) (string, error) {
+	emr, err := c.ReadRecord(ctx, emrID)
+	if err != nil {
+		return "", err
+	}
+	if !emr.Encrypted {
+		return "", fmt.Errorf("record with ID %s is not encrypted", emrID)
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	key, err := wrappedKeyKey(ctx, emrID, clientID)
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKeyJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get wrapped key: %v", err)
+	}
+	if wrappedKeyJSON == nil {
+		return "", fmt.Errorf("no key of record with ID %s is wrapped for this client", emrID)
+	}
+
+	var wrappedKey WrappedKey
+	err = json.Unmarshal(wrappedKeyJSON, &wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal wrapped key: %v", err)
+	}
+
+	return wrappedKey.WrappedKey, nil
+}
+
+// transientWrappedKeys returns the wrapped keys passed to CreateRecord by role, nil for records that are not encrypted
+func transientWrappedKeys(ctx contractapi.TransactionContextInterface) (map[string]string, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient map: %v", err)
+	}
+
+	wrappedKeysJSON, ok := transientMap[wrappedKeysTransientKey]
+	if !ok {
+		return nil, nil
+	}
+
+	wrappedKeys := map[string]string{}
+	err = json.Unmarshal(wrappedKeysJSON, &wrappedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal wrapped keys: %v", err)
+	}
+	return wrappedKeys, nil
+}
+
+// transientWrappedKey returns the wrapped key of the grantee passed to ShareRecord
+func transientWrappedKey(ctx contractapi.TransactionContextInterface) (string, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get transient map: %v", err)
+	}
+
+	wrappedKey := transientMap[wrappedKeyTransientKey]
+	if len(wrappedKey) == 0 {
+		return "", fmt.Errorf("the key of an encrypted record must be wrapped for the grantee and passed in the transient map under the %q key", wrappedKeyTransientKey)
+	}
+	return string(wrappedKey), nil
+}
+
+// putPartyWrappedKeys stores the wrapped keys of the patient, doctor and hospital of a new encrypted record
+// Every party of the record needs a wrapped key, and only parties of the record can be given one
+func putPartyWrappedKeys(ctx contractapi.TransactionContextInterface, emr *EMR, wrappedKeys map[string]string) error {
+	parties := map[string]string{"patient": emr.PatientID, "doctor": emr.DoctorID, "hospital": emr.HospitalID}
+	for role := range wrappedKeys {
+		if parties[role] == "" {
+			return fmt.Errorf("a key is wrapped for the %s of a record that has none", role)
+		}
+	}
+
+	// Iterate in a fixed order so that every peer writes the same keys
+	for _, role := range []string{"patient", "doctor", "hospital"} {
+		if parties[role] == "" {
+			continue
+		}
+		wrappedKey, ok := wrappedKeys[role]
+		if !ok {
+			return fmt.Errorf("the key of an encrypted record must be wrapped for its %s", role)
+		}
+		err := putWrappedKey(ctx, emr.EMRID, parties[role], wrappedKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putWrappedKey stores the data key of an encrypted record wrapped for a party
+func putWrappedKey(ctx contractapi.TransactionContextInterface, emrID string, partyID string, wrappedKey string) error {
+	if decoded, err := base64.StdEncoding.DecodeString(wrappedKey); err != nil || len(decoded) == 0 {
+		return fmt.Errorf("invalid wrapped key: it must be base64 encoded")
+	}
+
+	key, err := wrappedKeyKey(ctx, emrID, partyID)
+	if err != nil {
+		return err
+	}
+
+	wrappedKeyJSON, err := json.Marshal(WrappedKey{EMRID: emrID, PartyID: partyID, WrappedKey: wrappedKey})
+	if err != nil {
+		return fmt.Errorf("failed to marshal wrapped key: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, wrappedKeyJSON)
+	if err != nil {
+		return fmt.Errorf("failed to write wrapped key: %v", err)
+	}
+	return nil
+}
+
+// delWrappedKey deletes the data key of an encrypted record wrapped for a grantee
+// The keys of the patient, doctor and hospital of the record are kept, they do not depend on grants
+func delWrappedKey(ctx contractapi.TransactionContextInterface, emr *EMR, granteeID string) error {
+	if slices.Contains([]string{emr.PatientID, emr.DoctorID, emr.HospitalID}, granteeID) {
+		return nil
+	}
+
+	key, err := wrappedKeyKey(ctx, emr.EMRID, granteeID)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete wrapped key: %v", err)
+	}
+	return nil
+}
+
+// validateCiphertext checks that the content of an encrypted record version is base64 encoded
+func validateCiphertext(content []byte) error {
+	decoded, err := base64.StdEncoding.DecodeString(string(content))
+	if err != nil || len(decoded) == 0 {
+		return fmt.Errorf("invalid encrypted content: it must be base64 encoded")
+	}
+	return nil
+}
+
+// wrappedKeyKey returns the world state key of the data key of a record wrapped for a party
+func wrappedKeyKey(ctx contractapi.TransactionContextInterface, emrID string, partyID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(wrappedKeyObjectType, []string{emrID, partyID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create wrapped key key: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Names of the chaincode events, each transaction emits at most one event
+// Event payloads only carry IDs so that listeners never receive clinical content
+const (
+	EventRecordCreated       = "RecordCreated"
+	EventRecordShared        = "RecordShared"
+	EventRecordUnshared      = "RecordUnshared"
+	EventRecordAmended       = "RecordAmended"
+	EventUserRegistered      = "UserRegistered"
+	EventEmergencyAccess     = "EmergencyAccess"
+	EventProxyAdded          = "ProxyAdded"
+	EventProxyRemoved        = "ProxyRemoved"
+	EventDocumentAttached    = "DocumentAttached"
+	EventUserStatusChanged   = "UserStatusChanged"
+	EventCertificateLinked   = "CertificateLinked"
+	EventCertificateUnlinked = "CertificateUnlinked"
+	EventRecordReassigned    = "RecordReassigned"
+)
+
+// RecordCreatedEvent is the payload of the RecordCreated event emitted by CreateRecord
+type RecordCreatedEvent struct {
+	EMRID      string `json:"emrId"`
+	PatientID  string `json:"patientId"`
+	DoctorID   string `json:"doctorId,omitempty"`
+	HospitalID string `json:"hospitalId,omitempty"`
+}
+
+// RecordSharedEvent is the payload of the RecordShared event emitted by ShareRecord
+type RecordSharedEvent struct {
+	EMRID       string `json:"emrId"`
+	PatientID   string `json:"patientId"`
+	GrantorID   string `json:"grantorId"`
+	GranteeID   string `json:"granteeId"`
+	GranteeRole string `json:"granteeRole"` // doctor or hospital
+}
+
+// RecordUnsharedEvent is the payload of the RecordUnshared event emitted by UnshareRecord
+type RecordUnsharedEvent struct {
+	EMRID       string `json:"emrId"`
+	PatientID   string `json:"patientId"`
+	RevokerID   string `json:"revokerId"`
+	GranteeID   string `json:"granteeId"`
+	GranteeRole string `json:"granteeRole"` // doctor or hospital
+}
+
+// RecordAmendedEvent is the payload of the RecordAmended event emitted by UpdateRecord and AppendAddendum
+type RecordAmendedEvent struct {
+	EMRID     string `json:"emrId"`
+	PatientID string `json:"patientId"`
+	AuthorID  string `json:"authorId"`
+	Version   int    `json:"version"`
+	Type      string `json:"type"` // amendment or addendum
+}
+
+// UserRegisteredEvent is the payload of the UserRegistered event emitted by RegisterUser
+type UserRegisteredEvent struct {
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+}
+
+// UserStatusChangedEvent is the payload of the UserStatusChanged event emitted by SetUserStatus
+type UserStatusChangedEvent struct {
+	UserID    string `json:"userId"`
+	Status    string `json:"status"`
+	ChangedBy string `json:"changedBy"`
+}
+
+// CertificateLinkedEvent is the payload of the CertificateLinked event emitted by ApproveCertificateLink
+type CertificateLinkedEvent struct {
+	UserID        string `json:"userId"`
+	CertificateID string `json:"certificateId"`
+	ApprovedBy    string `json:"approvedBy"`
+}
+
+// CertificateUnlinkedEvent is the payload of the CertificateUnlinked event emitted by UnlinkCertificate
+type CertificateUnlinkedEvent struct {
+	UserID        string `json:"userId"`
+	CertificateID string `json:"certificateId"`
+	UnlinkedBy    string `json:"unlinkedBy"`
+}
+
+// RecordReassignedEvent is the payload of the RecordReassigned event emitted by ReassignRecordOwner
+type RecordReassignedEvent struct {
+	EMRID           string `json:"emrId"`
+	PatientID       string `json:"patientId"`
+	OwnerRole       string `json:"ownerRole"` // doctor or hospital
+	PreviousOwnerID string `json:"previousOwnerId,omitempty"`
+	OwnerID         string `json:"ownerId"`
+	ReassignedBy    string `json:"reassignedBy"`
+}
+
+// EmergencyAccessEvent is the payload of the EmergencyAccess event emitted by EmergencyAccess
+// Patients and auditors listen for it to review break-glass accesses, the justification is in the access log
+type EmergencyAccessEvent struct {
+	EMRID      string `json:"emrId"`
+	PatientID  string `json:"patientId"`
+	AccessorID string `json:"accessorId"`
+	Role       string `json:"role"` // doctor or hospital
+	ExpiresAt  string `json:"expiresAt"`
+	TxID       string `json:"txId"`
+}
+
+// ProxyAddedEvent is the payload of the ProxyAdded event emitted by AddProxy
+type ProxyAddedEvent struct {
+	PatientID string `json:"patientId"`
+	ProxyID   string `json:"proxyId"`
+	GrantedBy string `json:"grantedBy"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+// ProxyRemovedEvent is the payload of the ProxyRemoved event emitted by RemoveProxy
+type ProxyRemovedEvent struct {
+	PatientID string `json:"patientId"`
+	ProxyID   string `json:"proxyId"`
+	RemovedBy string `json:"removedBy"`
+}
+
+// DocumentAttachedEvent is the payload of the DocumentAttached event emitted by AttachDocument
+type DocumentAttachedEvent struct {
+	EMRID     string `json:"emrId"`
+	PatientID string `json:"patientId"`
+	DocID     string `json:"docId"`
+	AuthorID  string `json:"authorId"`
+}
+
+// setEvent emits a chaincode event with a JSON payload
+func setEvent(ctx contractapi.TransactionContextInterface, name string, payload any) error {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %v", name, err)
+	}
+
+	err = ctx.GetStub().SetEvent(name, payloadJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set %s event: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// FHIRBundle is the subset of a FHIR R4 Bundle used to exchange EMR records
+type FHIRBundle struct {
+	ResourceType string            `json:"resourceType"`
+	ID           string            `json:"id,omitempty"`
+	Type         string            `json:"type"`
+	Timestamp    string            `json:"timestamp,omitempty"`
+	Entry        []FHIRBundleEntry `json:"entry"`
+}
+
+// FHIRBundleEntry is an entry of a FHIR Bundle
+type FHIRBundleEntry struct {
+	FullURL  string       `json:"fullUrl,omitempty"`
+	Resource FHIRResource `json:"resource"`
+}
+
+// FHIRResource holds the fields of the Patient, Practitioner, Organization, Condition, Observation and
+// MedicationStatement resources used by the chaincode, fields that do not apply to a resource type are left empty
+type FHIRResource struct {
+	ResourceType              string               `json:"resourceType"`
+	ID                        string               `json:"id,omitempty"`
+	Identifier                []FHIRIdentifier     `json:"identifier,omitempty"`
+	Status                    string               `json:"status,omitempty"`
+	ManagingOrganization      *FHIRReference       `json:"managingOrganization,omitempty"`
+	Code                      *FHIRCodeableConcept `json:"code,omitempty"`
+	MedicationCodeableConcept *FHIRCodeableConcept `json:"medicationCodeableConcept,omitempty"`
+	Subject                   *FHIRReference       `json:"subject,omitempty"`
+	Asserter                  *FHIRReference       `json:"asserter,omitempty"`
+	RecordedDate              string               `json:"recordedDate,omitempty"`
+	Note                      []FHIRAnnotation     `json:"note,omitempty"`
+	ValueQuantity             *FHIRQuantity        `json:"valueQuantity,omitempty"`
+	Dosage                    []FHIRDosage         `json:"dosage,omitempty"`
+}
+
+// FHIRIdentifier is a FHIR Identifier
+type FHIRIdentifier struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+// FHIRReference is a FHIR Reference to another resource of the bundle
+type FHIRReference struct {
+	Reference string `json:"reference"`
+}
+
+// FHIRCodeableConcept is a FHIR CodeableConcept
+type FHIRCodeableConcept struct {
+	Coding []FHIRCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+// FHIRCoding is a FHIR Coding
+type FHIRCoding struct {
+	System  string `json:"system"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+// FHIRAnnotation is a FHIR Annotation
+type FHIRAnnotation struct {
+	Text string `json:"text"`
+}
+
+// FHIRQuantity is a FHIR Quantity with a UCUM unit
+type FHIRQuantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit"`
+	System string  `json:"system"`
+	Code   string  `json:"code"`
+}
+
+// FHIRDosage is a FHIR Dosage, the dose is kept as text and the frequency as the code of its timing
+type FHIRDosage struct {
+	Text   string      `json:"text,omitempty"`
+	Timing *FHIRTiming `json:"timing,omitempty"`
+}
+
+// FHIRTiming is a FHIR Timing
+type FHIRTiming struct {
+	Code *FHIRCodeableConcept `json:"code,omitempty"`
+}
+
+// Code systems and identifier systems of the exchanged resources
+const (
+	fhirSystemICD10 = "http://hl7.org/fhir/sid/icd-10"
+	fhirSystemLOINC = "http://loinc.org"
+	fhirSystemUCUM  = "http://unitsofmeasure.org"
+	fhirSystemUser  = "urn:emr-net:user"
+	fhirSystemEMR   = "urn:emr-net:emr"
+)
+
+// fhirBaseURL is the base of the full URLs of bundle entries, relative references resolve against it
+const fhirBaseURL = "https://emr-net.example.com/fhir/"
+
+// fhirVital maps a vital sign of ClinicalData to its LOINC code and UCUM unit
+type fhirVital struct {
+	loincCode string
+	display   string
+	unit      string
+	get       func(v *Vitals) float64
+	set       func(v *Vitals, value float64)
+}
+
+// fhirVitals lists the vital signs in the order they are exported
+var fhirVitals = []fhirVital{
+	{"8867-4", "Heart rate", "/min",
+		func(v *Vitals) float64 { return float64(v.HeartRate) },
+		func(v *Vitals, value float64) { v.HeartRate = int(math.Round(value)) }},
+	{"8480-6", "Systolic blood pressure", "mm[Hg]",
+		func(v *Vitals) float64 { return float64(v.SystolicBloodPressure) },
+		func(v *Vitals, value float64) { v.SystolicBloodPressure = int(math.Round(value)) }},
+	{"8462-4", "Diastolic blood pressure", "mm[Hg]",
+		func(v *Vitals) float64 { return float64(v.DiastolicBloodPressure) },
+		func(v *Vitals, value float64) { v.DiastolicBloodPressure = int(math.Round(value)) }},
+	{"9279-1", "Respiratory rate", "/min",
+		func(v *Vitals) float64 { return float64(v.RespiratoryRate) },
+		func(v *Vitals, value float64) { v.RespiratoryRate = int(math.Round(value)) }},
+	{"8310-5", "Body temperature", "Cel",
+		func(v *Vitals) float64 { return v.Temperature },
+		func(v *Vitals, value float64) { v.Temperature = value }},
+	{"2708-6", "Oxygen saturation in Arterial blood", "%",
+		func(v *Vitals) float64 { return v.OxygenSaturation },
+		func(v *Vitals, value float64) { v.OxygenSaturation = value }},
+}
+
+// ExportRecordFHIR exports the current content of an EMR record as a FHIR R4 Bundle in JSON
+// The Condition carries the diagnosis, codes and notes, addenda are added as notes, vitals as Observations
+// and medications as MedicationStatements, the access is not logged
+func (c *EMRChaincode) ExportRecordFHIR(ctx contractapi.TransactionContextInterface, emrID string) (string, error) {
+	emr, err := c.ReadRecord(ctx, emrID)
+	if err != nil {
+		return "", err
+	}
+
+	return exportRecordFHIR(ctx, emr)
+}
+
+// AccessRecordFHIR exports an EMR record like ExportRecordFHIR and logs the access
+func (c *EMRChaincode) AccessRecordFHIR(ctx contractapi.TransactionContextInterface, emrID string, purpose string) (string, error) {
+	emr, err := c.accessRecord(ctx, emrID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	return exportRecordFHIR(ctx, emr)
+}
+
+// exportRecordFHIR builds the FHIR Bundle of an EMR record the client is authorized to read and marshals it to JSON
+func exportRecordFHIR(ctx contractapi.TransactionContextInterface, emr *EMR) (string, error) {
+	if emr.Encrypted {
+		return "", fmt.Errorf("record with ID %s is encrypted and cannot be exported", emr.EMRID)
+	}
+
+	contents, err := recordContents(ctx, emr)
+	if err != nil {
+		return "", err
+	}
+
+	bundle := recordToFHIR(emr, contents)
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal FHIR bundle: %v", err)
+	}
+
+	return string(bundleJSON), nil
+}
+
+// ImportRecordFHIR creates a new EMR record from a FHIR R4 Bundle holding one Condition, vital sign Observations
+// and MedicationStatements
+// The bundle is passed in the transient map under the "content" key, Patient, Practitioner and Organization
+// resources are ignored in favor of the given CommonNames
+func (c *EMRChaincode) ImportRecordFHIR(ctx contractapi.TransactionContextInterface, emrID string, patientCommonName string, doctorCommonName string, hospitalCommonName string) error {
+	bundleJSON, err := transientContent(ctx)
+	if err != nil {
+		return err
+	}
+
+	var bundle FHIRBundle
+	err = json.Unmarshal(bundleJSON, &bundle)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal FHIR bundle: %v", err)
+	}
+
+	clinicalData, err := fhirToClinicalData(&bundle)
+	if err != nil {
+		return err
+	}
+
+	clinicalDataJSON, err := json.Marshal(clinicalData)
+	if err != nil {
+		return fmt.Errorf("failed to marshal clinical data: %v", err)
+	}
+
+	return c.createRecord(ctx, emrID, patientCommonName, doctorCommonName, hospitalCommonName, clinicalDataJSON, nil)
+}
+
+// recordToFHIR builds the FHIR Bundle of an EMR record from the contents of its versions
+// Resource IDs are local to the bundle so that every peer builds the same bundle
+func recordToFHIR(emr *EMR, contents []RecordContent) *FHIRBundle {
+	clinicalData, addenda := currentClinicalData(contents)
+
+	bundle := &FHIRBundle{
+		ResourceType: "Bundle",
+		ID:           emr.EMRID,
+		Type:         "collection",
+		Timestamp:    emr.LastModified,
+		Entry:        []FHIRBundleEntry{},
+	}
+	patientReference := &FHIRReference{Reference: "Patient/patient"}
+
+	patient := FHIRResource{
+		ResourceType: "Patient",
+		ID:           "patient",
+		Identifier:   []FHIRIdentifier{{System: fhirSystemUser, Value: emr.PatientID}},
+	}
+	if emr.HospitalID != "" {
+		patient.ManagingOrganization = &FHIRReference{Reference: "Organization/organization"}
+	}
+	bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: fhirBaseURL + "Patient/patient", Resource: patient})
+
+	if emr.DoctorID != "" {
+		bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: fhirBaseURL + "Practitioner/practitioner", Resource: FHIRResource{
+			ResourceType: "Practitioner",
+			ID:           "practitioner",
+			Identifier:   []FHIRIdentifier{{System: fhirSystemUser, Value: emr.DoctorID}},
+		}})
+	}
+	if emr.HospitalID != "" {
+		bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: fhirBaseURL + "Organization/organization", Resource: FHIRResource{
+			ResourceType: "Organization",
+			ID:           "organization",
+			Identifier:   []FHIRIdentifier{{System: fhirSystemUser, Value: emr.HospitalID}},
+		}})
+	}
+
+	condition := FHIRResource{
+		ResourceType: "Condition",
+		ID:           "condition",
+		Identifier:   []FHIRIdentifier{{System: fhirSystemEMR, Value: emr.EMRID}},
+		Code:         &FHIRCodeableConcept{Text: clinicalData.Diagnosis},
+		Subject:      patientReference,
+		RecordedDate: emr.CreatedOn,
+	}
+	for _, code := range clinicalData.ICD10Codes {
+		condition.Code.Coding = append(condition.Code.Coding, FHIRCoding{System: fhirSystemICD10, Code: code})
+	}
+	if emr.DoctorID != "" {
+		condition.Asserter = &FHIRReference{Reference: "Practitioner/practitioner"}
+	}
+	if clinicalData.Notes != "" {
+		condition.Note = append(condition.Note, FHIRAnnotation{Text: clinicalData.Notes})
+	}
+	for _, addendum := range addenda {
+		condition.Note = append(condition.Note, FHIRAnnotation{Text: addendum})
+	}
+	bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: fhirBaseURL + "Condition/condition", Resource: condition})
+
+	if clinicalData.Vitals != nil {
+		for _, vital := range fhirVitals {
+			value := vital.get(clinicalData.Vitals)
+			if value == 0 {
+				continue // Not measured
+			}
+
+			id := "observation-" + vital.loincCode
+			bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: fhirBaseURL + "Observation/" + id, Resource: FHIRResource{
+				ResourceType: "Observation",
+				ID:           id,
+				Status:       "final",
+				Code:         &FHIRCodeableConcept{Coding: []FHIRCoding{{System: fhirSystemLOINC, Code: vital.loincCode, Display: vital.display}}},
+				Subject:      patientReference,
+				ValueQuantity: &FHIRQuantity{
+					Value:  value,
+					Unit:   vital.unit,
+					System: fhirSystemUCUM,
+					Code:   vital.unit,
+				},
+			}})
+		}
+	}
+
+	for i, medication := range clinicalData.Medications {
+		id := fmt.Sprintf("medication-%d", i+1)
+		statement := FHIRResource{
+			ResourceType:              "MedicationStatement",
+			ID:                        id,
+			Status:                    "active",
+			MedicationCodeableConcept: &FHIRCodeableConcept{Text: medication.Name},
+			Subject:                   patientReference,
+		}
+		if medication.Dose != "" || medication.Frequency != "" {
+			dosage := FHIRDosage{Text: medication.Dose}
+			if medication.Frequency != "" {
+				dosage.Timing = &FHIRTiming{Code: &FHIRCodeableConcept{Text: medication.Frequency}}
+			}
+			statement.Dosage = []FHIRDosage{dosage}
+		}
+		bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: fhirBaseURL + "MedicationStatement/" + id, Resource: statement})
+	}
+
+	return bundle
+}
+
+// currentClinicalData returns the clinical data of the latest original or amended version
+// and the text of the addenda appended since
+func currentClinicalData(contents []RecordContent) (ClinicalData, []string) {
+	var clinicalData ClinicalData
+	var addenda []string
+	for _, content := range contents {
+		if content.Type == versionTypeAddendum {
+			addenda = append(addenda, content.Content)
+			continue
+		}
+
+		// Contents written before clinical data had a schema are a plain diagnosis
+		clinicalData = ClinicalData{}
+		if json.Unmarshal([]byte(content.Content), &clinicalData) != nil {
+			clinicalData = ClinicalData{Diagnosis: content.Content}
+		}
+		addenda = nil
+	}
+
+	return clinicalData, addenda
+}
+
+// fhirToClinicalData maps the Condition, vital sign Observations and MedicationStatements of a FHIR Bundle to clinical data
+func fhirToClinicalData(bundle *FHIRBundle) (*ClinicalData, error) {
+	if bundle.ResourceType != "Bundle" {
+		return nil, fmt.Errorf("expected a FHIR Bundle, got %s", bundle.ResourceType)
+	}
+
+	clinicalData := ClinicalData{SchemaVersion: clinicalDataSchemaVersion}
+	conditions := 0
+	for _, entry := range bundle.Entry {
+		resource := entry.Resource
+		switch resource.ResourceType {
+		case "Condition":
+			conditions++
+			if resource.Code == nil {
+				return nil, fmt.Errorf("the FHIR Condition has no code")
+			}
+
+			clinicalData.Diagnosis = resource.Code.Text
+			for _, coding := range resource.Code.Coding {
+				if strings.HasPrefix(coding.System, fhirSystemICD10) {
+					clinicalData.ICD10Codes = append(clinicalData.ICD10Codes, coding.Code)
+				}
+				if clinicalData.Diagnosis == "" {
+					clinicalData.Diagnosis = coding.Display
+				}
+			}
+
+			var notes []string
+			for _, note := range resource.Note {
+				notes = append(notes, note.Text)
+			}
+			clinicalData.Notes = strings.Join(notes, "\n")
+		case "Observation":
+			err := setFHIRVital(&clinicalData, &resource)
+			if err != nil {
+				return nil, err
+			}
+		case "MedicationStatement":
+			medication, err := fhirToMedication(&resource)
+			if err != nil {
+				return nil, err
+			}
+			clinicalData.Medications = append(clinicalData.Medications, *medication)
+		}
+	}
+	if conditions != 1 {
+		return nil, fmt.Errorf("the FHIR Bundle must contain exactly one Condition, found %d", conditions)
+	}
+
+	return &clinicalData, nil
+}
+
+// setFHIRVital sets the vital sign measured by a FHIR Observation
+func setFHIRVital(clinicalData *ClinicalData, observation *FHIRResource) error {
+	if observation.Code == nil || observation.ValueQuantity == nil {
+		return fmt.Errorf("FHIR Observation %s must have a code and a valueQuantity", observation.ID)
+	}
+
+	for _, coding := range observation.Code.Coding {
+		if coding.System != fhirSystemLOINC {
+			continue
+		}
+
+		index := slices.IndexFunc(fhirVitals, func(v fhirVital) bool { return v.loincCode == coding.Code })
+		if index == -1 {
+			continue
+		}
+		if observation.ValueQuantity.Unit != fhirVitals[index].unit && observation.ValueQuantity.Code != fhirVitals[index].unit {
+			return fmt.Errorf("FHIR Observation %s must be measured in %s", observation.ID, fhirVitals[index].unit)
+		}
+
+		if clinicalData.Vitals == nil {
+			clinicalData.Vitals = &Vitals{}
+		}
+		fhirVitals[index].set(clinicalData.Vitals, observation.ValueQuantity.Value)
+		return nil
+	}
+
+	// Observations the record cannot hold are rejected rather than silently dropped
+	return fmt.Errorf("FHIR Observation %s is not a supported vital sign", observation.ID)
+}
+
+// fhirToMedication maps a FHIR MedicationStatement to a medication, only its first dosage is kept
+func fhirToMedication(statement *FHIRResource) (*Medication, error) {
+	if statement.MedicationCodeableConcept == nil {
+		return nil, fmt.Errorf("FHIR MedicationStatement %s must have a medicationCodeableConcept", statement.ID)
+	}
+
+	medication := Medication{Name: statement.MedicationCodeableConcept.Text}
+	for _, coding := range statement.MedicationCodeableConcept.Coding {
+		if medication.Name == "" {
+			medication.Name = coding.Display
+		}
+	}
+	if medication.Name == "" {
+		return nil, fmt.Errorf("FHIR MedicationStatement %s has no medication name", statement.ID)
+	}
+
+	if len(statement.Dosage) > 0 {
+		dosage := statement.Dosage[0]
+		medication.Dose = dosage.Text
+		if dosage.Timing != nil && dosage.Timing.Code != nil {
+			medication.Frequency = dosage.Timing.Code.Text
+		}
+	}
+
+	return &medication, nil
+}
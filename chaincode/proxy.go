@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// proxyObjectType is the composite key object type of proxies, keyed by patient ID and proxy ID
+const proxyObjectType = "proxy"
+
+// Proxy lets a guardian or caregiver act for a patient on all of the patient's records
+// Proxies are registered with the patient role and hold the permissions of their scope, optionally until ExpiresAt
+type Proxy struct {
+	PatientID string   `json:"patientId"`
+	ProxyID   string   `json:"proxyId"`
+	Scope     []string `json:"scope"`
+	GrantedBy string   `json:"grantedBy"`
+	GrantedAt string   `json:"grantedAt"`
+	ExpiresAt string   `json:"expiresAt,omitempty"` // Empty for proxies that never expire
+}
+
+// AddProxy links a proxy identity to a patient, it can be called by the patient or a registrar of the patient's org
+// scope is a comma separated list of the permissions the proxy holds, read is always granted
+// durationDays limits the proxy to the given number of days, 0 keeps it until it is removed
+func (c *EMRChaincode) AddProxy(ctx contractapi.TransactionContextInterface, patientCommonName string, proxyCommonName string, scope string, durationDays int) error {
+	role, clientID, patient, err := c.proxyManager(ctx, patientCommonName)
+	if err != nil {
+		return err
+	}
+	if clientID != patient.UserID {
+		registrar, err := isPatientRegistrar(ctx, role, patient)
+		if err != nil {
+			return err
+		}
+		if !registrar {
+			return fmt.Errorf("this %s is not authorized to add proxies for this patient", role)
+		}
+	}
+
+	proxyUser, err := c.GetUser(ctx, proxyCommonName)
+	if err != nil {
+		return fmt.Errorf("failed to get proxy: %v", err)
+	}
+	if proxyUser.Role != "patient" {
+		return fmt.Errorf("user with CommonName %s is not registered with the patient role", proxyCommonName)
+	}
+	if !proxyUser.isActive() {
+		return fmt.Errorf("user with CommonName %s is %s and cannot be given access", proxyCommonName, proxyUser.Status)
+	}
+	if proxyUser.UserID == patient.UserID {
+		return fmt.Errorf("a patient cannot be their own proxy")
+	}
+
+	if durationDays < 0 {
+		return fmt.Errorf("invalid proxy duration: %d days", durationDays)
+	}
+
+	permissions, err := parsePermissions(scope)
+	if err != nil {
+		return err
+	}
+
+	now, err := c.now(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing, err := getProxy(ctx, patient.UserID, proxyUser.UserID)
+	if err != nil {
+		return err
+	}
+	if existing != nil && notExpired(existing.ExpiresAt, now) {
+		return fmt.Errorf("user with CommonName %s is already a proxy for this patient", proxyCommonName)
+	}
+
+	proxy := Proxy{
+		PatientID: patient.UserID,
+		ProxyID:   proxyUser.UserID,
+		Scope:     permissions,
+		GrantedBy: clientID,
+		GrantedAt: now.Format(time.RFC3339),
+	}
+	if durationDays > 0 {
+		proxy.ExpiresAt = now.AddDate(0, 0, durationDays).Format(time.RFC3339)
+	}
+
+	key, err := proxyKey(ctx, proxy.PatientID, proxy.ProxyID)
+	if err != nil {
+		return err
+	}
+
+	proxyJSON, err := json.Marshal(proxy)
+	if err != nil {
+		return fmt.Errorf("failed to marshal proxy: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, proxyJSON)
+	if err != nil {
+		return fmt.Errorf("failed to write proxy: %v", err)
+	}
+
+	return setEvent(ctx, EventProxyAdded, ProxyAddedEvent{
+		PatientID: proxy.PatientID,
+		ProxyID:   proxy.ProxyID,
+		GrantedBy: clientID,
+		ExpiresAt: proxy.ExpiresAt,
+	})
+}
+
+// RemoveProxy unlinks a proxy identity from a patient
+// It can be called by the patient, a registrar of the patient's org or the proxy giving up its own access
+func (c *EMRChaincode) RemoveProxy(ctx contractapi.TransactionContextInterface, patientCommonName string, proxyCommonName string) error {
+	role, clientID, patient, err := c.proxyManager(ctx, patientCommonName)
+	if err != nil {
+		return err
+	}
+
+	proxyUser, err := c.GetUser(ctx, proxyCommonName)
+	if err != nil {
+		return fmt.Errorf("failed to get proxy: %v", err)
+	}
+
+	if clientID != patient.UserID && clientID != proxyUser.UserID {
+		registrar, err := isPatientRegistrar(ctx, role, patient)
+		if err != nil {
+			return err
+		}
+		if !registrar {
+			return fmt.Errorf("this %s is not authorized to remove proxies for this patient", role)
+		}
+	}
+
+	existing, err := getProxy(ctx, patient.UserID, proxyUser.UserID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("user with CommonName %s is not a proxy for this patient", proxyCommonName)
+	}
+
+	key, err := proxyKey(ctx, patient.UserID, proxyUser.UserID)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete proxy: %v", err)
+	}
+
+	return setEvent(ctx, EventProxyRemoved, ProxyRemovedEvent{
+		PatientID: patient.UserID,
+		ProxyID:   proxyUser.UserID,
+		RemovedBy: clientID,
+	})
+}
+
+// proxyManager returns the role and ID of the client managing the proxies of a patient, and the patient
+func (c *EMRChaincode) proxyManager(ctx contractapi.TransactionContextInterface, patientCommonName string) (string, string, *User, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue("role")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to get role attribute: %v", err)
+	}
+	if !found {
+		return "", "", nil, fmt.Errorf("role attribute not found")
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to get client ID: %v", err)
+	}
+
+	patient, err := c.GetUser(ctx, patientCommonName)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to get patient: %v", err)
+	}
+	if patient.Role != "patient" {
+		return "", "", nil, fmt.Errorf("user with CommonName %s is not a patient", patientCommonName)
+	}
+
+	return role, clientID, patient, nil
+}
+
+// isPatientRegistrar checks if the client is a registrar of the patient's org, registrars only manage the proxies of their org
+func isPatientRegistrar(ctx contractapi.TransactionContextInterface, role string, patient *User) (bool, error) {
+	if role != "registrar" {
+		return false, nil
+	}
+
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return false, fmt.Errorf("failed to get MSP ID: %v", err)
+	}
+	return patient.MSPID != "" && mspID == patient.MSPID, nil
+}
+
+// activeProxyScope returns the scope of the proxy held by proxyID for a patient if it has not expired
+func activeProxyScope(ctx contractapi.TransactionContextInterface, patientID string, proxyID string, now time.Time) ([]string, error) {
+	proxy, err := getProxy(ctx, patientID, proxyID)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil || !notExpired(proxy.ExpiresAt, now) {
+		return nil, nil
+	}
+	return proxy.Scope, nil
+}
+
+// getProxy retrieves the proxy held by proxyID for a patient, nil if there is none
+func getProxy(ctx contractapi.TransactionContextInterface, patientID string, proxyID string) (*Proxy, error) {
+	key, err := proxyKey(ctx, patientID, proxyID)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proxy: %v", err)
+	}
+	if proxyJSON == nil {
+		return nil, nil
+	}
+
+	var proxy Proxy
+	err = json.Unmarshal(proxyJSON, &proxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal proxy: %v", err)
+	}
+
+	return &proxy, nil
+}
+
+// proxyKey returns the world state key of the proxy held by proxyID for a patient
+func proxyKey(ctx contractapi.TransactionContextInterface, patientID string, proxyID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(proxyObjectType, []string{patientID, proxyID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create proxy key: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// userIDObjectType is the composite key object type mapping client IDs to the CommonName of their user
+const userIDObjectType = "userid"
+
+// Statuses of registered users
+const (
+	userStatusActive      = "active"
+	userStatusSuspended   = "suspended"   // Temporarily barred, for example during an investigation
+	userStatusDeactivated = "deactivated" // Left the network, for example a doctor leaving a hospital
+)
+
+// isActive checks if the user can submit transactions, users registered before statuses existed are active
+func (u *User) isActive() bool {
+	return u.Status == "" || u.Status == userStatusActive
+}
+
+// SetUserStatus suspends, deactivates or re-activates a user, only admins of the user's org can change user statuses
+// Users that are not active cannot submit transactions and hold no permission on records, their grants are kept
+// so that re-activated users get their access back
+func (c *EMRChaincode) SetUserStatus(ctx contractapi.TransactionContextInterface, commonName string, status string) error {
+	clientID, mspID, err := orgAdmin(ctx, "change user statuses")
+	if err != nil {
+		return err
+	}
+
+	if status != userStatusActive && status != userStatusSuspended && status != userStatusDeactivated {
+		return fmt.Errorf("invalid user status: %s", status)
+	}
+
+	user, err := c.orgUser(ctx, mspID, commonName)
+	if err != nil {
+		return err
+	}
+	if user.UserID == clientID {
+		return fmt.Errorf("an admin cannot change their own status")
+	}
+	if (user.isActive() && status == userStatusActive) || user.Status == status {
+		return fmt.Errorf("user with CommonName %s is already %s", commonName, status)
+	}
+	user.Status = status
+
+	return c.putUserStatus(ctx, user, clientID)
+}
+
+// putUserStatus writes a user whose status changed and the client ID mapping used to check the status of callers
+func (c *EMRChaincode) putUserStatus(ctx contractapi.TransactionContextInterface, user *User, changedBy string) error {
+	err := putUser(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	// Users registered before statuses existed have no client ID mapping yet
+	err = putUserID(ctx, user.UserID, user.CommonName)
+	if err != nil {
+		return err
+	}
+
+	return setEvent(ctx, EventUserStatusChanged, UserStatusChangedEvent{
+		UserID:    user.UserID,
+		Status:    user.Status,
+		ChangedBy: changedBy,
+	})
+}
+
+// isActiveUser checks if the user of a client ID is active, clients without a registered user are considered active
+func (c *EMRChaincode) isActiveUser(ctx contractapi.TransactionContextInterface, clientID string) (bool, error) {
+	user, err := c.userByClientID(ctx, clientID)
+	if err != nil {
+		return false, err
+	}
+	return user == nil || user.isActive(), nil
+}
+
+// userByClientID retrieves the user registered with a client ID, nil if there is none
+func (c *EMRChaincode) userByClientID(ctx contractapi.TransactionContextInterface, clientID string) (*User, error) {
+	key, err := userIDKey(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	commonName, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user of client ID: %v", err)
+	}
+	if commonName == nil {
+		return nil, nil
+	}
+
+	return c.GetUser(ctx, string(commonName))
+}
+
+// putUserID maps a client ID, the one a user registered with or a certificate linked to it, to the CommonName of the user
+func putUserID(ctx contractapi.TransactionContextInterface, clientID string, commonName string) error {
+	key, err := userIDKey(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().PutState(key, []byte(commonName))
+	if err != nil {
+		return fmt.Errorf("failed to write user ID mapping: %v", err)
+	}
+	return nil
+}
+
+// userIDKey returns the world state key mapping a client ID to the CommonName of its user
+func userIDKey(ctx contractapi.TransactionContextInterface, clientID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(userIDObjectType, []string{clientID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create user ID key: %v", err)
+	}
+	return key, nil
+}
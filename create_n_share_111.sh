@@ -36,10 +36,13 @@ export PEER0_ORG2_CA=${PWD}/organizations/peerOrganizations/org2.example.com/tls
 
 echo "1. Creating EMR as doctor1..."
 set_user_env "Org1" "doctor1" "7051"
+# The clinical data is passed in the transient map so it stays off the public ledger
+CONTENT=$(echo -n '{"schemaVersion":"1","diagnosis":"not actually sick"}' | base64 | tr -d '\n')
 peer chaincode invoke -o localhost:7050 --ordererTLSHostnameOverride orderer.example.com --tls --cafile $ORDERER_CA \
 -C emrchannel -n emr --peerAddresses localhost:7051 --tlsRootCertFiles $PEER0_ORG1_CA \
 --peerAddresses localhost:9051 --tlsRootCertFiles $PEER0_ORG2_CA \
--c '{"Args":["CreateRecord","EMR111","patient1@org2.example.com","doctor1@org1.example.com","hospital1@org1.example.com","not actually sick"]}'
+-c '{"Args":["CreateRecord","EMR111","patient1@org2.example.com","doctor1@org1.example.com","hospital1@org1.example.com"]}' \
+--transient "{\"content\":\"$CONTENT\"}"
 sleep 3
 
 echo -e "\n2. Testing access as patient2 (should fail)..."
@@ -65,7 +68,7 @@ set_user_env "Org1" "doctor1" "7051"
 peer chaincode invoke -o localhost:7050 --ordererTLSHostnameOverride orderer.example.com --tls --cafile $ORDERER_CA \
 -C emrchannel -n emr --peerAddresses localhost:7051 --tlsRootCertFiles $PEER0_ORG1_CA \
 --peerAddresses localhost:9051 --tlsRootCertFiles $PEER0_ORG2_CA \
--c '{"Args":["ShareRecord","EMR111","doctor2@org1.example.com","doctor"]}'
+-c '{"Args":["ShareRecord","EMR111","doctor2@org1.example.com","doctor","0","read"]}'
 sleep 3
 
 echo -e "\n5. Verifying doctor2 access (should succeed)..."
@@ -77,7 +80,7 @@ set_user_env "Org1" "doctor1" "7051"
 peer chaincode invoke -o localhost:7050 --ordererTLSHostnameOverride orderer.example.com --tls --cafile $ORDERER_CA \
 -C emrchannel -n emr --peerAddresses localhost:7051 --tlsRootCertFiles $PEER0_ORG1_CA \
 --peerAddresses localhost:9051 --tlsRootCertFiles $PEER0_ORG2_CA \
--c '{"Args":["ShareRecord","EMR111","hospital2@org1.example.com","hospital"]}'
+-c '{"Args":["ShareRecord","EMR111","hospital2@org1.example.com","hospital","0","read"]}'
 sleep 3
 
 echo -e "\n7. Verifying hospital2 access (should succeed)..."
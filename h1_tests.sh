@@ -6,7 +6,7 @@
 #    - Confirm that the emrchannel has been created and that the organizations are joined to it.
 
 # 3. Deploy the "emrChaincode" to the channel:
-#    - Run: ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel
+#    - Run: ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel -cccg ./chaincode/collections_config.json
 #    - Wait for successful chaincode packaging, installing, approving, and committing.
 
 # 4. Validate the deployment:
@@ -22,12 +22,12 @@
 #    - If enrollment errors appear, re-run registerEnroll.sh or fix configurations in Fabric-CA.
 #    - If chaincode install fails, review logs for error messages, check Go version/dependencies, and re-try the deployment steps.
 
-# ./network.sh down && ./network.sh up createChannel -ca && ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel
+# ./network.sh down && ./network.sh up createChannel -ca && ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel -cccg ./chaincode/collections_config.json
 
 # Check if the network is up if not call ./network.sh up -ca -c emrchannel
 if ! docker ps | grep -q "orderer.example.com"; then
   echo "Network is not up. Starting the network..."
-  ./network.sh down && ./network.sh up createChannel -ca && ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel
+  ./network.sh down && ./network.sh up createChannel -ca && ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel -cccg ./chaincode/collections_config.json
   sleep 3
 fi
 echo "Network is up and running."
@@ -40,12 +40,12 @@ fi
 
 # Check if the chaincode is deployed
 if [ ! -d "chaincode" ]; then
-  echo "Please deploy the chaincode first. Use ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel"
+  echo "Please deploy the chaincode first. Use ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel -cccg ./chaincode/collections_config.json"
   exit 1
 fi
 # Check if the chaincode is installed
 if [ ! -d "organizations/peerOrganizations/org1.example.com/peers/peer0.org1.example.com/tls" ]; then
-  echo "Please install the chaincode first. Use ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel"
+  echo "Please install the chaincode first. Use ./network.sh deployCC -ccn emr -ccp ./chaincode -ccl go -c emrchannel -cccg ./chaincode/collections_config.json"
   exit 1
 fi
 
@@ -131,7 +131,7 @@ peer chaincode invoke -o localhost:7050 --ordererTLSHostnameOverride orderer.exa
 
 
 echo "Creating EMR001 with hospital1"
-peer chaincode invoke -o localhost:7050 --ordererTLSHostnameOverride orderer.example.com --tls --cafile ${ORDERER_CA} -C emrchannel -n emr --peerAddresses localhost:7051 --tlsRootCertFiles ${PWD}/organizations/peerOrganizations/org1.example.com/peers/peer0.org1.example.com/tls/ca.crt --peerAddresses localhost:9051 --tlsRootCertFiles ${PWD}/organizations/peerOrganizations/org2.example.com/peers/peer0.org2.example.com/tls/ca.crt -c '{"Args":["CreateRecord","EMR001","patient1","doctor1","hospital1","Common Cold"]}'
+peer chaincode invoke -o localhost:7050 --ordererTLSHostnameOverride orderer.example.com --tls --cafile ${ORDERER_CA} -C emrchannel -n emr --peerAddresses localhost:7051 --tlsRootCertFiles ${PWD}/organizations/peerOrganizations/org1.example.com/peers/peer0.org1.example.com/tls/ca.crt --peerAddresses localhost:9051 --tlsRootCertFiles ${PWD}/organizations/peerOrganizations/org2.example.com/peers/peer0.org2.example.com/tls/ca.crt -c '{"Args":["CreateRecord","EMR001","patient1","doctor1","hospital1"]}' --transient "{\"content\":\"$(echo -n '{"schemaVersion":"1","diagnosis":"Common Cold"}' | base64 | tr -d '\n')\"}"
 sleep 3
 
 echo "Attempting query with Hospital1's MSP..."
@@ -277,6 +277,9 @@ measure_create_record() {
   
   echo "Testing CreateRecord: Doctor $doctor creating record $record_id for patient $patient at hospital $hospital (Attempt $attempt)"
   
+  # The clinical data is passed in the transient map so it stays off the public ledger
+  local content=$(echo -n '{"schemaVersion":"1","diagnosis":"Latency test record"}' | base64 | tr -d '\n')
+  
   # Measure start time
   local start_time=$(date +%s.%N)
   
@@ -287,7 +290,8 @@ measure_create_record() {
     -C emrchannel -n emr \
     --peerAddresses localhost:7051 --tlsRootCertFiles $PEER0_ORG1_CA \
     --peerAddresses localhost:9051 --tlsRootCertFiles $PEER0_ORG2_CA \
-    -c "{\"Args\":[\"CreateRecord\",\"$record_id\",\"$patient@org2.example.com\",\"$doctor@org1.example.com\",\"$hospital@org1.example.com\",\"Latency test record\"]}" \
+    -c "{\"Args\":[\"CreateRecord\",\"$record_id\",\"$patient@org2.example.com\",\"$doctor@org1.example.com\",\"$hospital@org1.example.com\"]}" \
+    --transient "{\"content\":\"$content\"}" \
     --waitForEvent 2>&1 > /dev/null; then
     echo "Failed to create record $record_id"
     return 1
@@ -397,7 +401,7 @@ measure_share_record() {
     -C emrchannel -n emr \
     --peerAddresses localhost:7051 --tlsRootCertFiles $PEER0_ORG1_CA \
     --peerAddresses localhost:9051 --tlsRootCertFiles $PEER0_ORG2_CA \
-    -c "{\"Args\":[\"ShareRecord\",\"$record_id\",\"$target_user@$target_domain\",\"$target_type\"]}" \
+    -c "{\"Args\":[\"ShareRecord\",\"$record_id\",\"$target_user@$target_domain\",\"$target_type\",\"0\",\"read\"]}" \
     --waitForEvent 2>&1 > /dev/null; then
     echo "Failed to share record $record_id with $target_type $target_user"
     return 1
@@ -359,6 +359,9 @@ perform_create_record() {
   
   setup_doctor_env "$doctor"
   
+  # The clinical data is passed in the transient map so it stays off the public ledger
+  local content=$(echo -n '{"schemaVersion":"1","diagnosis":"Throughput test record"}' | base64 | tr -d '\n')
+  
   local start_time=$(date +%s.%N)
   
   # Execute CreateRecord transaction
@@ -368,7 +371,8 @@ perform_create_record() {
     -C emrchannel -n emr \
     --peerAddresses localhost:7051 --tlsRootCertFiles $PEER0_ORG1_CA \
     --peerAddresses localhost:9051 --tlsRootCertFiles $PEER0_ORG2_CA \
-    -c "{\"Args\":[\"CreateRecord\",\"$record_id\",\"$patient@org2.example.com\",\"$doctor@org1.example.com\",\"$hospital@org1.example.com\",\"Throughput test record\"]}" \
+    -c "{\"Args\":[\"CreateRecord\",\"$record_id\",\"$patient@org2.example.com\",\"$doctor@org1.example.com\",\"$hospital@org1.example.com\"]}" \
+    --transient "{\"content\":\"$content\"}" \
     --waitForEvent 2>&1 > /dev/null; then
     
     local end_time=$(date +%s.%N)
@@ -632,7 +636,7 @@ perform_share_record() {
     -C emrchannel -n emr \
     --peerAddresses localhost:7051 --tlsRootCertFiles $PEER0_ORG1_CA \
     --peerAddresses localhost:9051 --tlsRootCertFiles $PEER0_ORG2_CA \
-    -c "{\"Args\":[\"ShareRecord\",\"$record_id\",\"$target_user@$target_domain\",\"$target_type\"]}" \
+    -c "{\"Args\":[\"ShareRecord\",\"$record_id\",\"$target_user@$target_domain\",\"$target_type\",\"0\",\"read\"]}" \
     --waitForEvent 2>&1 > /dev/null; then
     
     local end_time=$(date +%s.%N)
@@ -0,0 +1,48 @@
+#!/bin/bash
+
+# Checks a local copy of an attached document against the hash and size anchored by AttachDocument
+# Usage: ./verify_attachment.sh <file> <emrID> <docID>
+# The peer environment (CORE_PEER_*) must be set for a user that can read the record
+
+# Exit on first error
+set -e
+
+# Import utils
+. scripts/utils.sh
+
+export PATH=${PWD}/../bin:$PATH
+export FABRIC_CFG_PATH=${PWD}/../config/
+
+if [ $# -ne 3 ]; then
+  fatalln "Usage: $0 <file> <emrID> <docID>"
+fi
+
+file=$1
+emr_id=$2
+doc_id=$3
+
+if [ ! -f "$file" ]; then
+  fatalln "File not found: $file"
+fi
+
+infoln "Fetching the attachments of $emr_id"
+attachments=$(peer chaincode query -C emrchannel -n emr -c "{\"Args\":[\"ListAttachments\",\"$emr_id\"]}")
+
+anchored=$(echo "$attachments" | jq -c --arg doc "$doc_id" '.[] | select(.docId == $doc)')
+if [ -z "$anchored" ]; then
+  fatalln "Document $doc_id is not attached to $emr_id"
+fi
+
+expected_hash=$(echo "$anchored" | jq -r '.sha256')
+expected_size=$(echo "$anchored" | jq -r '.sizeBytes')
+actual_hash=$(sha256sum "$file" | cut -d ' ' -f 1)
+actual_size=$(wc -c < "$file" | tr -d ' ')
+
+if [ "$actual_size" != "$expected_size" ]; then
+  fatalln "Size mismatch for $doc_id: anchored $expected_size bytes, file has $actual_size bytes"
+fi
+if [ "$actual_hash" != "$expected_hash" ]; then
+  fatalln "Hash mismatch for $doc_id: anchored $expected_hash, file has $actual_hash"
+fi
+
+successln "$file matches document $doc_id of $emr_id"